@@ -19,13 +19,19 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/lxc/incus/shared/units"
 	"github.com/pkg/errors"
 )
 
 type IncusRemoteProtocol string
 type IncusImageType string
+type BootstrapMode string
 
 func (l IncusImageType) String() string {
 	return string(l)
@@ -33,23 +39,53 @@ func (l IncusImageType) String() string {
 
 const (
 	SimpleStreams            IncusRemoteProtocol = "simplestreams"
+	IncusProtocol            IncusRemoteProtocol = "incus"
+	OCI                      IncusRemoteProtocol = "oci"
 	IncusImageVirtualMachine IncusImageType      = "virtual-machine"
 	IncusImageContainer      IncusImageType      = "container"
+
+	// BootstrapCloudInit passes the runner install script to cloud-init through the
+	// instance config. This is the default.
+	BootstrapCloudInit BootstrapMode = "cloud-init"
+	// BootstrapExec pushes the runner install script into the instance and runs it
+	// through the Incus exec API, for images without cloud-init.
+	BootstrapExec BootstrapMode = "exec"
+
+	// DefaultIPWaitTimeout is the time we wait for a new instance to get an IP address
+	// if ip_wait_timeout is not set.
+	DefaultIPWaitTimeout = 120 * time.Second
+
+	// DefaultAgentWaitTimeout is the time we wait for the Incus agent of a new virtual
+	// machine to come up if agent_wait_timeout is not set.
+	DefaultAgentWaitTimeout = 120 * time.Second
+
+	// DefaultRemoveConcurrency is the number of instances removed in parallel if
+	// remove_concurrency is not set.
+	DefaultRemoveConcurrency = 10
 )
 
 // IncusImageRemote holds information about a remote server from which Incus can fetch
-// OS images. Typically this will be a simplestreams server.
+// OS images. This can be a simplestreams server, another Incus server or an OCI registry.
 type IncusImageRemote struct {
-	Address            string              `toml:"addr" json:"addr"`
-	Public             bool                `toml:"public" json:"public"`
-	Protocol           IncusRemoteProtocol `toml:"protocol" json:"protocol"`
-	InsecureSkipVerify bool                `toml:"skip_verify" json:"skip-verify"`
+	Address            string              `toml:"addr" json:"addr" jsonschema:"required,description=The address of the image remote."`
+	Public             bool                `toml:"public" json:"public" jsonschema:"description=Whether or not the image remote is public."`
+	Protocol           IncusRemoteProtocol `toml:"protocol" json:"protocol" jsonschema:"required,enum=simplestreams,enum=incus,enum=oci,description=The protocol used by the image remote."`
+	InsecureSkipVerify bool                `toml:"skip_verify" json:"skip-verify" jsonschema:"description=Skip TLS verification when connecting to the image remote."`
+
+	// ClientCertificate and ClientKey are used to authenticate against remotes using
+	// the incus protocol, that are not public.
+	ClientCertificate string `toml:"client_certificate" json:"client-certificate" jsonschema:"description=Path to the x509 client certificate used to authenticate against a private incus remote."`
+	ClientKey         string `toml:"client_key" json:"client-key" jsonschema:"description=Path to the key used to authenticate against a private incus remote."`
+	// TLSServerCert is the certificate of a remote using the incus protocol. If not
+	// specified, the system CA is used.
+	TLSServerCert string `toml:"tls_server_certificate" json:"tls-server-certificate" jsonschema:"description=Path to the TLS certificate of an incus remote."`
 }
 
 func (l *IncusImageRemote) Validate() error {
-	if l.Protocol != SimpleStreams {
-		// Only supports simplestreams for now.
-		return fmt.Errorf("invalid remote protocol %s. Supported protocols: %s", l.Protocol, SimpleStreams)
+	switch l.Protocol {
+	case SimpleStreams, IncusProtocol, OCI:
+	default:
+		return fmt.Errorf("invalid remote protocol %s. Supported protocols: %s, %s, %s", l.Protocol, SimpleStreams, IncusProtocol, OCI)
 	}
 	if l.Address == "" {
 		return fmt.Errorf("missing address")
@@ -64,13 +100,219 @@ func (l *IncusImageRemote) Validate() error {
 		return fmt.Errorf("address must be http or https")
 	}
 
+	if l.Protocol != IncusProtocol {
+		if l.ClientCertificate != "" || l.ClientKey != "" || l.TLSServerCert != "" {
+			return fmt.Errorf("client_certificate, client_key and tls_server_certificate are only supported by the %s protocol", IncusProtocol)
+		}
+		return nil
+	}
+
+	if url.Scheme != "https" {
+		return fmt.Errorf("address must be https for the %s protocol", IncusProtocol)
+	}
+
+	if !l.Public && (l.ClientCertificate == "" || l.ClientKey == "") {
+		return fmt.Errorf("client_certificate and client_key are mandatory for private %s remotes", IncusProtocol)
+	}
+
+	for _, file := range []string{l.ClientCertificate, l.ClientKey, l.TLSServerCert} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("failed to access %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// Passthrough holds the policy that decides which raw Incus config keys and devices
+// pool authors are allowed to set through extra specs. If no allow or deny list is
+// set, passthrough is disabled.
+type Passthrough struct {
+	// AllowedConfigPrefixes is a list of config key prefixes pool authors may set.
+	// If empty, all keys not matching DeniedConfigPrefixes are allowed.
+	AllowedConfigPrefixes []string `toml:"allowed_config_prefixes" json:"allowed-config-prefixes" jsonschema:"description=Config key prefixes pool authors may set through extra specs."`
+	// DeniedConfigPrefixes is a list of config key prefixes pool authors may not set.
+	// This list takes precedence over AllowedConfigPrefixes.
+	DeniedConfigPrefixes []string `toml:"denied_config_prefixes" json:"denied-config-prefixes" jsonschema:"description=Config key prefixes pool authors may not set through extra specs."`
+	// AllowedDeviceTypes is a list of device types (disk, proxy, nic, etc) pool
+	// authors may add. If empty, all types not in DeniedDeviceTypes are allowed.
+	AllowedDeviceTypes []string `toml:"allowed_device_types" json:"allowed-device-types" jsonschema:"description=Device types pool authors may add through extra specs."`
+	// DeniedDeviceTypes is a list of device types pool authors may not add. This
+	// list takes precedence over AllowedDeviceTypes.
+	DeniedDeviceTypes []string `toml:"denied_device_types" json:"denied-device-types" jsonschema:"description=Device types pool authors may not add through extra specs."`
+}
+
+func (p *Passthrough) configEnabled() bool {
+	return len(p.AllowedConfigPrefixes) > 0 || len(p.DeniedConfigPrefixes) > 0
+}
+
+func (p *Passthrough) devicesEnabled() bool {
+	return len(p.AllowedDeviceTypes) > 0 || len(p.DeniedDeviceTypes) > 0
+}
+
+// IsConfigKeyAllowed returns true if pool authors may set the given config key.
+func (p *Passthrough) IsConfigKeyAllowed(key string) bool {
+	if !p.configEnabled() {
+		return false
+	}
+
+	for _, prefix := range p.DeniedConfigPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return false
+		}
+	}
+
+	if len(p.AllowedConfigPrefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range p.AllowedConfigPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDeviceTypeAllowed returns true if pool authors may add devices of the given type.
+func (p *Passthrough) IsDeviceTypeAllowed(deviceType string) bool {
+	if !p.devicesEnabled() {
+		return false
+	}
+
+	if slices.Contains(p.DeniedDeviceTypes, deviceType) {
+		return false
+	}
+
+	if len(p.AllowedDeviceTypes) == 0 {
+		return true
+	}
+	return slices.Contains(p.AllowedDeviceTypes, deviceType)
+}
+
+func (p *Passthrough) Validate() error {
+	for _, prefix := range append(p.AllowedConfigPrefixes, p.DeniedConfigPrefixes...) {
+		if prefix == "" {
+			return fmt.Errorf("config prefixes may not be empty")
+		}
+	}
+	for _, deviceType := range append(p.AllowedDeviceTypes, p.DeniedDeviceTypes...) {
+		if deviceType == "" {
+			return fmt.Errorf("device types may not be empty")
+		}
+	}
+	return nil
+}
+
+// ProjectFeatures holds the features enabled on a managed project. Each enabled
+// feature isolates the respective resources from the default project. Images and
+// profiles are isolated unless disabled, like in projects created through Incus.
+type ProjectFeatures struct {
+	Images         *bool `toml:"images" json:"images" jsonschema:"description=Isolate images from the default project. Defaults to true."`
+	Profiles       *bool `toml:"profiles" json:"profiles" jsonschema:"description=Isolate profiles from the default project. Defaults to true."`
+	Networks       bool  `toml:"networks" json:"networks" jsonschema:"description=Isolate networks from the default project."`
+	StorageVolumes bool  `toml:"storage_volumes" json:"storage-volumes" jsonschema:"description=Isolate storage volumes from the default project."`
+}
+
+// GetImages returns whether images are isolated from the default project.
+func (f ProjectFeatures) GetImages() bool {
+	return f.Images == nil || *f.Images
+}
+
+// GetProfiles returns whether profiles are isolated from the default project.
+func (f ProjectFeatures) GetProfiles() bool {
+	return f.Profiles == nil || *f.Profiles
+}
+
+// ProjectLimits holds the limits applied to a managed project. A zero value means
+// no limit.
+type ProjectLimits struct {
+	Instances uint   `toml:"instances" json:"instances" jsonschema:"description=The maximum number of instances in the project."`
+	CPU       uint   `toml:"cpu" json:"cpu" jsonschema:"description=The maximum number of CPUs all instances in the project can use."`
+	Memory    string `toml:"memory" json:"memory" jsonschema:"description=The maximum amount of memory all instances in the project can use (ex: 64GiB)."`
+}
+
+// ManagedProject holds the settings the provider applies to the project when
+// manage_project is enabled.
+type ManagedProject struct {
+	Features ProjectFeatures `toml:"features" json:"features" jsonschema:"description=The features enabled on the project."`
+	Limits   ProjectLimits   `toml:"limits" json:"limits" jsonschema:"description=The limits applied to the project."`
+}
+
+func (m *ManagedProject) Validate() error {
+	if m.Limits.Memory != "" {
+		if _, err := units.ParseByteSizeString(m.Limits.Memory); err != nil {
+			return fmt.Errorf("invalid memory limit %s: %w", m.Limits.Memory, err)
+		}
+	}
+	return nil
+}
+
+// FlavorNIC describes a network interface added to instances using a flavor. Either
+// Network or NICType and Parent must be set.
+type FlavorNIC struct {
+	Network string `toml:"network" json:"network" jsonschema:"description=The managed network the NIC is attached to."`
+	NICType string `toml:"nictype" json:"nictype" jsonschema:"description=The NIC type (bridged or macvlan etc) when not using a managed network."`
+	Parent  string `toml:"parent" json:"parent" jsonschema:"description=The host interface the NIC is attached to when not using a managed network."`
+}
+
+func (f *FlavorNIC) Validate() error {
+	if f.Network == "" && (f.NICType == "" || f.Parent == "") {
+		return fmt.Errorf("either network or nictype and parent must be set")
+	}
+	if f.Network != "" && (f.NICType != "" || f.Parent != "") {
+		return fmt.Errorf("network can not be used together with nictype or parent")
+	}
+	return nil
+}
+
+// Flavor describes the size of a runner. Every flavor is translated into an Incus
+// profile with the same name, which is created or updated by the provider as needed.
+type Flavor struct {
+	Description string               `toml:"description" json:"description" jsonschema:"description=The description of the profile."`
+	CPU         uint                 `toml:"cpu" json:"cpu" jsonschema:"description=The number of CPUs of the instance."`
+	Memory      string               `toml:"memory" json:"memory" jsonschema:"description=The amount of memory of the instance (ex: 4GiB)."`
+	DiskSize    string               `toml:"disk_size" json:"disk-size" jsonschema:"description=The size of the root disk (ex: 20GiB)."`
+	DiskPool    string               `toml:"disk_pool" json:"disk-pool" jsonschema:"description=The storage pool of the root disk. Mandatory if disk_size is set."`
+	NICs        map[string]FlavorNIC `toml:"nics" json:"nics" jsonschema:"description=The network interfaces of the instance. The key is the name of the NIC."`
+	Config      map[string]string    `toml:"config" json:"config" jsonschema:"description=Extra Incus config keys set on the profile."`
+}
+
+func (f *Flavor) Validate() error {
+	if f.Memory != "" {
+		if _, err := units.ParseByteSizeString(f.Memory); err != nil {
+			return fmt.Errorf("invalid memory %s: %w", f.Memory, err)
+		}
+	}
+
+	if f.DiskSize != "" {
+		if f.DiskPool == "" {
+			return fmt.Errorf("disk_pool is mandatory when disk_size is set")
+		}
+		if _, err := units.ParseByteSizeString(f.DiskSize); err != nil {
+			return fmt.Errorf("invalid disk_size %s: %w", f.DiskSize, err)
+		}
+	}
+
+	for name, nic := range f.NICs {
+		if err := nic.Validate(); err != nil {
+			return fmt.Errorf("nic %s is invalid: %w", name, err)
+		}
+	}
 	return nil
 }
 
 // NewConfig returns a new Config
 func NewConfig(cfgFile string) (*Incus, error) {
 	var config Incus
-	if _, err := toml.DecodeFile(cfgFile, &config); err != nil {
+	md, err := toml.DecodeFile(cfgFile, &config)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding config: %w", err)
+	}
+
+	if err := checkUndecodedKeys(cfgFile, md); err != nil {
 		return nil, fmt.Errorf("error decoding config: %w", err)
 	}
 
@@ -84,40 +326,103 @@ func NewConfig(cfgFile string) (*Incus, error) {
 type Incus struct {
 	// UnixSocket is the path on disk to the Incus unix socket. If defined,
 	// this is prefered over connecting via HTTPs.
-	UnixSocket string `toml:"unix_socket_path" json:"unix-socket-path"`
+	UnixSocket string `toml:"unix_socket_path" json:"unix-socket-path" jsonschema:"description=The path on disk to the Incus unix socket."`
 
 	// Project name is the name of the project in which this runner will create
 	// instances. If this option is not set, the default project will be used.
 	// The project used here, must have all required profiles created by you
-	// beforehand. For Incus, the "flavor" used in the runner definition for a pool
-	// equates to a profile in the desired project.
-	ProjectName string `toml:"project_name" json:"project-name"`
+	// beforehand, unless they are defined in Flavors. For Incus, the "flavor" used
+	// in the runner definition for a pool equates to a profile in the desired project.
+	ProjectName string `toml:"project_name" json:"project-name" jsonschema:"description=The Incus project in which runners will be created."`
 
 	// IncludeDefaultProfile specifies whether or not this provider will always add
 	// the "default" profile to any newly created instance.
-	IncludeDefaultProfile bool `toml:"include_default_profile" json:"include-default-profile"`
+	IncludeDefaultProfile bool `toml:"include_default_profile" json:"include-default-profile" jsonschema:"description=Always add the default profile to new instances."`
 
 	// URL holds the URL of the remote Incus server.
 	// example: https://10.10.10.1:8443/
-	URL string `toml:"url" json:"url"`
+	URL string `toml:"url" json:"url" jsonschema:"description=The URL of the remote Incus server."`
 	// ClientCertificate is the x509 client certificate path used for authentication.
-	ClientCertificate string `toml:"client_certificate" json:"client_certificate"`
+	ClientCertificate string `toml:"client_certificate" json:"client_certificate" jsonschema:"description=Path to the x509 client certificate used for authentication."`
 	// ClientKey is the key used for client certificate authentication.
-	ClientKey string `toml:"client_key" json:"client-key"`
+	ClientKey string `toml:"client_key" json:"client-key" jsonschema:"description=Path to the key used for client certificate authentication."`
 	// TLS certificate of the remote server. If not specified, the system CA is used.
-	TLSServerCert string `toml:"tls_server_certificate" json:"tls-server-certificate"`
+	TLSServerCert string `toml:"tls_server_certificate" json:"tls-server-certificate" jsonschema:"description=Path to the TLS certificate of the remote server."`
 	// TLSCA is the TLS CA certificate when running Incus in PKI mode.
-	TLSCA string `toml:"tls_ca" json:"tls-ca"`
+	TLSCA string `toml:"tls_ca" json:"tls-ca" jsonschema:"description=Path to the TLS CA certificate when running Incus in PKI mode."`
+
+	// Endpoints is a list of additional Incus endpoints. Each endpoint is either an
+	// https URL or the path to a unix socket (optionally prefixed with unix://). The
+	// provider tries the unix socket, the URL and then these endpoints in order, and
+	// uses the first one that responds. This allows the provider to keep working if
+	// a member of an Incus cluster is down.
+	Endpoints []string `toml:"endpoints" json:"endpoints" jsonschema:"description=Additional Incus endpoints (https URLs or unix socket paths) tried in order if the previous ones are not reachable."`
+
+	// IPWaitTimeout is the number of seconds to wait for a new instance to get an IP
+	// address, before giving up. Defaults to 120 seconds.
+	IPWaitTimeout uint `toml:"ip_wait_timeout" json:"ip-wait-timeout" jsonschema:"description=Number of seconds to wait for a new instance to get an IP address. Defaults to 120."`
+
+	// RemoveConcurrency is the number of instances removed in parallel when GARM asks
+	// the provider to remove all instances. Defaults to 10.
+	RemoveConcurrency uint `toml:"remove_concurrency" json:"remove-concurrency" jsonschema:"description=Number of instances removed in parallel when removing all instances. Defaults to 10."`
+
+	// SkipOwnershipCheck allows the provider to get, start, stop and delete instances
+	// that were not created by this controller. This is meant to be used by admins
+	// to clean up instances, and should never be enabled in the config GARM uses.
+	SkipOwnershipCheck bool `toml:"skip_ownership_check" json:"skip-ownership-check" jsonschema:"description=Allow acting on instances not created by this controller. Only meant for admin cleanup."`
+
+	// KeepUserData disables removing the user data from instances once cloud-init is done with it.
+	// The user data holds the GARM instance token, so this should only be enabled
+	// when debugging the bootstrap process.
+	KeepUserData bool `toml:"keep_user_data" json:"keep-user-data" jsonschema:"description=Keep the user data (which holds the runner token) in the instance config after it boots. Only meant for debugging."`
+
+	// UseCloudInitKeys makes the provider pass the cloud-init data to instances using
+	// the cloud-init.* config keys, instead of the legacy user.* keys. Images with an
+	// old cloud-init or Incus agent may only support the legacy keys.
+	UseCloudInitKeys bool `toml:"use_cloud_init_keys" json:"use-cloud-init-keys" jsonschema:"description=Use the cloud-init.* config keys instead of the legacy user.* keys for the cloud-init data of instances."`
+
+	// VendorData is the cloud-init vendor data set on all instances. Vendor data is
+	// merged with the user data generated by the provider, and can be used to apply
+	// site wide settings (mirrors, proxies, CA certificates etc) to all runners.
+	VendorData string `toml:"vendor_data" json:"vendor-data" jsonschema:"description=The cloud-init vendor data set on all instances."`
+
+	// NetworkConfig is the cloud-init network config set on all instances.
+	NetworkConfig string `toml:"network_config" json:"network-config" jsonschema:"description=The cloud-init network config set on all instances."`
+
+	// BootstrapMode is the way the runner install script is run on new instances. It
+	// defaults to cloud-init. The exec mode allows using images without cloud-init.
+	BootstrapMode BootstrapMode `toml:"bootstrap_mode" json:"bootstrap-mode" jsonschema:"enum=cloud-init,enum=exec,description=How the runner install script is run on new instances. Defaults to cloud-init."`
+
+	// AgentWaitTimeout is the number of seconds to wait for the Incus agent of a new
+	// virtual machine to come up, when using the exec bootstrap mode. Defaults to 120.
+	AgentWaitTimeout uint `toml:"agent_wait_timeout" json:"agent-wait-timeout" jsonschema:"description=Number of seconds to wait for the Incus agent of a new virtual machine when using the exec bootstrap mode. Defaults to 120."`
 
 	// ImageRemotes is a map to a set of remote image repositories we can use to
 	// download images.
-	ImageRemotes map[string]IncusImageRemote `toml:"image_remotes" json:"image-remotes"`
+	ImageRemotes map[string]IncusImageRemote `toml:"image_remotes" json:"image-remotes" jsonschema:"required,description=A map of remote image repositories used to download images."`
 
 	// SecureBoot enables secure boot for VMs spun up using this provider.
-	SecureBoot bool `toml:"secure_boot" json:"secure-boot"`
+	SecureBoot bool `toml:"secure_boot" json:"secure-boot" jsonschema:"description=Enable secure boot for virtual machines."`
 
 	// InstanceType allows you to choose between a virtual machine and a container
-	InstanceType IncusImageType `toml:"instance_type" json:"instance-type"`
+	InstanceType IncusImageType `toml:"instance_type" json:"instance-type" jsonschema:"enum=virtual-machine,enum=container,description=The type of instances this provider will create."`
+
+	// ManageProject enables the creation of the project if it is missing. The limits
+	// defined in Project are reconciled every time the provider runs. The features are
+	// only set when the project is created, as Incus does not allow changing them on a
+	// project that has instances.
+	ManageProject bool `toml:"manage_project" json:"manage-project" jsonschema:"description=Create the project if missing and reconcile its limits. Features are only set when the project is created."`
+
+	// Project holds the features and limits of the project, if ManageProject is enabled.
+	Project ManagedProject `toml:"project" json:"project" jsonschema:"description=The features and limits of the project when manage_project is enabled."`
+
+	// Flavors is a map of flavor definitions. Each flavor is kept in sync with an Incus
+	// profile of the same name in the project, which is created if missing.
+	Flavors map[string]Flavor `toml:"flavors" json:"flavors" jsonschema:"description=Flavor definitions that are turned into Incus profiles by the provider."`
+
+	// Passthrough controls which raw Incus config keys and devices pool authors may
+	// set through the "config" and "devices" extra specs.
+	Passthrough Passthrough `toml:"passthrough" json:"passthrough" jsonschema:"description=Controls which raw Incus config keys and devices pool authors may set through extra specs."`
 }
 
 func (l *Incus) GetInstanceType() IncusImageType {
@@ -129,26 +434,140 @@ func (l *Incus) GetInstanceType() IncusImageType {
 	}
 }
 
+// GetIPWaitTimeout returns the time to wait for a new instance to get an IP address.
+func (l *Incus) GetIPWaitTimeout() time.Duration {
+	if l.IPWaitTimeout == 0 {
+		return DefaultIPWaitTimeout
+	}
+	return time.Duration(l.IPWaitTimeout) * time.Second
+}
+
+// GetBootstrapMode returns the way the runner install script is run on new instances.
+func (l *Incus) GetBootstrapMode() BootstrapMode {
+	switch l.BootstrapMode {
+	case BootstrapCloudInit, BootstrapExec:
+		return l.BootstrapMode
+	default:
+		return BootstrapCloudInit
+	}
+}
+
+// GetAgentWaitTimeout returns the time to wait for the Incus agent of a new virtual machine.
+func (l *Incus) GetAgentWaitTimeout() time.Duration {
+	if l.AgentWaitTimeout == 0 {
+		return DefaultAgentWaitTimeout
+	}
+	return time.Duration(l.AgentWaitTimeout) * time.Second
+}
+
+// GetRemoveConcurrency returns the number of instances to remove in parallel.
+func (l *Incus) GetRemoveConcurrency() int {
+	if l.RemoveConcurrency == 0 {
+		return DefaultRemoveConcurrency
+	}
+	return int(l.RemoveConcurrency)
+}
+
+// GetEndpoints returns all configured Incus endpoints, in the order in which they
+// should be tried. If a unix socket is set and no client certificate is, URLs are
+// left out, as they can't be used without one. This keeps configs that set both the
+// unix socket and an URL working, as the URL used to be ignored when the socket was set.
+func (l *Incus) GetEndpoints() []string {
+	unixSocket := l.UnixSocket
+	if unixSocket != "" && !strings.HasPrefix(unixSocket, "unix://") {
+		unixSocket = "unix://" + unixSocket
+	}
+	skipURLs := unixSocket != "" && l.ClientCertificate == "" && l.ClientKey == ""
+
+	endpoints := []string{}
+	for _, endpoint := range append([]string{unixSocket, l.URL}, l.Endpoints...) {
+		if endpoint == "" || slices.Contains(endpoints, endpoint) {
+			continue
+		}
+		if _, ok := UnixSocketPath(endpoint); !ok && skipURLs {
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
+
+// UnixSocketPath returns the path to the unix socket if the endpoint refers to one.
+func UnixSocketPath(endpoint string) (string, bool) {
+	if strings.HasPrefix(endpoint, "unix://") {
+		return strings.TrimPrefix(endpoint, "unix://"), true
+	}
+	if filepath.IsAbs(endpoint) {
+		return endpoint, true
+	}
+	return "", false
+}
+
 func (l *Incus) Validate() error {
-	if l.UnixSocket != "" {
-		if _, err := os.Stat(l.UnixSocket); err != nil {
-			return fmt.Errorf("could not access unix socket %s: %w", l.UnixSocket, err)
+	if err := l.Passthrough.Validate(); err != nil {
+		return fmt.Errorf("passthrough is invalid: %w", err)
+	}
+
+	switch l.BootstrapMode {
+	case "", BootstrapCloudInit, BootstrapExec:
+	default:
+		return fmt.Errorf("invalid bootstrap_mode %s. Supported modes: %s, %s", l.BootstrapMode, BootstrapCloudInit, BootstrapExec)
+	}
+
+	if l.ManageProject {
+		if l.ProjectName == "default" {
+			return fmt.Errorf("manage_project can not be used with the default project")
 		}
+		if err := l.Project.Validate(); err != nil {
+			return fmt.Errorf("project is invalid: %w", err)
+		}
+	}
 
-		return nil
+	for name, flavor := range l.Flavors {
+		if name == "default" {
+			return fmt.Errorf("flavor default is invalid: the default profile of the project can not be used as a flavor")
+		}
+		if err := flavor.Validate(); err != nil {
+			return fmt.Errorf("flavor %s is invalid: %w", name, err)
+		}
 	}
 
-	if l.URL == "" {
+	for name, val := range l.ImageRemotes {
+		if err := val.Validate(); err != nil {
+			return fmt.Errorf("remote %s is invalid: %s", name, err)
+		}
+	}
+
+	endpoints := l.GetEndpoints()
+	if len(endpoints) == 0 {
 		return fmt.Errorf("unix_socket or address must be specified")
 	}
 
-	url, err := url.ParseRequestURI(l.URL)
-	if err != nil {
-		return fmt.Errorf("invalid Incus URL")
+	hasURL := false
+	for _, endpoint := range endpoints {
+		// Endpoints that are down are skipped when connecting, so only the syntax is
+		// checked here. A missing unix socket must not keep us from failing over to
+		// the other endpoints.
+		if socket, ok := UnixSocketPath(endpoint); ok {
+			if !filepath.IsAbs(socket) {
+				return fmt.Errorf("unix socket path %s must be absolute", socket)
+			}
+			continue
+		}
+
+		url, err := url.ParseRequestURI(endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid Incus URL")
+		}
+
+		if url.Scheme != "https" {
+			return fmt.Errorf("address must be https")
+		}
+		hasURL = true
 	}
 
-	if url.Scheme != "https" {
-		return fmt.Errorf("address must be https")
+	if !hasURL {
+		return nil
 	}
 
 	if l.ClientCertificate == "" || l.ClientKey == "" {
@@ -169,10 +588,5 @@ func (l *Incus) Validate() error {
 		}
 	}
 
-	for name, val := range l.ImageRemotes {
-		if err := val.Validate(); err != nil {
-			return fmt.Errorf("remote %s is invalid: %s", name, err)
-		}
-	}
 	return nil
 }
@@ -16,7 +16,9 @@
 package config
 
 import (
+	"encoding/json"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -94,7 +96,17 @@ func TestIncusWithInvalidUnixSocket(t *testing.T) {
 	cfg.UnixSocket = "bogus unix socket"
 	err := cfg.Validate()
 	require.NotNil(t, err)
-	require.ErrorIs(t, err, os.ErrNotExist)
+	require.EqualError(t, err, "unix socket path bogus unix socket must be absolute")
+}
+
+func TestIncusWithMissingUnixSocket(t *testing.T) {
+	cfg := getDefaultIncusConfig()
+
+	// The socket may be down while the other endpoints are up, so it is only
+	// checked when connecting.
+	cfg.UnixSocket = filepath.Join(t.TempDir(), "missing.socket")
+	err := cfg.Validate()
+	require.NoError(t, err)
 }
 
 func TestMissingUnixSocketAndMissingURL(t *testing.T) {
@@ -126,6 +138,56 @@ func TestIncusURLIsHTTPS(t *testing.T) {
 	require.EqualError(t, err, "address must be https")
 }
 
+func TestGetEndpoints(t *testing.T) {
+	cfg := getDefaultIncusConfig()
+	cfg.UnixSocket = "/var/lib/incus/unix.socket"
+	cfg.Endpoints = []string{
+		"https://member2.example.com:8443",
+		"https://example.com:8443",
+		"unix:///run/incus/unix.socket",
+	}
+
+	require.Equal(t, []string{
+		"unix:///var/lib/incus/unix.socket",
+		"https://example.com:8443",
+		"https://member2.example.com:8443",
+		"unix:///run/incus/unix.socket",
+	}, cfg.GetEndpoints())
+}
+
+func TestInvalidEndpoints(t *testing.T) {
+	cfg := getDefaultIncusConfig()
+	cfg.Endpoints = []string{"http://member2.example.com:8443"}
+	require.EqualError(t, cfg.Validate(), "address must be https")
+
+	cfg = getDefaultIncusConfig()
+	cfg.Endpoints = []string{"unix://i/am/not/absolute"}
+	err := cfg.Validate()
+	require.EqualError(t, err, "unix socket path i/am/not/absolute must be absolute")
+
+	// Client certificates are needed as soon as any endpoint is an URL.
+	cfg = getDefaultIncusConfig()
+	cfg.ClientCertificate = ""
+	cfg.Endpoints = []string{"https://member2.example.com:8443", "/var/lib/incus/unix.socket"}
+	require.EqualError(t, cfg.Validate(), "client_certificate and client_key are mandatory")
+}
+
+func TestUnixSocketWithoutClientCert(t *testing.T) {
+	// URLs are ignored if the unix socket is set and no client certificate is, like
+	// they were before multiple endpoints were supported.
+	cfg := getDefaultIncusConfig()
+	cfg.UnixSocket = "/var/lib/incus/unix.socket"
+	cfg.ClientCertificate = ""
+	cfg.ClientKey = ""
+	cfg.Endpoints = []string{"https://member2.example.com:8443"}
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, []string{"unix:///var/lib/incus/unix.socket"}, cfg.GetEndpoints())
+
+	// If only one of them is set, the config is most likely incomplete.
+	cfg.ClientKey = "../testdata/incus/certs/client.key"
+	require.EqualError(t, cfg.Validate(), "client_certificate and client_key are mandatory")
+}
+
 func TestMissingClientCertOrKey(t *testing.T) {
 	cfg := getDefaultIncusConfig()
 	cfg.ClientKey = ""
@@ -173,5 +235,389 @@ func TestInvalidIncusImageRemotes(t *testing.T) {
 
 	err := cfg.Validate()
 	require.NotNil(t, err)
-	require.EqualError(t, err, "remote default is invalid: invalid remote protocol bogus. Supported protocols: simplestreams")
+	require.EqualError(t, err, "remote default is invalid: invalid remote protocol bogus. Supported protocols: simplestreams, incus, oci")
+}
+
+func TestInvalidImageRemotesWithUnixSocket(t *testing.T) {
+	cfg := getDefaultIncusConfig()
+	cfg.URL = ""
+	cfg.ClientCertificate = ""
+	cfg.ClientKey = ""
+	cfg.TLSServerCert = ""
+	cfg.UnixSocket = "/var/lib/incus/unix.socket"
+	require.NoError(t, cfg.Validate())
+
+	cfg.ImageRemotes["default"] = IncusImageRemote{
+		Address:  "https://images.example.com:8443",
+		Protocol: IncusProtocol,
+	}
+	err := cfg.Validate()
+	require.EqualError(t, err, "remote default is invalid: client_certificate and client_key are mandatory for private incus remotes")
+}
+
+func TestIncusProtocolImageRemotes(t *testing.T) {
+	tests := []struct {
+		name        string
+		remote      IncusImageRemote
+		errorString string
+	}{
+		{
+			name: "private incus remote",
+			remote: IncusImageRemote{
+				Address:           "https://images.example.com:8443",
+				Protocol:          IncusProtocol,
+				ClientCertificate: "../testdata/incus/certs/client.crt",
+				ClientKey:         "../testdata/incus/certs/client.key",
+				TLSServerCert:     "../testdata/incus/certs/servercert.crt",
+			},
+		},
+		{
+			name: "public incus remote",
+			remote: IncusImageRemote{
+				Address:  "https://images.example.com:8443",
+				Protocol: IncusProtocol,
+				Public:   true,
+			},
+		},
+		{
+			name: "oci remote",
+			remote: IncusImageRemote{
+				Address:  "https://docker.io",
+				Protocol: OCI,
+				Public:   true,
+			},
+		},
+		{
+			name: "incus remote over http",
+			remote: IncusImageRemote{
+				Address:  "http://images.example.com:8443",
+				Protocol: IncusProtocol,
+				Public:   true,
+			},
+			errorString: "remote default is invalid: address must be https for the incus protocol",
+		},
+		{
+			name: "private incus remote without client certificate",
+			remote: IncusImageRemote{
+				Address:  "https://images.example.com:8443",
+				Protocol: IncusProtocol,
+			},
+			errorString: "remote default is invalid: client_certificate and client_key are mandatory for private incus remotes",
+		},
+		{
+			name: "incus remote with missing certificate file",
+			remote: IncusImageRemote{
+				Address:           "https://images.example.com:8443",
+				Protocol:          IncusProtocol,
+				ClientCertificate: "/i/am/not/here",
+				ClientKey:         "../testdata/incus/certs/client.key",
+			},
+			errorString: "remote default is invalid: failed to access /i/am/not/here: stat /i/am/not/here: no such file or directory",
+		},
+		{
+			name: "oci remote with client certificate",
+			remote: IncusImageRemote{
+				Address:           "https://docker.io",
+				Protocol:          OCI,
+				ClientCertificate: "../testdata/incus/certs/client.crt",
+			},
+			errorString: "remote default is invalid: client_certificate, client_key and tls_server_certificate are only supported by the incus protocol",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := getDefaultIncusConfig()
+			cfg.ImageRemotes["default"] = tt.remote
+
+			err := cfg.Validate()
+			if tt.errorString == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tt.errorString)
+			}
+		})
+	}
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	cfgFile := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(cfgFile, []byte(contents), 0o600)
+	require.NoError(t, err)
+	return cfgFile
+}
+
+func TestNewConfig(t *testing.T) {
+	cfg, err := NewConfig("../testdata/garm-provider-incus.toml")
+	require.NoError(t, err)
+	require.Equal(t, "default", cfg.ProjectName)
+}
+
+func TestNewConfigUnknownKeys(t *testing.T) {
+	cfgFile := writeConfigFile(t, `url = "https://example.com:8443"
+client_certificate = "../testdata/incus/certs/client.crt"
+client_key = "../testdata/incus/certs/client.key"
+unix_socket = "/var/lib/incus/unix.socket"
+
+[image_remotes]
+    [image_remotes.images]
+    addr = "https://images.linuxcontainers.org"
+    protocol = "simplestreams"
+    skip-verify = false
+`)
+
+	_, err := NewConfig(cfgFile)
+	require.NotNil(t, err)
+	require.EqualError(t, err, `error decoding config: unknown config keys: "unix_socket" (line 4), "image_remotes.images.skip-verify" (line 10)`)
+}
+
+func TestGenerateJSONSchema(t *testing.T) {
+	schema := GenerateJSONSchema()
+	asJSON, err := json.Marshal(schema)
+	require.NoError(t, err)
+
+	require.Contains(t, string(asJSON), `"unix_socket_path"`)
+	require.Contains(t, string(asJSON), `"skip_verify"`)
+	require.Contains(t, string(asJSON), `"additionalProperties":false`)
+	require.NotContains(t, string(asJSON), `"unix-socket-path"`)
+
+	require.Equal(t, []string{"image_remotes"}, schema.Definitions["Incus"].Required)
+	require.Equal(t, []string{"addr", "protocol"}, schema.Definitions["IncusImageRemote"].Required)
+	require.Empty(t, schema.Definitions["Flavor"].Required)
+}
+
+func TestPassthroughConfigKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Passthrough
+		allowed map[string]bool
+	}{
+		{
+			name:   "disabled by default",
+			policy: Passthrough{},
+			allowed: map[string]bool{
+				"linux.kernel_modules": false,
+				"raw.qemu":             false,
+			},
+		},
+		{
+			name: "allow list",
+			policy: Passthrough{
+				AllowedConfigPrefixes: []string{"linux.kernel_modules", "security.syscalls.intercept."},
+			},
+			allowed: map[string]bool{
+				"linux.kernel_modules":              true,
+				"security.syscalls.intercept.mknod": true,
+				"security.privileged":               false,
+				"raw.qemu":                          false,
+			},
+		},
+		{
+			name: "deny list",
+			policy: Passthrough{
+				DeniedConfigPrefixes: []string{"security.", "raw."},
+			},
+			allowed: map[string]bool{
+				"linux.kernel_modules": true,
+				"security.privileged":  false,
+				"raw.lxc":              false,
+			},
+		},
+		{
+			name: "deny list takes precedence",
+			policy: Passthrough{
+				AllowedConfigPrefixes: []string{"security."},
+				DeniedConfigPrefixes:  []string{"security.privileged"},
+			},
+			allowed: map[string]bool{
+				"security.nesting":    true,
+				"security.privileged": false,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, allowed := range tt.allowed {
+				require.Equal(t, allowed, tt.policy.IsConfigKeyAllowed(key), key)
+			}
+		})
+	}
+}
+
+func TestPassthroughDeviceTypes(t *testing.T) {
+	policy := Passthrough{}
+	require.False(t, policy.IsDeviceTypeAllowed("disk"))
+
+	policy = Passthrough{
+		AllowedDeviceTypes: []string{"disk", "proxy"},
+	}
+	require.True(t, policy.IsDeviceTypeAllowed("proxy"))
+	require.False(t, policy.IsDeviceTypeAllowed("unix-char"))
+
+	policy = Passthrough{
+		DeniedDeviceTypes: []string{"unix-char", "unix-block"},
+	}
+	require.True(t, policy.IsDeviceTypeAllowed("disk"))
+	require.False(t, policy.IsDeviceTypeAllowed("unix-block"))
+}
+
+func TestInvalidPassthrough(t *testing.T) {
+	cfg := getDefaultIncusConfig()
+	cfg.Passthrough = Passthrough{
+		AllowedConfigPrefixes: []string{""},
+	}
+
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "passthrough is invalid: config prefixes may not be empty")
+}
+
+func TestManageDefaultProject(t *testing.T) {
+	cfg := getDefaultIncusConfig()
+	cfg.ManageProject = true
+
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "manage_project can not be used with the default project")
+}
+
+func TestBootstrapMode(t *testing.T) {
+	cfg := getDefaultIncusConfig()
+	require.Equal(t, BootstrapCloudInit, cfg.GetBootstrapMode())
+
+	cfg.BootstrapMode = BootstrapExec
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, BootstrapExec, cfg.GetBootstrapMode())
+
+	cfg.BootstrapMode = "ssh"
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.EqualError(t, err, "invalid bootstrap_mode ssh. Supported modes: cloud-init, exec")
+}
+
+func TestManagedProjectInvalidMemory(t *testing.T) {
+	cfg := getDefaultIncusConfig()
+	cfg.ProjectName = "runners"
+	cfg.ManageProject = true
+	cfg.Project.Limits.Memory = "lots"
+
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	require.ErrorContains(t, err, "project is invalid: invalid memory limit lots")
+}
+
+func TestProjectFeaturesDefaults(t *testing.T) {
+	// Images and profiles are isolated by default, like in projects created through
+	// Incus.
+	features := ProjectFeatures{}
+	require.True(t, features.GetImages())
+	require.True(t, features.GetProfiles())
+
+	disabled := false
+	features = ProjectFeatures{Images: &disabled, Profiles: &disabled}
+	require.False(t, features.GetImages())
+	require.False(t, features.GetProfiles())
+}
+
+func TestInvalidFlavors(t *testing.T) {
+	tests := []struct {
+		name      string
+		flavor    Flavor
+		errString string
+	}{
+		{
+			name:      "invalid memory",
+			flavor:    Flavor{Memory: "lots"},
+			errString: "flavor small is invalid: invalid memory lots",
+		},
+		{
+			name:      "disk size without pool",
+			flavor:    Flavor{DiskSize: "20GiB"},
+			errString: "flavor small is invalid: disk_pool is mandatory when disk_size is set",
+		},
+		{
+			name: "nic without network or parent",
+			flavor: Flavor{
+				NICs: map[string]FlavorNIC{
+					"eth0": {NICType: "bridged"},
+				},
+			},
+			errString: "flavor small is invalid: nic eth0 is invalid: either network or nictype and parent must be set",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := getDefaultIncusConfig()
+			cfg.Flavors = map[string]Flavor{
+				"small": tt.flavor,
+			}
+			err := cfg.Validate()
+			require.NotNil(t, err)
+			require.ErrorContains(t, err, tt.errString)
+		})
+	}
+}
+
+func TestDefaultFlavor(t *testing.T) {
+	cfg := getDefaultIncusConfig()
+	cfg.Flavors = map[string]Flavor{
+		"default": {CPU: 2},
+	}
+	err := cfg.Validate()
+	require.EqualError(t, err, "flavor default is invalid: the default profile of the project can not be used as a flavor")
+}
+
+func TestNewConfigUnknownKeysInValues(t *testing.T) {
+	cfgFile := writeConfigFile(t, `url = "https://example.com:8443"
+client_certificate = "../testdata/incus/certs/client.crt"
+client_key = "../testdata/incus/certs/client.key"
+vendor_data = """
+unix_socket = "/var/lib/incus/unix.socket"
+"""
+unix_socket = "/var/lib/incus/unix.socket"
+
+[image_remotes]
+    [image_remotes.images]
+    addr = "https://images.linuxcontainers.org"
+    protocol = "simplestreams"
+    skip-verify = false
+`)
+
+	_, err := NewConfig(cfgFile)
+	require.NotNil(t, err)
+	require.EqualError(t, err, `error decoding config: unknown config keys: "unix_socket" (line 7), "image_remotes.images.skip-verify" (line 13)`)
+}
+
+func TestKeyLines(t *testing.T) {
+	lines := keyLines(`name = "test" # a [comment
+motd = '''
+[fake]
+fake = true
+'''
+packages = [
+    "a = b",
+    { key = "value" },
+]
+limits = { cpu = 2, memory = "1GiB" }
+
+[[pools]]
+id = "one"
+
+[[pools]]
+id = "two"
+
+[flavors.small]
+cpu = 1
+`)
+
+	require.Equal(t, map[string]int{
+		"name":              1,
+		"motd":              2,
+		"packages":          6,
+		"limits":            10,
+		"flavors.small":     18,
+		"flavors.small.cpu": 19,
+	}, lines)
 }
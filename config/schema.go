@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/invopop/jsonschema"
+)
+
+var (
+	tableHeaderRe = regexp.MustCompile(`^\s*\[\[?\s*([^\]]+?)\s*\]\]?\s*(#.*)?$`)
+	keyValueRe    = regexp.MustCompile(`^\s*([A-Za-z0-9_\-."' ]+?)\s*=`)
+)
+
+// GenerateJSONSchema returns the JSON schema of the provider config file.
+func GenerateJSONSchema() *jsonschema.Schema {
+	reflector := jsonschema.Reflector{
+		AllowAdditionalProperties: false,
+		// The provider config is a TOML file, so the schema must describe
+		// the TOML keys, not the JSON ones.
+		FieldNameTag: "toml",
+		// None of the TOML tags use omitempty, so mandatory keys are marked as
+		// required in the jsonschema tags instead.
+		RequiredFromJSONSchemaTags: true,
+	}
+	schema := reflector.Reflect(Incus{})
+
+	return schema
+}
+
+// splitKey splits a dotted TOML key into its components, removing any quotes.
+func splitKey(key string) []string {
+	parts := strings.Split(key, ".")
+	for idx, part := range parts {
+		parts[idx] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+	return parts
+}
+
+// tomlScanner tracks the multi-line constructs of a TOML document (strings,
+// arrays and inline tables) across lines, so that lines which are part of a
+// value are not mistaken for keys.
+type tomlScanner struct {
+	// delim is the delimiter of the multi-line string we are in, if any.
+	delim string
+	// depth is the nesting depth of arrays and inline tables.
+	depth int
+}
+
+// topLevel returns true if the next line starts outside of any value.
+func (s *tomlScanner) topLevel() bool {
+	return s.delim == "" && s.depth == 0
+}
+
+// scan updates the scanner state with the contents of a line.
+func (s *tomlScanner) scan(line string) {
+	for i := 0; i < len(line); i++ {
+		if s.delim != "" {
+			switch {
+			case s.delim == `"""` && line[i] == '\\':
+				i++
+			case strings.HasPrefix(line[i:], s.delim):
+				i += len(s.delim) - 1
+				s.delim = ""
+			}
+			continue
+		}
+
+		switch c := line[i]; {
+		case c == '#':
+			return
+		case strings.HasPrefix(line[i:], `"""`), strings.HasPrefix(line[i:], "'''"):
+			s.delim = line[i : i+3]
+			i += 2
+		case c == '"':
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return
+			}
+			i += end + 1
+		case c == '[', c == '{':
+			s.depth++
+		case c == ']', c == '}':
+			if s.depth > 0 {
+				s.depth--
+			}
+		}
+	}
+}
+
+// keyLines maps every key in a TOML document to the line it was defined on.
+// Keys are only looked up on lines that start outside of a value, so lines of
+// multi-line strings, arrays and inline tables are never reported. Keys that
+// are defined more than once, like the keys of array tables, can't be located
+// unambiguously and are left out.
+func keyLines(contents string) map[string]int {
+	ret := map[string]int{}
+	seen := map[string]int{}
+	var table []string
+	scanner := &tomlScanner{}
+	for idx, line := range strings.Split(contents, "\n") {
+		topLevel := scanner.topLevel()
+		scanner.scan(line)
+		if !topLevel {
+			continue
+		}
+
+		var key []string
+		if match := tableHeaderRe.FindStringSubmatch(line); match != nil {
+			table = splitKey(match[1])
+			key = table
+		} else if match := keyValueRe.FindStringSubmatch(line); match != nil {
+			key = append(append([]string{}, table...), splitKey(match[1])...)
+		} else {
+			continue
+		}
+
+		name := toml.Key(key).String()
+		seen[name]++
+		if _, ok := ret[name]; !ok {
+			ret[name] = idx + 1
+		}
+	}
+
+	for name, count := range seen {
+		if count > 1 {
+			delete(ret, name)
+		}
+	}
+	return ret
+}
+
+// checkUndecodedKeys returns an error listing all keys in the config file that
+// do not map to a config option. Those are almost always typos.
+func checkUndecodedKeys(cfgFile string, md toml.MetaData) error {
+	undecoded := md.Undecoded()
+	if len(undecoded) == 0 {
+		return nil
+	}
+
+	contents, err := os.ReadFile(cfgFile)
+	if err != nil {
+		return fmt.Errorf("error reading config: %w", err)
+	}
+	lines := keyLines(string(contents))
+
+	unknown := make([]string, 0, len(undecoded))
+	for _, key := range undecoded {
+		if line, ok := lines[key.String()]; ok {
+			unknown = append(unknown, fmt.Sprintf("%q (line %d)", key.String(), line))
+			continue
+		}
+		unknown = append(unknown, fmt.Sprintf("%q", key.String()))
+	}
+	return fmt.Errorf("unknown config keys: %s", strings.Join(unknown, ", "))
+}
@@ -39,6 +39,16 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), signals...)
 	defer stop()
 
+	// GARM runs the provider without any arguments. Arguments are used to run the
+	// provider subcommands, like baking runner images.
+	if len(os.Args) > 1 {
+		if err := provider.RunCommand(ctx, os.Args[1:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to run %s: %s\n", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	executionEnv, err := execution.GetEnvironment()
 	if err != nil {
 		log.Fatal(err)
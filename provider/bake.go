@@ -0,0 +1,285 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-incus/config"
+	"github.com/pkg/errors"
+
+	"github.com/lxc/incus/shared/api"
+)
+
+const (
+	// bakeInstancePrefix is the name prefix of the instances images are baked in.
+	bakeInstancePrefix = "garm-bake-"
+	// bakeControllerID is the controller ID the bake command runs as. The instances
+	// images are baked in are marked with it, so failed launches get rolled back like
+	// the ones of runners.
+	bakeControllerID = "garm-bake"
+	// bakedFromPropertyName is the image property recording the image a baked image
+	// was baked from. It marks the images the prune command may remove.
+	bakedFromPropertyName = "garm.baked-from"
+	// bakeVersionFormat is the format of the default version of a baked image.
+	bakeVersionFormat = "20060102-1504"
+	runnerReleaseURL  = "https://github.com/actions/runner/releases/download/v%[1]s/actions-runner-linux-%[2]s-%[1]s.tar.gz"
+)
+
+// runnerArchMap maps the architectures of the provider to the ones used in the
+// names of the GitHub runner releases.
+var runnerArchMap = map[commonParams.OSArch]string{
+	commonParams.Amd64: "x64",
+	commonParams.Arm64: "arm64",
+	commonParams.Arm:   "arm",
+}
+
+// bakeOptions holds the options of the bake command.
+type bakeOptions struct {
+	image        string
+	alias        string
+	version      string
+	flavor       string
+	osArch       commonParams.OSArch
+	instanceType config.IncusImageType
+	runnerURL    string
+}
+
+// bakeResult describes an image published by the bake command.
+type bakeResult struct {
+	alias          string
+	versionedAlias string
+	fingerprint    string
+	size           int64
+}
+
+// getRunnerURL returns the URL of the GitHub release of the runner, for the given
+// runner version and architecture.
+func getRunnerURL(version string, osArch commonParams.OSArch) (string, error) {
+	arch, ok := runnerArchMap[osArch]
+	if !ok {
+		return "", fmt.Errorf("architecture %s is not supported", osArch)
+	}
+	return fmt.Sprintf(runnerReleaseURL, strings.TrimPrefix(version, "v"), arch), nil
+}
+
+func runBake(ctx context.Context, args []string, out io.Writer) error {
+	fs, configFile := newFlagSet("bake", "", "Publish a local image with the GitHub runner and its dependencies installed")
+	opts := bakeOptions{}
+	fs.StringVar(&opts.image, "image", "", "image to install the runner in, in the same format as the image of a pool")
+	fs.StringVar(&opts.alias, "alias", "", "alias of the published image")
+	fs.StringVar(&opts.version, "version", "", "version of the published image, which also gets the alias <alias>/<version> (default: the current UTC time)")
+	fs.StringVar(&opts.flavor, "flavor", "", "flavor (profile) of the instance the image is baked in")
+	arch := fs.String("arch", string(commonParams.Amd64), "architecture of the image: amd64, arm64 or arm")
+	instanceType := fs.String("instance-type", "", "instance type of the image: container or virtual-machine (default: the instance type in the provider config)")
+	runnerVersion := fs.String("runner-version", "", "version of the GitHub runner to install, for example 2.319.1")
+	fs.StringVar(&opts.runnerURL, "runner-url", "", "URL of the runner archive to install, instead of the GitHub release of --runner-version")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlags(fs, "config", "image", "alias", "flavor"); err != nil {
+		return err
+	}
+
+	opts.osArch = commonParams.OSArch(*arch)
+	switch {
+	case opts.runnerURL != "" && *runnerVersion != "":
+		return fmt.Errorf("only one of --runner-url and --runner-version can be set")
+	case opts.runnerURL == "" && *runnerVersion == "":
+		return fmt.Errorf("one of --runner-url and --runner-version is required")
+	case opts.runnerURL == "":
+		url, err := getRunnerURL(*runnerVersion, opts.osArch)
+		if err != nil {
+			return errors.Wrap(err, "getting runner URL")
+		}
+		opts.runnerURL = url
+	}
+
+	l, err := newIncus(*configFile, bakeControllerID)
+	if err != nil {
+		return errors.Wrap(err, "creating provider")
+	}
+
+	opts.instanceType, err = parseInstanceType(*instanceType, l.cfg)
+	if err != nil {
+		return err
+	}
+	if opts.version == "" {
+		opts.version = time.Now().UTC().Format(bakeVersionFormat)
+	}
+
+	result, err := l.bakeImage(ctx, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "alias:       %s\n", result.alias)
+	fmt.Fprintf(out, "version:     %s\n", result.versionedAlias)
+	fmt.Fprintf(out, "fingerprint: %s\n", result.fingerprint)
+	fmt.Fprintf(out, "size:        %d\n", result.size)
+	return nil
+}
+
+// bakeImage launches an instance from the base image, installs the runner in it and
+// publishes it as a local image. The image gets the <alias>/<version> alias, and the
+// alias itself is moved to the new image. Pools reference the image by its alias,
+// without a remote, so new runners pick up the image as soon as it is published.
+func (l *Incus) bakeImage(ctx context.Context, opts bakeOptions) (bakeResult, error) {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return bakeResult{}, errors.Wrap(err, "fetching client")
+	}
+
+	versionedAlias := opts.alias + "/" + opts.version
+	if _, _, err := cli.GetImageAlias(versionedAlias); err == nil {
+		return bakeResult{}, runnerErrors.NewBadRequestError("image alias %s already exists", versionedAlias)
+	} else if !isNotFoundError(err) {
+		return bakeResult{}, errors.Wrapf(err, "fetching image alias %s", versionedAlias)
+	}
+
+	profiles, err := l.ensureProfiles(ctx, opts.flavor)
+	if err != nil {
+		return bakeResult{}, errors.Wrap(err, "fetching profiles")
+	}
+
+	arch, err := resolveArchitecture(opts.osArch)
+	if err != nil {
+		return bakeResult{}, errors.Wrap(err, "fetching architecture")
+	}
+
+	instanceSource, err := l.imageManager.getInstanceSource(opts.image, opts.instanceType, arch, cli)
+	if err != nil {
+		return bakeResult{}, errors.Wrap(err, "getting instance source")
+	}
+
+	configMap := map[string]string{
+		controllerIDKeyName: l.controllerID,
+	}
+	if opts.instanceType == config.IncusImageVirtualMachine {
+		configMap["security.secureboot"] = l.secureBootEnabled()
+	}
+
+	instanceName := fmt.Sprintf("%s%d", bakeInstancePrefix, time.Now().Unix())
+	args := api.InstancesPost{
+		InstancePut: api.InstancePut{
+			Architecture: arch,
+			Profiles:     profiles,
+			Description:  fmt.Sprintf("Instance used by garm to bake image %s", versionedAlias),
+			Config:       configMap,
+		},
+		Source: instanceSource,
+		Name:   instanceName,
+		Type:   api.InstanceType(opts.instanceType),
+	}
+	if err := l.launchInstance(ctx, args); err != nil {
+		return bakeResult{}, errors.Wrap(err, "launching instance")
+	}
+	defer func() {
+		if err := l.deleteInstance(context.Background(), instanceName); err != nil {
+			fmt.Fprintf(bootstrapLog, "failed to remove instance %s: %s\n", instanceName, err)
+		}
+	}()
+
+	if err := l.installRunner(ctx, instanceName, opts.instanceType, opts.runnerURL, ""); err != nil {
+		return bakeResult{}, err
+	}
+
+	if err := l.setState(ctx, instanceName, "stop", false); err != nil {
+		return bakeResult{}, errors.Wrap(err, "stopping instance")
+	}
+
+	description := fmt.Sprintf("GARM runner image baked from %s", opts.image)
+	op, err := cli.CreateImage(api.ImagesPost{
+		ImagePut: api.ImagePut{
+			Properties: map[string]string{
+				"description":         description,
+				bakedFromPropertyName: opts.image,
+			},
+		},
+		Source: &api.ImagesPostSource{
+			Type: "instance",
+			Name: instanceName,
+		},
+		Aliases: []api.ImageAlias{
+			{
+				Name:        versionedAlias,
+				Description: description,
+			},
+		},
+	}, nil)
+	if err != nil {
+		return bakeResult{}, errors.Wrap(err, "publishing image")
+	}
+	if err := op.WaitContext(ctx); err != nil {
+		return bakeResult{}, errors.Wrap(err, "waiting for image to be published")
+	}
+	fingerprint, ok := op.Get().Metadata["fingerprint"].(string)
+	if !ok {
+		return bakeResult{}, fmt.Errorf("failed to get the fingerprint of the published image")
+	}
+
+	image, _, err := cli.GetImage(fingerprint)
+	if err != nil {
+		return bakeResult{}, errors.Wrap(err, "fetching published image")
+	}
+
+	if err := setImageAlias(cli, opts.alias, fingerprint, description); err != nil {
+		return bakeResult{}, errors.Wrapf(err, "setting image alias %s", opts.alias)
+	}
+
+	return bakeResult{
+		alias:          opts.alias,
+		versionedAlias: versionedAlias,
+		fingerprint:    fingerprint,
+		size:           image.Size,
+	}, nil
+}
+
+// setImageAlias points an image alias to the image with the given fingerprint,
+// creating the alias if it does not exist.
+func setImageAlias(cli InstanceServerInterface, name string, fingerprint string, description string) error {
+	entry := api.ImageAliasesEntryPut{
+		Description: description,
+		Target:      fingerprint,
+	}
+
+	_, etag, err := cli.GetImageAlias(name)
+	if err != nil {
+		if !isNotFoundError(err) {
+			return errors.Wrap(err, "fetching image alias")
+		}
+		err := cli.CreateImageAlias(api.ImageAliasesPost{
+			ImageAliasesEntry: api.ImageAliasesEntry{
+				ImageAliasesEntryPut: entry,
+				Name:                 name,
+			},
+		})
+		if err != nil {
+			return errors.Wrap(err, "creating image alias")
+		}
+		return nil
+	}
+
+	if err := cli.UpdateImageAlias(name, entry, etag); err != nil {
+		return errors.Wrap(err, "updating image alias")
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-incus/config"
+	incus "github.com/lxc/incus/client"
+	"github.com/lxc/incus/shared/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRunnerURL(t *testing.T) {
+	url, err := getRunnerURL("v2.319.1", commonParams.Arm64)
+	require.NoError(t, err)
+	assert.Equal(t, "https://github.com/actions/runner/releases/download/v2.319.1/actions-runner-linux-arm64-2.319.1.tar.gz", url)
+
+	_, err = getRunnerURL("2.319.1", commonParams.OSArch("s390x"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "architecture s390x is not supported")
+}
+
+func TestBakeImage(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+	bootstrapLog = io.Discard
+	t.Cleanup(func() {
+		bootstrapLog = os.Stderr
+	})
+
+	l := &Incus{
+		cfg: &config.Incus{
+			UnixSocket:   "/var/run/incus.sock",
+			InstanceType: config.IncusImageContainer,
+		},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: bakeControllerID,
+	}
+	opts := bakeOptions{
+		image:        "ubuntu",
+		alias:        "garm-ubuntu",
+		version:      "v1",
+		flavor:       "default",
+		osArch:       commonParams.Amd64,
+		instanceType: config.IncusImageContainer,
+		runnerURL:    "https://example.com/runner.tar.gz",
+	}
+
+	aliases := map[string]*api.ImageAliasesEntry{
+		"x86_64": {
+			Name: "ubuntu",
+			Type: "container",
+		},
+	}
+	cli.On("GetImageAlias", "garm-ubuntu/v1").Return(nil, "", api.StatusErrorf(http.StatusNotFound, "Image alias not found"))
+	cli.On("GetImageAlias", "garm-ubuntu").Return(&api.ImageAliasesEntry{Name: "garm-ubuntu"}, "etag", nil)
+	cli.On("GetImageAliasArchitectures", config.IncusImageContainer.String(), "ubuntu").Return(aliases, nil)
+	cli.On("GetImage", aliases["x86_64"].Target).Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	cli.On("GetProfileNames").Return([]string{"default"}, nil)
+	mockOp := new(MockOperation)
+	mockOp.On("Wait").Return(nil)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+	cli.On("CreateInstance", mock.MatchedBy(func(args api.InstancesPost) bool {
+		return args.Source.Fingerprint == "123abc" && args.Type == "container" && args.Config[controllerIDKeyName] == bakeControllerID
+	})).Return(mockOp, nil)
+	cli.On("UpdateInstanceState", mock.Anything, mock.Anything, "").Return(mockOp, nil)
+	cli.On("GetEvents").Return(nil, assert.AnError)
+	cli.On("GetInstanceFull", mock.Anything).Return(&api.InstanceFull{
+		Instance: api.Instance{
+			Type: "container",
+		},
+		State: &api.InstanceState{
+			Status: "Running",
+			Network: map[string]api.InstanceStateNetwork{
+				"eth0": {
+					Addresses: []api.InstanceStateNetworkAddress{
+						{
+							Family:  "inet",
+							Address: "10.10.0.2",
+							Scope:   "global",
+						},
+					},
+				},
+			},
+		},
+	}, "", nil)
+	pushed := map[string]string{}
+	cli.On("CreateInstanceFile", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		fileArgs := args.Get(2).(incus.InstanceFileArgs)
+		if fileArgs.Type == "directory" {
+			pushed[args.String(1)] = "directory"
+			return
+		}
+		contents, err := io.ReadAll(fileArgs.Content)
+		require.NoError(t, err)
+		pushed[args.String(1)] = string(contents)
+	}).Return(nil)
+	// The name of the instance is based on the current time.
+	mockBootstrapExec(cli, mock.Anything, "runner installed\n", 0)
+	publishOp := new(MockOperation)
+	publishOp.On("WaitContext", mock.Anything).Return(nil)
+	publishOp.On("Get").Return(api.Operation{
+		Metadata: map[string]any{
+			"fingerprint": "456def",
+		},
+	})
+	cli.On("CreateImage", mock.MatchedBy(func(req api.ImagesPost) bool {
+		return req.Source.Type == "instance" && len(req.Aliases) == 1 && req.Aliases[0].Name == "garm-ubuntu/v1" && req.Properties[bakedFromPropertyName] == "ubuntu"
+	}), mock.Anything).Return(publishOp, nil)
+	cli.On("GetImage", "456def").Return(&api.Image{Fingerprint: "456def", Size: 1024}, "", nil)
+	cli.On("UpdateImageAlias", "garm-ubuntu", api.ImageAliasesEntryPut{
+		Description: "GARM runner image baked from ubuntu",
+		Target:      "456def",
+	}, "etag").Return(nil)
+	cli.On("DeleteInstance", mock.Anything).Return(mockOp, nil)
+
+	result, err := l.bakeImage(ctx, opts)
+	require.NoError(t, err)
+	assert.Equal(t, bakeResult{
+		alias:          "garm-ubuntu",
+		versionedAlias: "garm-ubuntu/v1",
+		fingerprint:    "456def",
+		size:           1024,
+	}, result)
+	assert.Equal(t, map[string]string{
+		bootstrapDir:      "directory",
+		prepareScriptPath: prepareScript,
+	}, pushed)
+	cli.AssertCalled(t, "ExecInstance", mock.Anything, mock.MatchedBy(func(req api.InstanceExecPost) bool {
+		return req.Command[1] == prepareScriptPath && req.Environment["RUNNER_URL"] == opts.runnerURL
+	}), mock.Anything)
+	cli.AssertCalled(t, "UpdateInstanceState", mock.Anything, api.InstanceStatePut{Action: "stop", Timeout: -1}, "")
+	cli.AssertCalled(t, "DeleteInstance", mock.Anything)
+	cli.AssertNotCalled(t, "CreateImageAlias", mock.Anything)
+}
+
+func TestBakeImageStartFails(t *testing.T) {
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg: &config.Incus{
+			UnixSocket: "/var/run/incus.sock",
+		},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: bakeControllerID,
+	}
+	opts := bakeOptions{
+		image:        "ubuntu",
+		alias:        "garm-ubuntu",
+		version:      "v1",
+		flavor:       "default",
+		osArch:       commonParams.Amd64,
+		instanceType: config.IncusImageContainer,
+		runnerURL:    "https://example.com/runner.tar.gz",
+	}
+
+	cli.On("GetImageAlias", "garm-ubuntu/v1").Return(nil, "", api.StatusErrorf(http.StatusNotFound, "Image alias not found"))
+	cli.On("GetImageAliasArchitectures", config.IncusImageContainer.String(), "ubuntu").Return(map[string]*api.ImageAliasesEntry{
+		"x86_64": {ImageAliasesEntryPut: api.ImageAliasesEntryPut{Target: "123abc"}},
+	}, nil)
+	cli.On("GetImage", "123abc").Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	cli.On("GetProfileNames").Return([]string{"default"}, nil)
+	createOp := new(MockOperation)
+	createOp.On("Wait").Return(nil)
+	// The rollback only removes the instance if it is marked with the controller ID
+	// of the bake command.
+	instance := &api.Instance{}
+	cli.On("CreateInstance", mock.Anything).Run(func(args mock.Arguments) {
+		instance.ExpandedConfig = args.Get(0).(api.InstancesPost).Config
+	}).Return(createOp, nil)
+	failedOp := new(MockOperation)
+	failedOp.On("Wait").Return(fmt.Errorf("failed to start"))
+	cli.On("UpdateInstanceState", mock.Anything, api.InstanceStatePut{Action: "start", Timeout: -1}, "").Return(failedOp, nil)
+	cli.On("GetInstance", mock.Anything).Return(instance, "", nil)
+	cli.On("GetInstanceConsoleLog", mock.Anything, mock.Anything).Return(nil, fmt.Errorf("not found"))
+	cli.On("GetInstanceFile", mock.Anything, mock.Anything).Return(nil, nil, fmt.Errorf("not found"))
+	cli.On("GetInstanceLogfiles", mock.Anything).Return(nil, fmt.Errorf("not found"))
+	stopOp := new(MockOperation)
+	stopOp.On("WaitContext", mock.Anything).Return(nil)
+	cli.On("UpdateInstanceState", mock.Anything, api.InstanceStatePut{Action: "stop", Timeout: -1, Force: true}, "").Return(stopOp, nil)
+	cli.On("DeleteInstance", mock.Anything).Return(stopOp, nil)
+
+	_, err := l.bakeImage(context.Background(), opts)
+	require.ErrorContains(t, err, "waiting for instance to start: failed to start")
+	assert.NotContains(t, err.Error(), "not removing instance")
+	cli.AssertCalled(t, "DeleteInstance", mock.Anything)
+}
+
+func TestBakeImageAliasExists(t *testing.T) {
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg: &config.Incus{
+			UnixSocket: "/var/run/incus.sock",
+		},
+		cli:          cli,
+		imageManager: &image{},
+	}
+	cli.On("GetImageAlias", "garm-ubuntu/v1").Return(&api.ImageAliasesEntry{Name: "garm-ubuntu/v1"}, "", nil)
+
+	_, err := l.bakeImage(context.Background(), bakeOptions{alias: "garm-ubuntu", version: "v1"})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+	assert.Contains(t, err.Error(), "image alias garm-ubuntu/v1 already exists")
+	cli.AssertNotCalled(t, "CreateInstance", mock.Anything)
+}
+
+func TestSetImageAliasCreate(t *testing.T) {
+	cli := new(MockIncusServer)
+	cli.On("GetImageAlias", "garm-ubuntu").Return(nil, "", api.StatusErrorf(http.StatusNotFound, "Image alias not found"))
+	cli.On("CreateImageAlias", api.ImageAliasesPost{
+		ImageAliasesEntry: api.ImageAliasesEntry{
+			ImageAliasesEntryPut: api.ImageAliasesEntryPut{
+				Description: "runner image",
+				Target:      "456def",
+			},
+			Name: "garm-ubuntu",
+		},
+	}).Return(nil)
+
+	err := setImageAlias(cli, "garm-ubuntu", "456def", "runner image")
+	require.NoError(t, err)
+	cli.AssertNotCalled(t, "UpdateImageAlias", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestRunCommand(t *testing.T) {
+	out := &bytes.Buffer{}
+
+	err := RunCommand(context.Background(), []string{"bake", "--config", "garm-provider-incus.toml", "--image", "ubuntu", "--alias", "garm-ubuntu"}, out)
+	require.Error(t, err)
+	assert.Equal(t, "missing required flag --flavor", err.Error())
+
+	err = RunCommand(context.Background(), []string{"unknown"}, out)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unknown command "unknown"`)
+	assert.Empty(t, out.String())
+}
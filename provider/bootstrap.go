@@ -0,0 +1,351 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudbase/garm-provider-common/defaults"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-incus/config"
+	"github.com/pkg/errors"
+
+	incus "github.com/lxc/incus/client"
+	"github.com/lxc/incus/shared/api"
+)
+
+const (
+	// bootstrapDir is the directory inside the instance that holds the files pushed
+	// by the exec bootstrap mode. It is removed once the bootstrap script is done.
+	bootstrapDir        = "/garm-bootstrap"
+	bootstrapScriptPath = bootstrapDir + "/bootstrap.sh"
+	installScriptPath   = bootstrapDir + "/install_runner.sh"
+	caBundlePath        = bootstrapDir + "/ca-bundle.crt"
+	preInstallDir       = bootstrapDir + "/pre-install"
+)
+
+// createRunnerUserScript creates the runner user with passwordless sudo, the way the
+// cloud-config generated by garm-provider-common does.
+const createRunnerUserScript = `if ! id "$RUNNER_USER" >/dev/null 2>&1; then
+	useradd -m -s /bin/bash "$RUNNER_USER"
+fi
+for group in $RUNNER_GROUPS; do
+	if getent group "$group" >/dev/null 2>&1; then
+		usermod -a -G "$group" "$RUNNER_USER"
+	fi
+done
+mkdir -p /etc/sudoers.d
+echo "$RUNNER_USER ALL=(ALL) NOPASSWD:ALL" > "/etc/sudoers.d/90-garm-$RUNNER_USER"
+chmod 0440 "/etc/sudoers.d/90-garm-$RUNNER_USER"
+`
+
+// bootstrapScript prepares an instance that has no cloud-init and runs the runner
+// install script. It does what cloud-init would otherwise do, based on the cloud-config
+// generated by garm-provider-common: it creates the runner user with passwordless sudo,
+// installs the CA bundle, runs the pre-install scripts and then the install script.
+const bootstrapScript = `#!/bin/sh
+set -e
+trap 'rm -rf "$BOOTSTRAP_DIR"' EXIT
+
+` + createRunnerUserScript + `
+if [ -f "$BOOTSTRAP_DIR/ca-bundle.crt" ]; then
+	if command -v update-ca-certificates >/dev/null 2>&1; then
+		mkdir -p /usr/local/share/ca-certificates
+		cp "$BOOTSTRAP_DIR/ca-bundle.crt" /usr/local/share/ca-certificates/garm-ca-bundle.crt
+		update-ca-certificates
+	elif command -v update-ca-trust >/dev/null 2>&1; then
+		cp "$BOOTSTRAP_DIR/ca-bundle.crt" /etc/pki/ca-trust/source/anchors/garm-ca-bundle.crt
+		update-ca-trust extract
+	else
+		echo "no supported tool found to install the CA bundle" >&2
+		exit 1
+	fi
+fi
+
+for script in "$BOOTSTRAP_DIR"/pre-install/*; do
+	if [ -f "$script" ]; then
+		"$script"
+	fi
+done
+
+# The install script holds the instance token, so it is only readable by root until
+# it is handed over to the runner user.
+chown "$RUNNER_USER" "$BOOTSTRAP_DIR/install_runner.sh"
+su -l -c "$BOOTSTRAP_DIR/install_runner.sh" "$RUNNER_USER"
+`
+
+// bootstrapLog is where the output of the bootstrap script is streamed to. GARM
+// logs the stderr of the provider.
+var bootstrapLog io.Writer = os.Stderr
+
+// bootstrapFiles holds the files pushed into instances by the exec bootstrap mode.
+type bootstrapFiles struct {
+	installScript     []byte
+	caBundle          []byte
+	preInstallScripts map[string][]byte
+}
+
+// withUserDataOptions returns the bootstrap params with the user data options set
+// in the extra specs of the pool.
+func withUserDataOptions(bootstrapParams commonParams.BootstrapInstance, specs extraSpecs) commonParams.BootstrapInstance {
+	bootstrapParams.UserDataOptions.DisableUpdatesOnBoot = specs.DisableUpdates
+	bootstrapParams.UserDataOptions.ExtraPackages = specs.ExtraPackages
+	bootstrapParams.UserDataOptions.EnableBootDebug = specs.EnableBootDebug
+	return bootstrapParams
+}
+
+// getBootstrapFiles generates the files needed to bootstrap an instance using the
+// exec bootstrap mode.
+func getBootstrapFiles(bootstrapParams commonParams.BootstrapInstance, specs extraSpecs) (bootstrapFiles, error) {
+	tools, err := DefaultToolFetch(bootstrapParams.OSType, bootstrapParams.OSArch, bootstrapParams.Tools)
+	if err != nil {
+		return bootstrapFiles{}, errors.Wrap(err, "getting tools")
+	}
+
+	installScript, err := DefaultGetRunnerInstallScript(withUserDataOptions(bootstrapParams, specs), tools, bootstrapParams.Name)
+	if err != nil {
+		return bootstrapFiles{}, errors.Wrap(err, "generating install script")
+	}
+
+	return bootstrapFiles{
+		installScript:     installScript,
+		caBundle:          bootstrapParams.CACertBundle,
+		preInstallScripts: specs.PreInstallScripts,
+	}, nil
+}
+
+// execBootstrap pushes the bootstrap files into an instance and runs the bootstrap
+// script through the Incus exec API. The output of the script is streamed to the
+// bootstrap log, and its tail is included in the error if the script fails.
+func (l *Incus) execBootstrap(ctx context.Context, instanceName string, instanceType config.IncusImageType, files bootstrapFiles) error {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+
+	// The file and exec APIs of virtual machines are served by the Incus agent.
+	if instanceType == config.IncusImageVirtualMachine {
+		if err := l.waitInstanceAgent(ctx, instanceName); err != nil {
+			return errors.Wrap(err, "waiting for agent")
+		}
+	}
+
+	if err := pushBootstrapFiles(cli, instanceName, files); err != nil {
+		return errors.Wrap(err, "pushing bootstrap files")
+	}
+
+	req := api.InstanceExecPost{
+		Command: []string{"/bin/sh", bootstrapScriptPath},
+		Environment: map[string]string{
+			"BOOTSTRAP_DIR": bootstrapDir,
+			"RUNNER_USER":   defaults.DefaultUser,
+			"RUNNER_GROUPS": strings.Join(defaults.DefaultUserGroups, " "),
+		},
+	}
+	return execScript(ctx, cli, instanceName, "bootstrap script", req)
+}
+
+// execScript runs a script inside an instance through the Incus exec API. The output
+// of the script is streamed to the bootstrap log, and its tail is included in the
+// error if the script fails.
+func execScript(ctx context.Context, cli InstanceServerInterface, instanceName string, description string, req api.InstanceExecPost) error {
+	output := newBootstrapOutput(instanceName, bootstrapLog)
+	dataDone := make(chan bool)
+	req.WaitForWS = true
+	op, err := cli.ExecInstance(instanceName, req, &incus.InstanceExecArgs{
+		Stdout:   output,
+		Stderr:   output,
+		DataDone: dataDone,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "running %s", description)
+	}
+
+	if err := op.WaitContext(ctx); err != nil {
+		return errors.Wrapf(err, "running %s", description)
+	}
+
+	select {
+	case <-dataDone:
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "reading %s output", description)
+	}
+	output.flush()
+
+	exitCode, ok := op.Get().Metadata["return"].(float64)
+	if !ok {
+		return fmt.Errorf("failed to get the exit code of the %s", description)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("%s exited with code %d:\n%s", description, int(exitCode), sanitizeLog(output.tail(), maxDiagnosticsSectionSize))
+	}
+	return nil
+}
+
+// pushBootstrapFiles creates the bootstrap directory inside the instance and writes
+// the bootstrap files to it.
+func pushBootstrapFiles(cli InstanceServerInterface, instanceName string, files bootstrapFiles) error {
+	toPush := []instanceFile{
+		{path: bootstrapScriptPath, contents: []byte(bootstrapScript), mode: 0o700},
+		// The install script holds the instance token. It is pushed as root, and handed
+		// over to the runner user by the bootstrap script, right before it is run.
+		{path: installScriptPath, contents: files.installScript, mode: 0o700},
+	}
+	if len(files.caBundle) > 0 {
+		toPush = append(toPush, instanceFile{path: caBundlePath, contents: files.caBundle, mode: 0o644})
+	}
+	// Pre-install scripts are run in the order of their names, as cloud-init does.
+	for _, name := range slices.Sorted(maps.Keys(files.preInstallScripts)) {
+		toPush = append(toPush, instanceFile{path: path.Join(preInstallDir, path.Base(name)), contents: files.preInstallScripts[name], mode: 0o700})
+	}
+	return pushInstanceFiles(cli, instanceName, []string{bootstrapDir, preInstallDir}, toPush)
+}
+
+// instanceFile is a file pushed into an instance.
+type instanceFile struct {
+	path     string
+	contents []byte
+	mode     int
+}
+
+// pushInstanceFiles creates the given directories inside an instance, and then writes
+// the files to it, overwriting any existing ones.
+func pushInstanceFiles(cli InstanceServerInterface, instanceName string, dirs []string, files []instanceFile) error {
+	for _, dir := range dirs {
+		if err := cli.CreateInstanceFile(instanceName, dir, incus.InstanceFileArgs{Type: "directory", Mode: 0o755}); err != nil {
+			return errors.Wrapf(err, "creating %s", dir)
+		}
+	}
+
+	for _, f := range files {
+		args := incus.InstanceFileArgs{
+			Content:   bytes.NewReader(f.contents),
+			Type:      "file",
+			Mode:      f.mode,
+			WriteMode: "overwrite",
+		}
+		if err := cli.CreateInstanceFile(instanceName, f.path, args); err != nil {
+			return errors.Wrapf(err, "creating %s", f.path)
+		}
+	}
+	return nil
+}
+
+// waitInstanceAgent waits for the Incus agent of a virtual machine to come up. Incus
+// only reports the processes running in a virtual machine while its agent is running.
+func (l *Incus) waitInstanceAgent(ctx context.Context, instanceName string) error {
+	timeout := l.cfg.GetAgentWaitTimeout()
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(ipPollInterval)
+	defer ticker.Stop()
+
+	for {
+		instance, err := l.getInstanceFull(waitCtx, instanceName)
+		switch {
+		case err == nil:
+			if instance.State != nil && instance.State.Processes > 0 {
+				return nil
+			}
+		case errors.Is(err, runnerErrors.ErrNotFound):
+			return errors.Wrap(err, "fetching instance")
+		}
+
+		select {
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return errors.Wrap(ctx.Err(), "waiting for instance agent")
+			}
+			return runnerErrors.NewTimeoutError("timed out after %s waiting for the agent of instance %s", timeout, instanceName)
+		case <-ticker.C:
+		}
+	}
+}
+
+// bootstrapOutput streams the output of the bootstrap script line by line, prefixed
+// with the name of the instance and with credentials redacted, and keeps its tail
+// around for error reporting. The exec API writes stdout and stderr from separate
+// goroutines.
+type bootstrapOutput struct {
+	mux    sync.Mutex
+	prefix string
+	out    io.Writer
+	line   []byte
+	buf    []byte
+}
+
+func newBootstrapOutput(instanceName string, out io.Writer) *bootstrapOutput {
+	return &bootstrapOutput{
+		prefix: instanceName + ": ",
+		out:    out,
+	}
+}
+
+func (b *bootstrapOutput) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.buf = append(b.buf, p...)
+	// Keep twice what we report, so sanitizing the tail can't cut it short.
+	if len(b.buf) > 2*maxDiagnosticsSectionSize {
+		b.buf = slices.Clone(b.buf[len(b.buf)-2*maxDiagnosticsSectionSize:])
+	}
+
+	b.line = append(b.line, p...)
+	for {
+		idx := bytes.IndexByte(b.line, '\n')
+		if idx < 0 {
+			break
+		}
+		b.writeLine(b.line[:idx])
+		b.line = b.line[idx+1:]
+	}
+	return len(p), nil
+}
+
+// writeLine writes a line of output, with any credentials in it redacted.
+func (b *bootstrapOutput) writeLine(line []byte) {
+	fmt.Fprintf(b.out, "%s%s\n", b.prefix, sanitizeLog(line, len(line)))
+}
+
+// flush writes out the last line, if it did not end with a new line.
+func (b *bootstrapOutput) flush() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if len(b.line) > 0 {
+		b.writeLine(b.line)
+		b.line = nil
+	}
+}
+
+func (b *bootstrapOutput) tail() []byte {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return slices.Clone(b.buf)
+}
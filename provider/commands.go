@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/cloudbase/garm-provider-incus/config"
+	"github.com/pkg/errors"
+)
+
+// commandFunc runs a provider subcommand with the given arguments, and writes its
+// result to out.
+type commandFunc func(ctx context.Context, args []string, out io.Writer) error
+
+// commands holds the provider subcommands. Subcommands are run by operators, outside
+// of GARM, which always runs the provider without any arguments. The pool-worker
+// subcommand is run by the provider itself.
+var commands = map[string]commandFunc{
+	"bake":        runBake,
+	"precache":    runPrecache,
+	"prune":       runPrune,
+	"pool-worker": runPoolWorker,
+}
+
+// RunCommand runs the provider subcommand given in args. The result of the command
+// is written to out.
+func RunCommand(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no command given")
+	}
+
+	run, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q, supported commands: %s", args[0], strings.Join(slices.Sorted(maps.Keys(commands)), ", "))
+	}
+
+	err := run(ctx, args[1:], out)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
+
+// newFlagSet returns the flag set of a subcommand, along with the path to the provider
+// config file. The config file defaults to the one GARM would pass to the provider.
+// The positional arguments of the subcommand, if any, are described by args.
+func newFlagSet(name, args, description string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		usage := strings.TrimSpace(fmt.Sprintf("garm-provider-incus %s [flags] %s", name, args))
+		fmt.Fprintf(fs.Output(), "Usage: %s\n\n%s.\n\nFlags:\n", usage, description)
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config", os.Getenv("GARM_PROVIDER_CONFIG_FILE"), "path to the provider config file")
+	return fs, configFile
+}
+
+// requireFlags returns an error if any of the given flags was left empty.
+func requireFlags(fs *flag.FlagSet, names ...string) error {
+	for _, name := range names {
+		if fs.Lookup(name).Value.String() == "" {
+			return fmt.Errorf("missing required flag --%s", name)
+		}
+	}
+	return nil
+}
+
+// parseInstanceType parses the instance type given to a subcommand. If empty, the
+// instance type in the provider config is used.
+func parseInstanceType(instanceType string, cfg *config.Incus) (config.IncusImageType, error) {
+	switch config.IncusImageType(instanceType) {
+	case "":
+		return cfg.GetInstanceType(), nil
+	case config.IncusImageContainer, config.IncusImageVirtualMachine:
+		return config.IncusImageType(instanceType), nil
+	default:
+		return "", fmt.Errorf("invalid instance type %s", instanceType)
+	}
+}
@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	incus "github.com/lxc/incus/client"
+)
+
+const (
+	// maxProviderFaultSize is the maximum number of bytes of diagnostics we attach
+	// to an instance as provider fault.
+	maxProviderFaultSize = 8192
+	// maxDiagnosticsSectionSize is the maximum number of bytes we keep from each
+	// log we collect. We keep the end of the logs, as that is where the errors are.
+	maxDiagnosticsSectionSize = 2048
+)
+
+// cloudInitLogFiles are the files inside the instance that hold the output of cloud-init.
+var cloudInitLogFiles = []string{
+	"/var/log/cloud-init-output.log",
+}
+
+var (
+	ansiEscapeRe = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+	// secretRes match credentials that may end up in logs, like the JWT GARM gives
+	// runners to call back home, and GitHub tokens. The first group of each
+	// expression is kept.
+	secretRes = []*regexp.Regexp{
+		regexp.MustCompile(`()eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`),
+		regexp.MustCompile(`()\b(gh[pousr]_|github_pat_)[A-Za-z0-9_]+`),
+		regexp.MustCompile(`(?i)(authorization:\s*(?:bearer|token)\s+)[^\s'"]+`),
+	}
+)
+
+// sanitizeLog removes terminal escape sequences, control characters and anything
+// that looks like a credential from a log, and keeps at most maxSize bytes from the
+// end of it.
+func sanitizeLog(contents []byte, maxSize int) string {
+	log := strings.ToValidUTF8(string(contents), "")
+	log = ansiEscapeRe.ReplaceAllString(log, "")
+	log = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, log)
+	for _, re := range secretRes {
+		log = re.ReplaceAllString(log, "${1}[REDACTED]")
+	}
+	log = strings.TrimSpace(log)
+
+	if len(log) > maxSize {
+		log = log[len(log)-maxSize:]
+		// Don't start in the middle of a line or a multi byte character.
+		if idx := strings.IndexByte(log, '\n'); idx >= 0 {
+			log = log[idx+1:]
+		}
+		log = strings.ToValidUTF8(log, "")
+	}
+	return log
+}
+
+func readLog(log io.ReadCloser, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer log.Close()
+	return io.ReadAll(log)
+}
+
+// collectDiagnostics gathers the console log, the cloud-init output and the Incus logs
+// of an instance, to help figure out why it failed. This is best effort, so logs that
+// can not be fetched are skipped. Fetching files from virtual machines needs the
+// Incus agent to be running inside the instance.
+func (l *Incus) collectDiagnostics(ctx context.Context, instanceName string) []byte {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	addSection := func(name string, contents []byte) {
+		log := sanitizeLog(contents, maxDiagnosticsSectionSize)
+		if log == "" {
+			return
+		}
+		fmt.Fprintf(&buf, "==> %s <==\n%s\n", name, log)
+	}
+
+	if contents, err := readLog(cli.GetInstanceConsoleLog(instanceName, &incus.InstanceConsoleLogArgs{})); err == nil {
+		addSection("console", contents)
+	}
+
+	for _, file := range cloudInitLogFiles {
+		content, _, err := cli.GetInstanceFile(instanceName, file)
+		if contents, err := readLog(content, err); err == nil {
+			addSection(file, contents)
+		}
+	}
+
+	if logfiles, err := cli.GetInstanceLogfiles(instanceName); err == nil {
+		for _, logfile := range logfiles {
+			if !strings.HasSuffix(logfile, ".log") || logfile == "console.log" {
+				continue
+			}
+			if contents, err := readLog(cli.GetInstanceLogfile(instanceName, logfile)); err == nil {
+				addSection(logfile, contents)
+			}
+		}
+	}
+
+	fault := buf.Bytes()
+	if len(fault) > maxProviderFaultSize {
+		fault = bytes.ToValidUTF8(fault[:maxProviderFaultSize], nil)
+	}
+	return fault
+}
@@ -0,0 +1,410 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cloudbase/garm-provider-common/defaults"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-incus/config"
+	"github.com/lxc/incus/shared/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	// goldenTemplatePrefix is the name prefix of the golden templates of pools.
+	goldenTemplatePrefix = "garm-golden-"
+	// goldenTemplateBuildTimeout is the time we give a golden template to build.
+	goldenTemplateBuildTimeout = 30 * time.Minute
+
+	prepareScriptPath = bootstrapDir + "/prepare.sh"
+)
+
+// prepareScript installs the runner and its dependencies the same way the runner install
+// script generated by garm-provider-common does, without registering the runner. The
+// install script skips the download when it finds the runner in the home folder of the
+// runner user. Cloud-init is reset, so it runs again in instances cloned from, or
+// created from an image of, the instance.
+const prepareScript = `#!/bin/sh
+set -e
+trap 'rm -rf "$BOOTSTRAP_DIR"' EXIT
+
+if command -v cloud-init >/dev/null 2>&1; then
+	cloud-init status --wait >/dev/null || true
+fi
+
+` + createRunnerUserScript + `
+RUN_HOME="/home/$RUNNER_USER/actions-runner"
+if command -v curl >/dev/null 2>&1; then
+	curl --retry 5 --retry-delay 5 --retry-connrefused --fail -sSL ${RUNNER_TOKEN:+-H "Authorization: Bearer $RUNNER_TOKEN"} -o /tmp/actions-runner.tar.gz "$RUNNER_URL"
+elif command -v wget >/dev/null 2>&1; then
+	wget -q ${RUNNER_TOKEN:+--header "Authorization: Bearer $RUNNER_TOKEN"} -O /tmp/actions-runner.tar.gz "$RUNNER_URL"
+else
+	echo "curl or wget is needed to download the runner" >&2
+	exit 1
+fi
+rm -rf "$RUN_HOME"
+mkdir -p "$RUN_HOME"
+tar xzf /tmp/actions-runner.tar.gz -C "$RUN_HOME"
+rm -f /tmp/actions-runner.tar.gz
+chown -R "$RUNNER_USER:$(id -gn "$RUNNER_USER")" "$RUN_HOME"
+"$RUN_HOME/bin/installdependencies.sh"
+
+if command -v cloud-init >/dev/null 2>&1; then
+	cloud-init clean --logs
+fi
+if [ -f /etc/machine-id ]; then
+	: > /etc/machine-id
+fi
+`
+
+// getGoldenInstanceSource returns the source used to clone new runners from the
+// golden instance of a pool, along with the type of the golden instance. The golden
+// instance is prepared by the user, we never create or update it. It is referenced
+// either by name, in which case it must be stopped, or as instance/snapshot. If arch
+// is empty, the architecture of the golden instance is not checked.
+//
+// Copies are done by the Incus server, so on storage pools that support it (zfs,
+// btrfs, lvm thin pools etc), the root disk of the runner is a copy-on-write clone
+// of the golden instance, which is near instant.
+func (l *Incus) getGoldenInstanceSource(ctx context.Context, golden string, arch string) (api.InstanceSource, config.IncusImageType, error) {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return api.InstanceSource{}, "", errors.Wrap(err, "fetching client")
+	}
+
+	instanceName, snapshotName, isSnapshot := strings.Cut(golden, "/")
+	if instanceName == "" || (isSnapshot && (snapshotName == "" || strings.Contains(snapshotName, "/"))) {
+		return api.InstanceSource{}, "", runnerErrors.NewBadRequestError("invalid golden instance %q, expected instance or instance/snapshot", golden)
+	}
+
+	instance, _, err := cli.GetInstance(instanceName)
+	if err != nil {
+		if isNotFoundError(err) {
+			return api.InstanceSource{}, "", runnerErrors.NewBadRequestError("golden instance %s not found", instanceName)
+		}
+		return api.InstanceSource{}, "", errors.Wrapf(err, "fetching golden instance %s", instanceName)
+	}
+
+	if arch != "" && instance.Architecture != arch {
+		return api.InstanceSource{}, "", runnerErrors.NewBadRequestError("golden instance %s has architecture %s, expected %s", instanceName, instance.Architecture, arch)
+	}
+
+	if isSnapshot {
+		if _, _, err := cli.GetInstanceSnapshot(instanceName, snapshotName); err != nil {
+			if isNotFoundError(err) {
+				return api.InstanceSource{}, "", runnerErrors.NewBadRequestError("snapshot %s of golden instance %s not found", snapshotName, instanceName)
+			}
+			return api.InstanceSource{}, "", errors.Wrapf(err, "fetching snapshot %s of golden instance %s", snapshotName, instanceName)
+		}
+	} else if instance.StatusCode != api.Stopped {
+		// Copying a running instance would leave the clone in an inconsistent state.
+		return api.InstanceSource{}, "", runnerErrors.NewBadRequestError("golden instance %s must be stopped, or a snapshot of it must be used", instanceName)
+	}
+
+	source := api.InstanceSource{
+		Type:         "copy",
+		Source:       golden,
+		InstanceOnly: true,
+	}
+	return source, config.IncusImageType(instance.Type), nil
+}
+
+// goldenTemplate holds what the golden template of a pool is built from. It is passed
+// to the pool worker, which builds the template in the background.
+type goldenTemplate struct {
+	// Args are the arguments the template is created with. The name of the template is
+	// set when it is built.
+	Args api.InstancesPost `json:"args"`
+	// RunnerURL is the URL the runner is downloaded from, and DownloadToken the token
+	// needed to download it from GitHub Enterprise Server, if any.
+	RunnerURL     string `json:"runner_url"`
+	DownloadToken string `json:"download_token,omitempty"`
+}
+
+// getGoldenTemplate returns what the golden template of a pool is built from, along with
+// the name of the template new runners should be cloned from. Templates are instances
+// in the project, with the runner installed, that are stopped once the runner is
+// installed. They are marked with the ID of the pool and a hash of the inputs they were
+// built from, so a new template is built whenever the image of the pool is updated or
+// GARM hands out a new runner version.
+//
+// Templates are only built by the pool worker, so creating a runner never waits for a
+// template to be built. Until the template for the current image and runner version is
+// ready, the previous template is used, if any. Otherwise, an empty name is returned and
+// the runner is created from the image of the pool.
+func (l *Incus) getGoldenTemplate(ctx context.Context, bootstrapParams commonParams.BootstrapInstance, specs extraSpecs) (*goldenTemplate, string, error) {
+	if bootstrapParams.OSType != commonParams.Linux {
+		return nil, "", runnerErrors.NewBadRequestError("golden templates only support linux instances")
+	}
+	if bootstrapParams.PoolID == "" {
+		return nil, "", runnerErrors.NewBadRequestError("missing pool ID")
+	}
+
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "fetching client")
+	}
+
+	profiles, err := l.getProfiles(ctx, bootstrapParams.Flavor)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "fetching profiles")
+	}
+
+	arch, err := resolveArchitecture(bootstrapParams.OSArch)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "fetching architecture")
+	}
+
+	instanceType := l.getInstanceType(specs)
+	source, err := l.imageManager.getInstanceSource(bootstrapParams.Image, instanceType, arch, cli)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "getting instance source")
+	}
+	if specs.ImageFingerprint != "" {
+		if err := l.imageManager.pinInstanceSource(&source, bootstrapParams.Image, instanceType, arch, specs.ImageFingerprint); err != nil {
+			return nil, "", errors.Wrap(err, "pinning image")
+		}
+	} else if source.Fingerprint == "" && source.Protocol == string(config.SimpleStreams) {
+		// Aliases on simplestreams remotes are resolved, so the template is rebuilt
+		// when the remote publishes a new image.
+		remote, parsedName, err := l.imageManager.parseImageName(bootstrapParams.Image)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "parsing image name: %s", bootstrapParams.Image)
+		}
+		_, imageDetails, err := l.imageManager.resolveRemoteImage(remote, parsedName, instanceType, arch)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "resolving image %s", bootstrapParams.Image)
+		}
+		source.Fingerprint = imageDetails.Fingerprint
+		source.Alias = ""
+	}
+
+	tools, err := DefaultToolFetch(bootstrapParams.OSType, bootstrapParams.OSArch, bootstrapParams.Tools)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "getting tools")
+	}
+	version := goldenTemplateVersion(source, instanceType, arch, tools.GetDownloadURL())
+
+	templates, err := l.getStandbyInstances(cli, goldenPoolIDKey, bootstrapParams.PoolID)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "fetching golden templates")
+	}
+	name, current := pickGoldenTemplate(templates, version)
+	if !current {
+		log.Printf("golden template of pool %s is not ready, using %q in the meantime", bootstrapParams.PoolID, name)
+	}
+
+	template := &goldenTemplate{
+		Args: api.InstancesPost{
+			InstancePut: api.InstancePut{
+				Architecture: arch,
+				Profiles:     profiles,
+				Description:  fmt.Sprintf("Golden template of pool %s, maintained by garm", bootstrapParams.PoolID),
+				Config: map[string]string{
+					standbyControllerIDKeyName: l.controllerID,
+					goldenPoolIDKey:            bootstrapParams.PoolID,
+					goldenVersionKeyName:       version,
+					osTypeKeyName:              string(bootstrapParams.OSType),
+					osArchKeyNAme:              string(bootstrapParams.OSArch),
+				},
+			},
+			Source: source,
+			Type:   api.InstanceType(instanceType),
+		},
+		RunnerURL:     tools.GetDownloadURL(),
+		DownloadToken: tools.GetTempDownloadToken(),
+	}
+	if source.Fingerprint != "" {
+		template.Args.Config[imageFingerprintKeyName] = source.Fingerprint
+	}
+	if instanceType == config.IncusImageVirtualMachine {
+		template.Args.Config["security.secureboot"] = l.secureBootEnabled()
+	}
+	return template, name, nil
+}
+
+// pickGoldenTemplate returns the newest ready template of the given version, or the newest
+// ready template if there is none, along with whether it is of the given version. The
+// templates are sorted oldest first.
+func pickGoldenTemplate(templates []api.InstanceFull, version string) (string, bool) {
+	var current, previous string
+	for _, template := range templates {
+		if template.Config[goldenReadyKeyName] != "true" {
+			continue
+		}
+		if template.Config[goldenVersionKeyName] == version {
+			current = template.Name
+		} else {
+			previous = template.Name
+		}
+	}
+	if current != "" {
+		return current, true
+	}
+	return previous, false
+}
+
+// buildGoldenTemplate launches a new golden template, installs the runner in it and stops
+// it. The template is only marked as ready once it is stopped, so runners are never cloned
+// from a template that is still being built. Templates that fail to build are removed.
+func (l *Incus) buildGoldenTemplate(ctx context.Context, template goldenTemplate) (string, error) {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "fetching client")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, goldenTemplateBuildTimeout)
+	defer cancel()
+
+	poolID := template.Args.Config[goldenPoolIDKey]
+	args := template.Args
+	args.Name = fmt.Sprintf("%s%.8s-%d", goldenTemplatePrefix, poolID, time.Now().Unix())
+	log.Printf("building golden template %s for pool %s", args.Name, poolID)
+	if err := l.launchInstance(ctx, args); err != nil {
+		return "", errors.Wrap(err, "launching instance")
+	}
+
+	if err := l.installRunner(ctx, args.Name, config.IncusImageType(args.Type), template.RunnerURL, template.DownloadToken); err != nil {
+		return "", l.rollbackInstance(ctx, args.Name, err)
+	}
+
+	if err := l.setState(ctx, args.Name, "stop", false); err != nil {
+		return "", l.rollbackInstance(ctx, args.Name, errors.Wrap(err, "stopping instance"))
+	}
+
+	instance, etag, err := cli.GetInstance(args.Name)
+	if err != nil {
+		return "", l.rollbackInstance(ctx, args.Name, errors.Wrap(err, "fetching instance"))
+	}
+	instancePut := instance.Writable()
+	instancePut.Config = maps.Clone(instancePut.Config)
+	instancePut.Config[goldenReadyKeyName] = "true"
+	op, err := cli.UpdateInstance(args.Name, instancePut, etag)
+	if err == nil {
+		err = op.Wait()
+	}
+	if err != nil {
+		return "", l.rollbackInstance(ctx, args.Name, errors.Wrap(err, "marking template as ready"))
+	}
+	return args.Name, nil
+}
+
+// installRunner waits for a new instance to come up, and runs the prepare script in it
+// to install the runner and its dependencies. The download token is only needed for
+// runners downloaded from GitHub Enterprise Server.
+func (l *Incus) installRunner(ctx context.Context, instanceName string, instanceType config.IncusImageType, runnerURL string, downloadToken string) error {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+
+	if _, err := l.waitInstanceHasIP(ctx, instanceName); err != nil {
+		return errors.Wrap(err, "waiting for instance to get an IP")
+	}
+	if instanceType == config.IncusImageVirtualMachine {
+		if err := l.waitInstanceAgent(ctx, instanceName); err != nil {
+			return errors.Wrap(err, "waiting for agent")
+		}
+	}
+
+	files := []instanceFile{
+		{path: prepareScriptPath, contents: []byte(prepareScript), mode: 0o700},
+	}
+	if err := pushInstanceFiles(cli, instanceName, []string{bootstrapDir}, files); err != nil {
+		return errors.Wrap(err, "pushing prepare script")
+	}
+	req := api.InstanceExecPost{
+		Command: []string{"/bin/sh", prepareScriptPath},
+		Environment: map[string]string{
+			"BOOTSTRAP_DIR": bootstrapDir,
+			"RUNNER_USER":   defaults.DefaultUser,
+			"RUNNER_GROUPS": strings.Join(defaults.DefaultUserGroups, " "),
+			"RUNNER_URL":    runnerURL,
+		},
+	}
+	if downloadToken != "" {
+		req.Environment["RUNNER_TOKEN"] = downloadToken
+	}
+	return execScript(ctx, cli, instanceName, "prepare script", req)
+}
+
+// removeGoldenTemplates removes the given golden templates, except the one named keep.
+// Failing to remove a template only leaves it around until the next run of the pool
+// worker, so errors are logged.
+func (l *Incus) removeGoldenTemplates(ctx context.Context, templates []api.InstanceFull, keep string) {
+	for _, template := range templates {
+		if template.Name == keep {
+			continue
+		}
+		if err := l.deleteInstance(ctx, template.Name); err != nil {
+			log.Printf("failed to remove golden template %s: %s", template.Name, err)
+		}
+	}
+}
+
+// goldenTemplateVersion returns a hash of the inputs a golden template is built from.
+func goldenTemplateVersion(source api.InstanceSource, instanceType config.IncusImageType, arch string, runnerURL string) string {
+	hash := sha256.New()
+	for _, val := range []string{string(instanceType), arch, source.Server, source.Fingerprint, source.Alias, runnerURL} {
+		fmt.Fprintf(hash, "%s\n", val)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// getStandbyInstances returns the golden templates and warm clones kept for the pools
+// of this controller, oldest first. If key is set, only the instances with the given
+// value for it are returned.
+func (l *Incus) getStandbyInstances(cli InstanceServerInterface, key string, value string) ([]api.InstanceFull, error) {
+	var instances []api.InstanceFull
+	var err error
+	if cli.HasExtension("api_filtering") {
+		filters := []string{
+			fmt.Sprintf("config.%s=%s", standbyControllerIDKeyName, l.controllerID),
+		}
+		if key != "" {
+			filters = append(filters, fmt.Sprintf("config.%s=%s", key, value))
+		}
+		instances, err = cli.GetInstancesFullWithFilter(api.InstanceTypeAny, filters)
+	} else {
+		instances, err = cli.GetInstancesFull(api.InstanceTypeAny)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []api.InstanceFull{}
+	for _, instance := range instances {
+		if instance.Config[standbyControllerIDKeyName] != l.controllerID || (key != "" && instance.Config[key] != value) {
+			continue
+		}
+		ret = append(ret, instance)
+	}
+	slices.SortStableFunc(ret, func(a, b api.InstanceFull) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return ret, nil
+}
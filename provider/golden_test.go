@@ -0,0 +1,458 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-incus/config"
+	"github.com/lxc/incus/shared/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetGoldenInstanceSource(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg: &config.Incus{},
+		cli: cli,
+	}
+	cli.On("GetInstance", "golden").Return(&api.Instance{
+		Name: "golden",
+		InstancePut: api.InstancePut{
+			Architecture: "x86_64",
+		},
+		Type:       "container",
+		StatusCode: api.Stopped,
+	}, "", nil)
+	cli.On("GetInstance", "running").Return(&api.Instance{
+		Name: "running",
+		InstancePut: api.InstancePut{
+			Architecture: "x86_64",
+		},
+		Type:       "virtual-machine",
+		StatusCode: api.Running,
+	}, "", nil)
+	cli.On("GetInstance", "missing").Return(nil, "", api.StatusErrorf(http.StatusNotFound, "Instance not found"))
+	cli.On("GetInstanceSnapshot", "running", "v1").Return(&api.InstanceSnapshot{Name: "v1"}, "", nil)
+	cli.On("GetInstanceSnapshot", "running", "v2").Return(nil, "", api.StatusErrorf(http.StatusNotFound, "Snapshot not found"))
+
+	tests := []struct {
+		name         string
+		golden       string
+		arch         string
+		expected     api.InstanceSource
+		instanceType config.IncusImageType
+		errString    string
+	}{
+		{
+			name:   "stopped instance",
+			golden: "golden",
+			arch:   "x86_64",
+			expected: api.InstanceSource{
+				Type:         "copy",
+				Source:       "golden",
+				InstanceOnly: true,
+			},
+			instanceType: config.IncusImageContainer,
+		},
+		{
+			name:   "snapshot of running instance",
+			golden: "running/v1",
+			expected: api.InstanceSource{
+				Type:         "copy",
+				Source:       "running/v1",
+				InstanceOnly: true,
+			},
+			instanceType: config.IncusImageVirtualMachine,
+		},
+		{
+			name:      "running instance",
+			golden:    "running",
+			errString: "golden instance running must be stopped, or a snapshot of it must be used",
+		},
+		{
+			name:      "missing snapshot",
+			golden:    "running/v2",
+			errString: "snapshot v2 of golden instance running not found",
+		},
+		{
+			name:      "missing instance",
+			golden:    "missing",
+			errString: "golden instance missing not found",
+		},
+		{
+			name:      "architecture mismatch",
+			golden:    "golden",
+			arch:      "aarch64",
+			errString: "golden instance golden has architecture x86_64, expected aarch64",
+		},
+		{
+			name:      "invalid name",
+			golden:    "golden/v1/extra",
+			errString: `invalid golden instance "golden/v1/extra"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, instanceType, err := l.getGoldenInstanceSource(ctx, tt.golden, tt.arch)
+			if tt.errString != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errString)
+				assert.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, source)
+			assert.Equal(t, tt.instanceType, instanceType)
+		})
+	}
+}
+
+func TestGetCreateInstanceArgsGoldenInstance(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg: &config.Incus{
+			UnixSocket:       "/var/run/incus.sock",
+			InstanceType:     config.IncusImageVirtualMachine,
+			UseCloudInitKeys: true,
+		},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+	DefaultToolFetch = func(_ commonParams.OSType, _ commonParams.OSArch, tools []commonParams.RunnerApplicationDownload) (commonParams.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+	DefaultGetCloudconfig = func(_ commonParams.BootstrapInstance, _ commonParams.RunnerApplicationDownload, _ string) (string, error) {
+		return "#cloud-config", nil
+	}
+	cli.On("GetProfileNames").Return([]string{"default"}, nil)
+	cli.On("GetInstance", "golden").Return(&api.Instance{
+		Name: "golden",
+		InstancePut: api.InstancePut{
+			Architecture: "x86_64",
+		},
+		Type:       "container",
+		StatusCode: api.Stopped,
+	}, "", nil)
+
+	bootstrapParams := commonParams.BootstrapInstance{
+		Name: "test-instance",
+		Tools: []commonParams.RunnerApplicationDownload{
+			{
+				OS:           ptr("linux"),
+				Architecture: ptr("x64"),
+				DownloadURL:  ptr("https://example.com"),
+				Filename:     ptr("test-app"),
+			},
+		},
+		Image:   "ignored",
+		Flavor:  "default",
+		RepoURL: "mock-repo-url",
+		PoolID:  "default",
+		OSArch:  commonParams.Amd64,
+		OSType:  commonParams.Linux,
+	}
+
+	ret, err := l.getCreateInstanceArgs(ctx, bootstrapParams, extraSpecs{GoldenInstance: "golden"})
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceSource{Type: "copy", Source: "golden", InstanceOnly: true}, ret.Source)
+	assert.Equal(t, api.InstanceType("container"), ret.Type)
+	assert.Equal(t, map[string]string{
+		"cloud-init.user-data":      "#cloud-config",
+		"cloud-init.vendor-data":    "",
+		"cloud-init.network-config": "",
+		"user.user-data":            "",
+		"user.vendor-data":          "",
+		"user.network-config":       "",
+		osTypeKeyName:               "linux",
+		osArchKeyNAme:               "amd64",
+		controllerIDKeyName:         "controller",
+		poolIDKey:                   "default",
+		goldenSourceKeyName:         "golden",
+		standbyControllerIDKeyName:  "",
+		goldenPoolIDKey:             "",
+		goldenVersionKeyName:        "",
+		goldenReadyKeyName:          "",
+		warmPoolIDKey:               "",
+	}, ret.Config)
+	cli.AssertNotCalled(t, "GetImageAliasArchitectures")
+}
+
+func TestGoldenTemplateVersion(t *testing.T) {
+	source := api.InstanceSource{Type: "image", Fingerprint: "123abc"}
+	version := goldenTemplateVersion(source, config.IncusImageContainer, "x86_64", "https://example.com/runner-1.tar.gz")
+	assert.Len(t, version, 16)
+	assert.Equal(t, version, goldenTemplateVersion(source, config.IncusImageContainer, "x86_64", "https://example.com/runner-1.tar.gz"))
+	assert.NotEqual(t, version, goldenTemplateVersion(source, config.IncusImageContainer, "x86_64", "https://example.com/runner-2.tar.gz"))
+	assert.NotEqual(t, version, goldenTemplateVersion(api.InstanceSource{Type: "image", Fingerprint: "456def"}, config.IncusImageContainer, "x86_64", "https://example.com/runner-1.tar.gz"))
+	assert.NotEqual(t, version, goldenTemplateVersion(source, config.IncusImageVirtualMachine, "x86_64", "https://example.com/runner-1.tar.gz"))
+}
+
+// goldenTemplateTestSetup returns a provider with a pool image that resolves to the
+// 123abc fingerprint, along with the bootstrap params of a runner of the pool and the
+// version of the golden template built for it.
+func goldenTemplateTestSetup(t *testing.T) (*Incus, *MockIncusServer, commonParams.BootstrapInstance, string) {
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg: &config.Incus{
+			UnixSocket:   "/var/run/incus.sock",
+			InstanceType: config.IncusImageContainer,
+		},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+	DefaultToolFetch = func(_ commonParams.OSType, _ commonParams.OSArch, tools []commonParams.RunnerApplicationDownload) (commonParams.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+	bootstrapLog = io.Discard
+	t.Cleanup(func() {
+		bootstrapLog = os.Stderr
+	})
+
+	cli.On("GetImageAliasArchitectures", config.IncusImageContainer.String(), "ubuntu").Return(map[string]*api.ImageAliasesEntry{
+		"x86_64": {ImageAliasesEntryPut: api.ImageAliasesEntryPut{Target: "123abc"}},
+	}, nil)
+	cli.On("GetImage", "123abc").Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	cli.On("HasExtension", "api_filtering").Return(true)
+	cli.On("GetProfileNames").Return([]string{"default"}, nil)
+
+	bootstrapParams := commonParams.BootstrapInstance{
+		Name: "test-instance",
+		Tools: []commonParams.RunnerApplicationDownload{
+			{
+				OS:                ptr("linux"),
+				Architecture:      ptr("x64"),
+				DownloadURL:       ptr("https://example.com/runner.tar.gz"),
+				Filename:          ptr("runner.tar.gz"),
+				TempDownloadToken: ptr("download-token"),
+			},
+		},
+		Image:  "ubuntu",
+		Flavor: "default",
+		PoolID: "6f1c5e4a-0d8b-4c3e-9a7f-2b1d3c4e5f60",
+		OSArch: commonParams.Amd64,
+		OSType: commonParams.Linux,
+	}
+	version := goldenTemplateVersion(api.InstanceSource{Type: "image", Fingerprint: "123abc"}, config.IncusImageContainer, "x86_64", "https://example.com/runner.tar.gz")
+	return l, cli, bootstrapParams, version
+}
+
+func goldenTemplateInstance(name string, version string, ready bool, created time.Time) api.InstanceFull {
+	instanceConfig := map[string]string{
+		standbyControllerIDKeyName: "controller",
+		goldenPoolIDKey:            "6f1c5e4a-0d8b-4c3e-9a7f-2b1d3c4e5f60",
+		goldenVersionKeyName:       version,
+	}
+	if ready {
+		instanceConfig[goldenReadyKeyName] = "true"
+	}
+	return api.InstanceFull{
+		Instance: api.Instance{
+			Name: name,
+			InstancePut: api.InstancePut{
+				Config: instanceConfig,
+			},
+			CreatedAt:  created,
+			StatusCode: api.Stopped,
+		},
+	}
+}
+
+func TestGetGoldenTemplate(t *testing.T) {
+	ctx := context.Background()
+	filters := []string{
+		"config.user.runner-standby-controller-id=controller",
+		"config.user.runner-golden-pool-id=6f1c5e4a-0d8b-4c3e-9a7f-2b1d3c4e5f60",
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		templates func(version string) []api.InstanceFull
+		expected  string
+	}{
+		{
+			name: "ready template",
+			templates: func(version string) []api.InstanceFull {
+				return []api.InstanceFull{
+					goldenTemplateInstance("garm-golden-old", "outdated", true, now.Add(-48*time.Hour)),
+					goldenTemplateInstance("garm-golden-current", version, true, now.Add(-time.Hour)),
+					goldenTemplateInstance("garm-golden-building", version, false, now.Add(-time.Minute)),
+				}
+			},
+			expected: "garm-golden-current",
+		},
+		{
+			name: "template being built",
+			templates: func(version string) []api.InstanceFull {
+				return []api.InstanceFull{
+					goldenTemplateInstance("garm-golden-older", "older", true, now.Add(-72*time.Hour)),
+					goldenTemplateInstance("garm-golden-old", "outdated", true, now.Add(-48*time.Hour)),
+					goldenTemplateInstance("garm-golden-building", version, false, now.Add(-time.Minute)),
+				}
+			},
+			expected: "garm-golden-old",
+		},
+		{
+			name: "first template being built",
+			templates: func(version string) []api.InstanceFull {
+				return []api.InstanceFull{
+					goldenTemplateInstance("garm-golden-building", version, false, now.Add(-time.Minute)),
+				}
+			},
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, cli, bootstrapParams, version := goldenTemplateTestSetup(t)
+			cli.On("GetInstancesFullWithFilter", api.InstanceTypeAny, filters).Return(tt.templates(version), nil)
+
+			template, name, err := l.getGoldenTemplate(ctx, bootstrapParams, extraSpecs{GoldenTemplate: true})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, name)
+			assert.Equal(t, api.InstancesPost{
+				InstancePut: api.InstancePut{
+					Architecture: "x86_64",
+					Profiles:     []string{"default"},
+					Description:  "Golden template of pool 6f1c5e4a-0d8b-4c3e-9a7f-2b1d3c4e5f60, maintained by garm",
+					Config: map[string]string{
+						standbyControllerIDKeyName: "controller",
+						goldenPoolIDKey:            bootstrapParams.PoolID,
+						goldenVersionKeyName:       version,
+						osTypeKeyName:              "linux",
+						osArchKeyNAme:              "amd64",
+						imageFingerprintKeyName:    "123abc",
+					},
+				},
+				Source: api.InstanceSource{Type: "image", Fingerprint: "123abc"},
+				Type:   "container",
+			}, template.Args)
+			assert.Equal(t, "https://example.com/runner.tar.gz", template.RunnerURL)
+			assert.Equal(t, "download-token", template.DownloadToken)
+			// Templates are only built and removed by the pool worker.
+			cli.AssertNotCalled(t, "CreateInstance", mock.Anything)
+			cli.AssertNotCalled(t, "DeleteInstance", mock.Anything)
+		})
+	}
+}
+
+func TestPickGoldenTemplate(t *testing.T) {
+	now := time.Now()
+	templates := []api.InstanceFull{
+		goldenTemplateInstance("garm-golden-1", "v1", true, now.Add(-3*time.Hour)),
+		goldenTemplateInstance("garm-golden-2", "v2", true, now.Add(-2*time.Hour)),
+		goldenTemplateInstance("garm-golden-3", "v3", false, now.Add(-time.Hour)),
+	}
+
+	name, current := pickGoldenTemplate(templates, "v1")
+	assert.Equal(t, "garm-golden-1", name)
+	assert.True(t, current)
+
+	name, current = pickGoldenTemplate(templates, "v3")
+	assert.Equal(t, "garm-golden-2", name)
+	assert.False(t, current)
+
+	name, current = pickGoldenTemplate(nil, "v1")
+	assert.Empty(t, name)
+	assert.False(t, current)
+}
+
+func TestBuildGoldenTemplate(t *testing.T) {
+	ctx := context.Background()
+	l, cli, bootstrapParams, version := goldenTemplateTestSetup(t)
+	cli.On("GetInstancesFullWithFilter", api.InstanceTypeAny, mock.Anything).Return([]api.InstanceFull{}, nil)
+	template, _, err := l.getGoldenTemplate(ctx, bootstrapParams, extraSpecs{GoldenTemplate: true})
+	require.NoError(t, err)
+
+	mockOp := new(MockOperation)
+	mockOp.On("Wait").Return(nil)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+	instance := &api.Instance{}
+	cli.On("CreateInstance", mock.Anything).Run(func(args mock.Arguments) {
+		instance.Name = args.Get(0).(api.InstancesPost).Name
+		instance.Config = args.Get(0).(api.InstancesPost).Config
+		instance.ExpandedConfig = instance.Config
+	}).Return(mockOp, nil)
+	cli.On("UpdateInstanceState", mock.Anything, mock.Anything, "").Return(mockOp, nil)
+	cli.On("GetEvents").Return(nil, assert.AnError)
+	cli.On("GetInstanceFull", mock.Anything).Return(&api.InstanceFull{
+		State: &api.InstanceState{
+			Status: "Running",
+			Network: map[string]api.InstanceStateNetwork{
+				"eth0": {
+					Addresses: []api.InstanceStateNetworkAddress{
+						{Family: "inet", Address: "10.10.0.2", Scope: "global"},
+					},
+				},
+			},
+		},
+	}, "", nil)
+	cli.On("CreateInstanceFile", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockBootstrapExec(cli, mock.Anything, "runner installed\n", 0)
+	cli.On("GetInstance", mock.Anything).Return(instance, "etag", nil)
+	cli.On("UpdateInstance", mock.Anything, mock.Anything, "etag").Return(mockOp, nil)
+
+	name, err := l.buildGoldenTemplate(ctx, *template)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(name, "garm-golden-6f1c5e4a-"), name)
+
+	cli.AssertCalled(t, "CreateInstance", mock.MatchedBy(func(args api.InstancesPost) bool {
+		_, isRunner := args.Config[controllerIDKeyName]
+		return args.Name == name && !isRunner &&
+			args.Source.Fingerprint == "123abc" &&
+			args.Config[standbyControllerIDKeyName] == "controller" &&
+			args.Config[goldenPoolIDKey] == bootstrapParams.PoolID &&
+			args.Config[goldenVersionKeyName] == version &&
+			args.Config[goldenReadyKeyName] == ""
+	}))
+	cli.AssertCalled(t, "ExecInstance", name, mock.MatchedBy(func(req api.InstanceExecPost) bool {
+		return req.Command[1] == prepareScriptPath &&
+			req.Environment["RUNNER_URL"] == "https://example.com/runner.tar.gz" &&
+			req.Environment["RUNNER_TOKEN"] == "download-token"
+	}), mock.Anything)
+	cli.AssertCalled(t, "UpdateInstanceState", name, api.InstanceStatePut{Action: "stop", Timeout: -1}, "")
+	cli.AssertCalled(t, "UpdateInstance", name, mock.MatchedBy(func(put api.InstancePut) bool {
+		return put.Config[goldenReadyKeyName] == "true"
+	}), "etag")
+	cli.AssertNotCalled(t, "DeleteInstance", mock.Anything)
+	// The template spec is left untouched.
+	assert.Empty(t, template.Args.Name)
+}
+
+func TestGoldenTemplateWindows(t *testing.T) {
+	l, _, bootstrapParams, _ := goldenTemplateTestSetup(t)
+	bootstrapParams.OSType = commonParams.Windows
+
+	_, _, err := l.getGoldenTemplate(context.Background(), bootstrapParams, extraSpecs{GoldenTemplate: true})
+	require.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+}
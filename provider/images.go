@@ -17,6 +17,7 @@ package provider
 
 import (
 	"fmt"
+	"os"
 	"strings"
 
 	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
@@ -26,8 +27,27 @@ import (
 	"github.com/pkg/errors"
 )
 
+// ImageServerInterface is the subset of the Incus image server API used to resolve
+// images on remotes that use the incus or simplestreams protocol.
+type ImageServerInterface interface {
+	GetImages() ([]api.Image, error)
+	GetImageAliasArchitectures(string, string) (map[string]*api.ImageAliasesEntry, error)
+	GetImage(string) (*api.Image, string, error)
+	GetImageSecret(string) (string, error)
+}
+
 type image struct {
 	remotes map[string]config.IncusImageRemote
+	// connectRemote connects to remotes that use the incus or simplestreams protocol.
+	// If not set, getImageServerFromRemote is used.
+	connectRemote func(config.IncusImageRemote) (ImageServerInterface, error)
+}
+
+func (i *image) getRemoteImageServer(remote config.IncusImageRemote) (ImageServerInterface, error) {
+	if i.connectRemote != nil {
+		return i.connectRemote(remote)
+	}
+	return getImageServerFromRemote(remote)
 }
 
 // parseImageName parses the image name that comes in from the config and returns a
@@ -64,6 +84,74 @@ func (i *image) getLocalImageByAlias(imageName string, imageType config.IncusIma
 	return image, nil
 }
 
+// resolveRemoteImage resolves an image alias on a remote that uses the incus or the
+// simplestreams protocol, for the given image type and architecture.
+func (i *image) resolveRemoteImage(remote config.IncusImageRemote, imageName string, imageType config.IncusImageType, arch string) (ImageServerInterface, *api.Image, error) {
+	srv, err := i.getRemoteImageServer(remote)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "connecting to remote %s", remote.Address)
+	}
+
+	aliases, err := srv.GetImageAliasArchitectures(imageType.String(), imageName)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "resolving alias: %s", imageName)
+	}
+
+	alias, ok := aliases[arch]
+	if !ok {
+		return nil, nil, fmt.Errorf("no image found for arch %s and image type %s with name %s", arch, imageType, imageName)
+	}
+
+	imageDetails, _, err := srv.GetImage(alias.Target)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "fetching image details")
+	}
+	return srv, imageDetails, nil
+}
+
+// setIncusRemoteSource resolves an image on a remote that uses the incus protocol and
+// fills in the fingerprint, certificate and, for private images, the secret Incus
+// needs to download the image from that remote.
+func (i *image) setIncusRemoteSource(instanceSource *api.InstanceSource, remote config.IncusImageRemote, imageName string, imageType config.IncusImageType, arch string) error {
+	srv, imageDetails, err := i.resolveRemoteImage(remote, imageName, imageType, arch)
+	if err != nil {
+		return err
+	}
+
+	instanceSource.Certificate, instanceSource.Secret, err = remoteImageCredentials(srv, remote, imageDetails)
+	if err != nil {
+		return errors.Wrap(err, "fetching image credentials")
+	}
+
+	// The alias may point to different images depending on the arch and type, so we
+	// always use the fingerprint we resolved.
+	instanceSource.Fingerprint = imageDetails.Fingerprint
+	instanceSource.Mode = "pull"
+	return nil
+}
+
+// remoteImageCredentials returns the certificate of the remote and, for private images,
+// the secret Incus needs to download an image from the remote.
+func remoteImageCredentials(srv ImageServerInterface, remote config.IncusImageRemote, imageDetails *api.Image) (string, string, error) {
+	var certificate, secret string
+	if remote.TLSServerCert != "" {
+		contents, err := os.ReadFile(remote.TLSServerCert)
+		if err != nil {
+			return "", "", errors.Wrap(err, "reading TLSServerCert")
+		}
+		certificate = string(contents)
+	}
+
+	if !imageDetails.Public {
+		var err error
+		secret, err = srv.GetImageSecret(imageDetails.Fingerprint)
+		if err != nil {
+			return "", "", errors.Wrap(err, "fetching image secret")
+		}
+	}
+	return certificate, secret, nil
+}
+
 func (i *image) getInstanceSource(imageName string, imageType config.IncusImageType, arch string, cli InstanceServerInterface) (api.InstanceSource, error) {
 	instanceSource := api.InstanceSource{
 		Type: "image",
@@ -81,9 +169,57 @@ func (i *image) getInstanceSource(imageName string, imageType config.IncusImageT
 		if err != nil {
 			return api.InstanceSource{}, errors.Wrapf(err, "parsing image name: %s", imageName)
 		}
-		instanceSource.Alias = parsedName
 		instanceSource.Server = remote.Address
 		instanceSource.Protocol = string(remote.Protocol)
+
+		switch {
+		case isImageSelector(parsedName):
+			imageDetails, err := i.resolveImageSelector(remote, parsedName, imageType, arch)
+			if err != nil {
+				return api.InstanceSource{}, errors.Wrapf(err, "resolving image %s", imageName)
+			}
+			instanceSource.Fingerprint = imageDetails.Fingerprint
+		case remote.Protocol == config.IncusProtocol:
+			if err := i.setIncusRemoteSource(&instanceSource, remote, parsedName, imageType, arch); err != nil {
+				return api.InstanceSource{}, errors.Wrapf(err, "resolving image %s", imageName)
+			}
+		case remote.Protocol == config.OCI:
+			if imageType != config.IncusImageContainer {
+				return api.InstanceSource{}, fmt.Errorf("OCI images can only be used for containers")
+			}
+			instanceSource.Alias = parsedName
+		default:
+			instanceSource.Alias = parsedName
+		}
 	}
 	return instanceSource, nil
 }
+
+// pinInstanceSource makes sure the image of an instance source resolves to the pinned
+// fingerprint, which may also be a prefix of the fingerprint. Images on simplestreams
+// remotes are otherwise resolved by the Incus server, so they are resolved here and
+// the instance source is changed to use the fingerprint, which makes sure the Incus
+// server uses the same image even if the alias is updated in the meantime.
+func (i *image) pinInstanceSource(instanceSource *api.InstanceSource, imageName string, imageType config.IncusImageType, arch string, pinned string) error {
+	if instanceSource.Fingerprint == "" {
+		remote, parsedName, err := i.parseImageName(imageName)
+		if err != nil {
+			return errors.Wrapf(err, "parsing image name: %s", imageName)
+		}
+		if remote.Protocol != config.SimpleStreams {
+			return runnerErrors.NewBadRequestError("image fingerprints can not be pinned for images on %s remotes", remote.Protocol)
+		}
+
+		_, imageDetails, err := i.resolveRemoteImage(remote, parsedName, imageType, arch)
+		if err != nil {
+			return errors.Wrapf(err, "resolving image %s", imageName)
+		}
+		instanceSource.Fingerprint = imageDetails.Fingerprint
+		instanceSource.Alias = ""
+	}
+
+	if !strings.HasPrefix(instanceSource.Fingerprint, pinned) {
+		return runnerErrors.NewBadRequestError("image %s resolved to fingerprint %s, which does not match the pinned fingerprint %s", imageName, instanceSource.Fingerprint, pinned)
+	}
+	return nil
+}
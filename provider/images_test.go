@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"testing"
 
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
 	"github.com/cloudbase/garm-provider-incus/config"
 	"github.com/lxc/incus/shared/api"
 	"github.com/stretchr/testify/assert"
@@ -184,3 +185,202 @@ func TestGetInstanceSource_Error(t *testing.T) {
 	assert.Equal(t, api.InstanceSource{}, instanceSource)
 	cli.AssertExpectations(t)
 }
+
+func TestGetInstanceSourceIncusRemote(t *testing.T) {
+	tests := []struct {
+		name           string
+		public         bool
+		imagePublic    bool
+		expectedSource api.InstanceSource
+	}{
+		{
+			name:        "public image",
+			public:      true,
+			imagePublic: true,
+			expectedSource: api.InstanceSource{
+				Type:        "image",
+				Mode:        "pull",
+				Server:      "https://images.example.com:8443",
+				Protocol:    "incus",
+				Fingerprint: "fingerprint",
+			},
+		},
+		{
+			name:        "private image",
+			imagePublic: false,
+			expectedSource: api.InstanceSource{
+				Type:        "image",
+				Mode:        "pull",
+				Server:      "https://images.example.com:8443",
+				Protocol:    "incus",
+				Fingerprint: "fingerprint",
+				Secret:      "secret",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := config.IncusImageRemote{
+				Address:  "https://images.example.com:8443",
+				Public:   tt.public,
+				Protocol: config.IncusProtocol,
+			}
+			srv := new(MockIncusServer)
+			i := &image{
+				remotes: map[string]config.IncusImageRemote{
+					"internal": remote,
+				},
+				connectRemote: func(r config.IncusImageRemote) (ImageServerInterface, error) {
+					require.Equal(t, remote, r)
+					return srv, nil
+				},
+			}
+			aliases := map[string]*api.ImageAliasesEntry{
+				"x86_64": {ImageAliasesEntryPut: api.ImageAliasesEntryPut{Target: "fingerprint"}},
+			}
+			srv.On("GetImageAliasArchitectures", "container", "ubuntu/22.04").Return(aliases, nil)
+			srv.On("GetImage", "fingerprint").Return(&api.Image{Fingerprint: "fingerprint", ImagePut: api.ImagePut{Public: tt.imagePublic}}, "", nil)
+			if !tt.imagePublic {
+				srv.On("GetImageSecret", "fingerprint").Return("secret", nil)
+			}
+
+			instanceSource, err := i.getInstanceSource("internal:ubuntu/22.04", config.IncusImageContainer, "x86_64", new(MockIncusServer))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedSource, instanceSource)
+			srv.AssertExpectations(t)
+		})
+	}
+}
+
+func TestGetInstanceSourceIncusRemoteMissingArch(t *testing.T) {
+	srv := new(MockIncusServer)
+	i := &image{
+		remotes: map[string]config.IncusImageRemote{
+			"internal": {
+				Address:  "https://images.example.com:8443",
+				Protocol: config.IncusProtocol,
+			},
+		},
+		connectRemote: func(config.IncusImageRemote) (ImageServerInterface, error) {
+			return srv, nil
+		},
+	}
+	srv.On("GetImageAliasArchitectures", "virtual-machine", "ubuntu/22.04").Return(map[string]*api.ImageAliasesEntry{}, nil)
+
+	_, err := i.getInstanceSource("internal:ubuntu/22.04", config.IncusImageVirtualMachine, "aarch64", new(MockIncusServer))
+	require.ErrorContains(t, err, "no image found for arch aarch64")
+	srv.AssertExpectations(t)
+}
+
+func TestGetInstanceSourceOCIRemote(t *testing.T) {
+	i := &image{
+		remotes: map[string]config.IncusImageRemote{
+			"docker": {
+				Address:  "https://docker.io",
+				Public:   true,
+				Protocol: config.OCI,
+			},
+		},
+	}
+
+	instanceSource, err := i.getInstanceSource("docker:ubuntu:22.04", config.IncusImageContainer, "x86_64", new(MockIncusServer))
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceSource{
+		Type:     "image",
+		Alias:    "ubuntu:22.04",
+		Server:   "https://docker.io",
+		Protocol: "oci",
+	}, instanceSource)
+
+	_, err = i.getInstanceSource("docker:ubuntu:22.04", config.IncusImageVirtualMachine, "x86_64", new(MockIncusServer))
+	require.ErrorContains(t, err, "OCI images can only be used for containers")
+}
+
+func TestPinInstanceSource(t *testing.T) {
+	srv := new(MockIncusServer)
+	i := &image{
+		remotes: map[string]config.IncusImageRemote{
+			"images": {
+				Address:  "https://images.linuxcontainers.org",
+				Public:   true,
+				Protocol: config.SimpleStreams,
+			},
+			"docker": {
+				Address:  "https://docker.io",
+				Public:   true,
+				Protocol: config.OCI,
+			},
+		},
+		connectRemote: func(config.IncusImageRemote) (ImageServerInterface, error) {
+			return srv, nil
+		},
+	}
+	srv.On("GetImageAliasArchitectures", "container", "ubuntu/22.04/cloud").Return(map[string]*api.ImageAliasesEntry{
+		"x86_64": {ImageAliasesEntryPut: api.ImageAliasesEntryPut{Target: "4a3f5b2c1d0e9f8a"}},
+	}, nil)
+	srv.On("GetImage", "4a3f5b2c1d0e9f8a").Return(&api.Image{Fingerprint: "4a3f5b2c1d0e9f8a"}, "", nil)
+
+	tests := []struct {
+		name      string
+		image     string
+		source    api.InstanceSource
+		pinned    string
+		expected  api.InstanceSource
+		errString string
+	}{
+		{
+			name:     "resolved fingerprint matches",
+			image:    "ubuntu",
+			source:   api.InstanceSource{Type: "image", Fingerprint: "4a3f5b2c1d0e9f8a"},
+			pinned:   "4a3f5b2c1d0e",
+			expected: api.InstanceSource{Type: "image", Fingerprint: "4a3f5b2c1d0e9f8a"},
+		},
+		{
+			name:      "resolved fingerprint does not match",
+			image:     "ubuntu",
+			source:    api.InstanceSource{Type: "image", Fingerprint: "4a3f5b2c1d0e9f8a"},
+			pinned:    "000000000000",
+			errString: "image ubuntu resolved to fingerprint 4a3f5b2c1d0e9f8a, which does not match the pinned fingerprint 000000000000",
+		},
+		{
+			name:  "simplestreams image is resolved",
+			image: "images:ubuntu/22.04/cloud",
+			source: api.InstanceSource{
+				Type:     "image",
+				Server:   "https://images.linuxcontainers.org",
+				Protocol: "simplestreams",
+				Alias:    "ubuntu/22.04/cloud",
+			},
+			pinned: "4a3f5b2c1d0e9f8a",
+			expected: api.InstanceSource{
+				Type:        "image",
+				Server:      "https://images.linuxcontainers.org",
+				Protocol:    "simplestreams",
+				Fingerprint: "4a3f5b2c1d0e9f8a",
+			},
+		},
+		{
+			name:      "oci images can not be pinned",
+			image:     "docker:ubuntu:22.04",
+			source:    api.InstanceSource{Type: "image", Alias: "ubuntu:22.04"},
+			pinned:    "4a3f5b2c1d0e",
+			errString: "image fingerprints can not be pinned for images on oci remotes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := tt.source
+			err := i.pinInstanceSource(&source, tt.image, config.IncusImageContainer, "x86_64", tt.pinned)
+			if tt.errString != "" {
+				require.Error(t, err)
+				assert.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+				assert.Contains(t, err.Error(), tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, source)
+		})
+	}
+}
@@ -16,13 +16,24 @@
 package provider
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
-	execution "github.com/cloudbase/garm-provider-common/execution/v0.1.0"
+	commonExecution "github.com/cloudbase/garm-provider-common/execution/common"
+	execution "github.com/cloudbase/garm-provider-common/execution/v0.1.1"
 	"github.com/cloudbase/garm-provider-incus/config"
 
 	incus "github.com/lxc/incus/client"
@@ -53,8 +64,103 @@ const (
 	// architecture a runner is supposed to have. This value is defined in the pool and
 	// passed into the provider as bootstrap params.
 	osArchKeyNAme = "user.os-arch"
+
+	// userDataKeyName is the key holding the cloud-config of the instance.
+	userDataKeyName = "user.user-data"
+	// vendorDataKeyName and networkConfigKeyName hold the cloud-init vendor data and
+	// network config of the instance.
+	vendorDataKeyName    = "user.vendor-data"
+	networkConfigKeyName = "user.network-config"
+
+	// The cloud-init.* keys replace the legacy user.* keys above, and are used if
+	// use_cloud_init_keys is enabled.
+	cloudInitUserDataKeyName      = "cloud-init.user-data"
+	cloudInitVendorDataKeyName    = "cloud-init.vendor-data"
+	cloudInitNetworkConfigKeyName = "cloud-init.network-config"
+
+	// managedFlavorKeyName marks the profiles the provider created for a flavor. Only
+	// profiles holding the name of the flavor in this key are updated by the provider.
+	managedFlavorKeyName = "user.runner-flavor"
+
+	// imageFingerprintKeyName is the key we use to record the fingerprint of the image
+	// an instance was created from.
+	imageFingerprintKeyName = "user.image-fingerprint"
+	// baseImageKeyName is the key in which Incus records the fingerprint of the
+	// image an instance was created from.
+	baseImageKeyName = "volatile.base_image"
+
+	// standbyControllerIDKeyName marks the golden templates and warm clones the provider
+	// keeps for the pools of a controller. They are not runners, so they are not marked
+	// with controllerIDKeyName, and GARM never sees them.
+	standbyControllerIDKeyName = "user.runner-standby-controller-id"
+	// goldenPoolIDKey marks the golden template of a pool. goldenVersionKeyName holds
+	// a hash of the image and runner the template was built from, and goldenReadyKeyName
+	// is set once the runner is installed and the template is stopped.
+	goldenPoolIDKey      = "user.runner-golden-pool-id"
+	goldenVersionKeyName = "user.runner-golden-version"
+	goldenReadyKeyName   = "user.runner-golden-ready"
+	// warmPoolIDKey marks the pre-booted clones kept in the warm pool of a pool.
+	warmPoolIDKey = "user.runner-warm-pool-id"
+	// goldenSourceKeyName records the golden instance or template an instance was
+	// cloned from.
+	goldenSourceKeyName = "user.runner-golden-source"
+	// runnerNameKeyName records the name of a runner claimed from a warm pool. Incus
+	// can't rename running instances, so the instance keeps the name of the clone, which
+	// is what we report to GARM as the provider ID of the runner.
+	runnerNameKeyName = "user.runner-name"
+
+	// cloudInitBootFinishedPath is written by cloud-init once it ran all its modules,
+	// including the runner install script, which reports back to GARM.
+	cloudInitBootFinishedPath = "/var/lib/cloud/instance/boot-finished"
+
+	// endpointHealthCheckTimeout is the time we give an Incus endpoint to respond
+	// before we fail over to the next one.
+	endpointHealthCheckTimeout = 10 * time.Second
 )
 
+// ipPollInterval is the interval at which we check if an instance got an IP address,
+// in between events.
+var ipPollInterval = 5 * time.Second
+
+// bootstrapConfigKeys are the config keys holding bootstrap data that includes secrets.
+// They are removed from the instance once cloud-init is done with them.
+var bootstrapConfigKeys = []string{
+	userDataKeyName,
+	cloudInitUserDataKeyName,
+}
+
+// providerManagedConfigKeys are the config keys the provider sets on every instance.
+// These may never be set by pool authors through extra specs.
+var providerManagedConfigKeys = slices.Concat([]string{
+	controllerIDKeyName,
+	poolIDKey,
+	osTypeKeyName,
+	osArchKeyNAme,
+	imageFingerprintKeyName,
+	goldenSourceKeyName,
+	runnerNameKeyName,
+}, standbyConfigKeys, cloudInitConfigKeys)
+
+// standbyConfigKeys are the config keys marking golden templates and warm clones. They
+// are cleared on runners cloned from a template, and removed from claimed clones.
+var standbyConfigKeys = []string{
+	standbyControllerIDKeyName,
+	goldenPoolIDKey,
+	goldenVersionKeyName,
+	goldenReadyKeyName,
+	warmPoolIDKey,
+}
+
+// cloudInitConfigKeys are all the config keys that hold data passed to cloud-init.
+var cloudInitConfigKeys = []string{
+	userDataKeyName,
+	vendorDataKeyName,
+	networkConfigKeyName,
+	cloudInitUserDataKeyName,
+	cloudInitVendorDataKeyName,
+	cloudInitNetworkConfigKeyName,
+}
+
 var (
 	configToIncusArchMap map[commonParams.OSArch]string = map[commonParams.OSArch]string{
 		commonParams.Amd64: "x86_64",
@@ -78,12 +184,21 @@ type ToolFetchFunc func(osType commonParams.OSType, osArch commonParams.OSArch,
 
 type GetCloudConfigFunc func(bootstrapParams commonParams.BootstrapInstance, tools commonParams.RunnerApplicationDownload, runnerName string) (string, error)
 
+type GetRunnerInstallScriptFunc func(bootstrapParams commonParams.BootstrapInstance, tools commonParams.RunnerApplicationDownload, runnerName string) ([]byte, error)
+
 var (
-	DefaultToolFetch      ToolFetchFunc      = util.GetTools
-	DefaultGetCloudconfig GetCloudConfigFunc = cloudconfig.GetCloudConfig
+	DefaultToolFetch              ToolFetchFunc              = util.GetTools
+	DefaultGetCloudconfig         GetCloudConfigFunc         = cloudconfig.GetCloudConfig
+	DefaultGetRunnerInstallScript GetRunnerInstallScriptFunc = cloudconfig.GetRunnerInstallScript
 )
 
 func NewIncusProvider(configFile, controllerID string) (execution.ExternalProvider, error) {
+	return newIncus(configFile, controllerID)
+}
+
+// newIncus loads and validates the provider config, and returns a new Incus provider.
+// It is shared by the provider and the provider subcommands.
+func newIncus(configFile, controllerID string) (*Incus, error) {
 	cfg, err := config.NewConfig(configFile)
 	if err != nil {
 		return nil, errors.Wrap(err, "parsing config")
@@ -102,6 +217,8 @@ func NewIncusProvider(configFile, controllerID string) (execution.ExternalProvid
 		imageManager: &image{
 			remotes: cfg.ImageRemotes,
 		},
+		configFile: configFile,
+		stateDir:   filepath.Join(os.TempDir(), "garm-provider-incus-"+controllerID),
 	}
 
 	return provider, nil
@@ -109,15 +226,38 @@ func NewIncusProvider(configFile, controllerID string) (execution.ExternalProvid
 
 type InstanceServerInterface interface {
 	GetProject(string) (*api.Project, string, error)
+	CreateProject(api.ProjectsPost) error
+	UpdateProject(string, api.ProjectPut, string) error
 	UseProject(string) incus.InstanceServer
 	GetProfileNames() ([]string, error)
+	GetProfile(string) (*api.Profile, string, error)
+	CreateProfile(api.ProfilesPost) error
+	UpdateProfile(string, api.ProfilePut, string) error
 	CreateInstance(api.InstancesPost) (incus.Operation, error)
 	UpdateInstanceState(string, api.InstanceStatePut, string) (incus.Operation, error)
+	GetInstance(string) (*api.Instance, string, error)
 	GetInstanceFull(string) (*api.InstanceFull, string, error)
+	GetInstanceSnapshot(string, string) (*api.InstanceSnapshot, string, error)
+	UpdateInstance(string, api.InstancePut, string) (incus.Operation, error)
 	DeleteInstance(string) (incus.Operation, error)
 	GetInstancesFull(api.InstanceType) ([]api.InstanceFull, error)
+	GetInstancesFullWithFilter(api.InstanceType, []string) ([]api.InstanceFull, error)
+	HasExtension(string) bool
 	GetImageAliasArchitectures(string, string) (map[string]*api.ImageAliasesEntry, error)
 	GetImage(string) (*api.Image, string, error)
+	GetImages() ([]api.Image, error)
+	DeleteImage(string) (incus.Operation, error)
+	CreateImage(api.ImagesPost, *incus.ImageCreateArgs) (incus.Operation, error)
+	GetImageAlias(string) (*api.ImageAliasesEntry, string, error)
+	CreateImageAlias(api.ImageAliasesPost) error
+	UpdateImageAlias(string, api.ImageAliasesEntryPut, string) error
+	GetEvents() (*incus.EventListener, error)
+	GetInstanceConsoleLog(string, *incus.InstanceConsoleLogArgs) (io.ReadCloser, error)
+	GetInstanceLogfiles(string) ([]string, error)
+	GetInstanceLogfile(string, string) (io.ReadCloser, error)
+	GetInstanceFile(string, string) (io.ReadCloser, *incus.InstanceFileResponse, error)
+	CreateInstanceFile(string, string, incus.InstanceFileArgs) error
+	ExecInstance(string, api.InstanceExecPost, *incus.InstanceExecArgs) (incus.Operation, error)
 }
 
 type Incus struct {
@@ -129,6 +269,10 @@ type Incus struct {
 	imageManager *image
 	// controllerID is the ID of this controller
 	controllerID string
+	// configFile is the path to the provider config file, passed on to the pool worker.
+	configFile string
+	// stateDir holds the locks of the pool workers, and tracks when pools were last seen.
+	stateDir string
 
 	mux sync.Mutex
 }
@@ -145,9 +289,15 @@ func (l *Incus) getCLI(ctx context.Context) (InstanceServerInterface, error) {
 		return nil, errors.Wrap(err, "creating Incus client")
 	}
 
-	_, _, err = cli.GetProject(projectName(l.cfg))
-	if err != nil {
-		return nil, errors.Wrapf(err, "fetching project name: %s", projectName(l.cfg))
+	if l.cfg.ManageProject {
+		if err := l.reconcileProject(cli); err != nil {
+			return nil, errors.Wrapf(err, "reconciling project: %s", projectName(l.cfg))
+		}
+	} else {
+		_, _, err = cli.GetProject(projectName(l.cfg))
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching project name: %s", projectName(l.cfg))
+		}
 	}
 	cli = cli.UseProject(projectName(l.cfg))
 	l.cli = cli
@@ -155,33 +305,205 @@ func (l *Incus) getCLI(ctx context.Context) (InstanceServerInterface, error) {
 	return cli, nil
 }
 
+// reconcileProject creates the project if it is missing, and makes sure its limits
+// match the ones in the provider config. Features are only set when the project is
+// created, as Incus refuses to change them on a project that has instances. Feature
+// drift on an existing project is logged, so it never keeps the provider from
+// working. Any other project settings are left untouched.
+func (l *Incus) reconcileProject(cli InstanceServerInterface) error {
+	name := projectName(l.cfg)
+	desired := managedProjectConfig(l.cfg.Project)
+
+	project, etag, err := cli.GetProject(name)
+	if err != nil {
+		if !isNotFoundError(err) {
+			return errors.Wrap(err, "fetching project")
+		}
+
+		projectConfig := map[string]string{}
+		for key, val := range desired {
+			if val != "" {
+				projectConfig[key] = val
+			}
+		}
+		err := cli.CreateProject(api.ProjectsPost{
+			Name: name,
+			ProjectPut: api.ProjectPut{
+				Description: DefaultProjectDescription,
+				Config:      projectConfig,
+			},
+		})
+		if err != nil {
+			return errors.Wrap(err, "creating project")
+		}
+		return nil
+	}
+
+	projectConfig := maps.Clone(project.Config)
+	if projectConfig == nil {
+		projectConfig = map[string]string{}
+	}
+	changed := false
+	for key, val := range desired {
+		current, ok := projectConfig[key]
+		if strings.HasPrefix(key, "features.") {
+			if current != val {
+				log.Printf("feature %s of project %s is %q instead of %q, not changing it as Incus does not allow changing features of projects in use", key, name, current, val)
+			}
+			continue
+		}
+		switch {
+		case val == "" && ok:
+			delete(projectConfig, key)
+			changed = true
+		case val != "" && current != val:
+			projectConfig[key] = val
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	err = cli.UpdateProject(name, api.ProjectPut{
+		Description: project.Description,
+		Config:      projectConfig,
+	}, etag)
+	if err != nil {
+		return errors.Wrap(err, "updating project")
+	}
+	return nil
+}
+
+// ensureFlavorProfile creates or updates the profile of a flavor defined in the
+// provider config. Flavors not defined in the provider config are left alone.
+func (l *Incus) ensureFlavorProfile(cli InstanceServerInterface, flavor string) error {
+	flavorCfg, ok := l.cfg.Flavors[flavor]
+	if !ok {
+		return nil
+	}
+	desired := flavorToProfile(flavorCfg)
+	desired.Config[managedFlavorKeyName] = flavor
+
+	profile, etag, err := cli.GetProfile(flavor)
+	if err != nil {
+		if !isNotFoundError(err) {
+			return errors.Wrapf(err, "fetching profile %s", flavor)
+		}
+		err := cli.CreateProfile(api.ProfilesPost{
+			Name:       flavor,
+			ProfilePut: desired,
+		})
+		// Another instance of the provider may have created the profile in the
+		// meantime. That's fine, it will have used the same flavor definition.
+		if err != nil && !api.StatusErrorCheck(err, http.StatusConflict) {
+			return errors.Wrapf(err, "creating profile %s", flavor)
+		}
+		return nil
+	}
+
+	// Never overwrite profiles we did not create, like the default profile, which
+	// holds the NICs and root disk of every other instance in the project.
+	if profile.Config[managedFlavorKeyName] != flavor {
+		return runnerErrors.NewBadRequestError("profile %s was not created for flavor %s, refusing to update it (set %s=%s on the profile to let the provider manage it)", flavor, flavor, managedFlavorKeyName, flavor)
+	}
+
+	if profileMatches(profile.ProfilePut, desired) {
+		return nil
+	}
+
+	if err := cli.UpdateProfile(flavor, desired, etag); err != nil {
+		return errors.Wrapf(err, "updating profile %s", flavor)
+	}
+	return nil
+}
+
+// getProfiles returns the profiles of the instances of a flavor. The profiles of
+// flavors defined in the provider config are created by ensureProfiles when needed,
+// so only the other flavors are looked up. This never writes to Incus, so it is safe
+// to use when validating pools.
 func (l *Incus) getProfiles(ctx context.Context, flavor string) ([]string, error) {
 	ret := []string{}
 	if l.cfg.IncludeDefaultProfile {
 		ret = append(ret, "default")
 	}
 
-	set := map[string]struct{}{}
+	if _, ok := l.cfg.Flavors[flavor]; !ok {
+		cli, err := l.getCLI(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching client")
+		}
+
+		profiles, err := cli.GetProfileNames()
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching profile names")
+		}
+		if !slices.Contains(profiles, flavor) {
+			return nil, errors.Wrapf(runnerErrors.ErrNotFound, "looking for profile %s", flavor)
+		}
+	}
+
+	ret = append(ret, flavor)
+	return ret, nil
+}
 
+// ensureProfiles creates or updates the profile of a flavor defined in the provider
+// config, and returns the profiles of the instances of the flavor. It is used before
+// creating instances.
+func (l *Incus) ensureProfiles(ctx context.Context, flavor string) ([]string, error) {
 	cli, err := l.getCLI(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "fetching client")
 	}
 
-	profiles, err := cli.GetProfileNames()
-	if err != nil {
-		return nil, errors.Wrap(err, "fetching profile names")
+	if err := l.ensureFlavorProfile(cli, flavor); err != nil {
+		return nil, errors.Wrap(err, "ensuring flavor profile")
 	}
-	for _, profile := range profiles {
-		set[profile] = struct{}{}
+	return l.getProfiles(ctx, flavor)
+}
+
+// getRootDiskDevice returns the root disk device of the instance, with the size and
+// pool from the extra specs applied. The device is copied from the last profile that
+// defines one, which is the one Incus would use when expanding the profiles.
+func (l *Incus) getRootDiskDevice(ctx context.Context, profiles []string, specs extraSpecs) (string, map[string]string, error) {
+	if specs.RootDiskSize == "" && specs.RootDiskPool == "" {
+		return "", nil, nil
 	}
 
-	if _, ok := set[flavor]; !ok {
-		return nil, errors.Wrapf(runnerErrors.ErrNotFound, "looking for profile %s", flavor)
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "fetching client")
 	}
 
-	ret = append(ret, flavor)
-	return ret, nil
+	name := "root"
+	device := map[string]string{
+		"type": "disk",
+		"path": "/",
+	}
+	for _, profileName := range profiles {
+		profile, _, err := cli.GetProfile(profileName)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "fetching profile %s", profileName)
+		}
+		for devName, dev := range profile.Devices {
+			if dev["type"] == "disk" && dev["path"] == "/" {
+				name = devName
+				device = maps.Clone(dev)
+			}
+		}
+	}
+
+	if specs.RootDiskPool != "" {
+		device["pool"] = specs.RootDiskPool
+	}
+	if device["pool"] == "" {
+		return "", nil, runnerErrors.NewBadRequestError("no root disk found in profiles %v and no root_disk_pool set", profiles)
+	}
+	if specs.RootDiskSize != "" {
+		device["size"] = specs.RootDiskSize
+	}
+	return name, device, nil
 }
 
 // sadly, the security.secureboot flag is a string encoded boolean.
@@ -192,11 +514,63 @@ func (l *Incus) secureBootEnabled() string {
 	return "false"
 }
 
+// getBootstrapMode returns the bootstrap mode for a pool. The bootstrap mode set in
+// the extra specs of the pool takes precedence over the one in the provider config.
+func (l *Incus) getBootstrapMode(specs extraSpecs) config.BootstrapMode {
+	switch specs.BootstrapMode {
+	case config.BootstrapCloudInit, config.BootstrapExec:
+		return specs.BootstrapMode
+	default:
+		return l.cfg.GetBootstrapMode()
+	}
+}
+
+// getInstanceType returns the instance type for a pool. The instance type set in
+// the extra specs of the pool takes precedence over the one in the provider config.
+func (l *Incus) getInstanceType(specs extraSpecs) config.IncusImageType {
+	switch specs.InstanceType {
+	case config.IncusImageVirtualMachine, config.IncusImageContainer:
+		return specs.InstanceType
+	default:
+		return l.cfg.GetInstanceType()
+	}
+}
+
+// cloudInitConfig returns the config keys holding the cloud-init data of a new
+// instance. The vendor data and network config set in the extra specs of the pool
+// take precedence over the ones in the provider config.
+func (l *Incus) cloudInitConfig(userData string, specs extraSpecs) map[string]string {
+	useCloudInitKeys := l.cfg.UseCloudInitKeys
+	if specs.UseCloudInitKeys != nil {
+		useCloudInitKeys = *specs.UseCloudInitKeys
+	}
+
+	userDataKey, vendorDataKey, networkConfigKey := userDataKeyName, vendorDataKeyName, networkConfigKeyName
+	if useCloudInitKeys {
+		userDataKey, vendorDataKey, networkConfigKey = cloudInitUserDataKeyName, cloudInitVendorDataKeyName, cloudInitNetworkConfigKeyName
+	}
+
+	ret := map[string]string{
+		userDataKey: userData,
+	}
+
+	vendorData := cmp.Or(specs.VendorData, l.cfg.VendorData)
+	if vendorData != "" {
+		ret[vendorDataKey] = vendorData
+	}
+
+	networkConfig := cmp.Or(specs.NetworkConfig, l.cfg.NetworkConfig)
+	if networkConfig != "" {
+		ret[networkConfigKey] = networkConfig
+	}
+	return ret
+}
+
 func (l *Incus) getCreateInstanceArgs(ctx context.Context, bootstrapParams commonParams.BootstrapInstance, specs extraSpecs) (api.InstancesPost, error) {
 	if bootstrapParams.Name == "" {
 		return api.InstancesPost{}, runnerErrors.NewBadRequestError("missing name")
 	}
-	profiles, err := l.getProfiles(ctx, bootstrapParams.Flavor)
+	profiles, err := l.ensureProfiles(ctx, bootstrapParams.Flavor)
 	if err != nil {
 		return api.InstancesPost{}, errors.Wrap(err, "fetching profiles")
 	}
@@ -206,47 +580,108 @@ func (l *Incus) getCreateInstanceArgs(ctx context.Context, bootstrapParams commo
 		return api.InstancesPost{}, errors.Wrap(err, "fetching archictecture")
 	}
 
-	instanceType := l.cfg.GetInstanceType()
-	instanceSource, err := l.imageManager.getInstanceSource(bootstrapParams.Image, instanceType, arch, l.cli)
-	if err != nil {
-		return api.InstancesPost{}, errors.Wrap(err, "getting instance source")
+	if err := checkPassthrough(specs, l.cfg.Passthrough); err != nil {
+		return api.InstancesPost{}, errors.Wrap(err, "checking extra specs")
 	}
 
-	tools, err := DefaultToolFetch(bootstrapParams.OSType, bootstrapParams.OSArch, bootstrapParams.Tools)
-	if err != nil {
-		return api.InstancesPost{}, errors.Wrap(err, "getting tools")
+	instanceType := l.getInstanceType(specs)
+	var instanceSource api.InstanceSource
+	if specs.GoldenInstance != "" {
+		// Runners cloned from a golden instance have the same type as the golden instance.
+		instanceSource, instanceType, err = l.getGoldenInstanceSource(ctx, specs.GoldenInstance, arch)
+		if err != nil {
+			return api.InstancesPost{}, errors.Wrap(err, "getting golden instance")
+		}
+	} else {
+		instanceSource, err = l.imageManager.getInstanceSource(bootstrapParams.Image, instanceType, arch, l.cli)
+		if err != nil {
+			return api.InstancesPost{}, errors.Wrap(err, "getting instance source")
+		}
+		if specs.ImageFingerprint != "" {
+			if err := l.imageManager.pinInstanceSource(&instanceSource, bootstrapParams.Image, instanceType, arch, specs.ImageFingerprint); err != nil {
+				return api.InstancesPost{}, errors.Wrap(err, "pinning image")
+			}
+		}
+	}
+	if err := specs.checkInstanceType(instanceType); err != nil {
+		return api.InstancesPost{}, err
 	}
 
-	bootstrapParams.UserDataOptions.DisableUpdatesOnBoot = specs.DisableUpdates
-	bootstrapParams.UserDataOptions.ExtraPackages = specs.ExtraPackages
-	bootstrapParams.UserDataOptions.EnableBootDebug = specs.EnableBootDebug
-	cloudCfg, err := DefaultGetCloudconfig(bootstrapParams, tools, bootstrapParams.Name)
-	if err != nil {
-		return api.InstancesPost{}, errors.Wrap(err, "generating cloud-config")
+	// In exec mode, the runner install script is pushed into the instance once it
+	// is up, so we don't pass any user data to the instance.
+	configMap := map[string]string{}
+	if l.getBootstrapMode(specs) == config.BootstrapCloudInit {
+		tools, err := DefaultToolFetch(bootstrapParams.OSType, bootstrapParams.OSArch, bootstrapParams.Tools)
+		if err != nil {
+			return api.InstancesPost{}, errors.Wrap(err, "getting tools")
+		}
+
+		cloudCfg, err := DefaultGetCloudconfig(withUserDataOptions(bootstrapParams, specs), tools, bootstrapParams.Name)
+		if err != nil {
+			return api.InstancesPost{}, errors.Wrap(err, "generating cloud-config")
+		}
+
+		if bootstrapParams.OSType == commonParams.Windows {
+			cloudCfg = fmt.Sprintf("#ps1_sysnative\n%s", cloudCfg)
+		}
+		configMap = l.cloudInitConfig(cloudCfg, specs)
+	} else {
+		if bootstrapParams.OSType != commonParams.Linux {
+			return api.InstancesPost{}, runnerErrors.NewBadRequestError("the %s bootstrap mode only supports linux instances", config.BootstrapExec)
+		}
+		if err := specs.checkExecBootstrap(); err != nil {
+			return api.InstancesPost{}, err
+		}
 	}
 
-	if bootstrapParams.OSType == commonParams.Windows {
-		cloudCfg = fmt.Sprintf("#ps1_sysnative\n%s", cloudCfg)
+	if specs.GoldenInstance != "" {
+		setCloneConfig(configMap, specs.GoldenInstance)
 	}
 
-	configMap := map[string]string{
-		"user.user-data":    cloudCfg,
-		osTypeKeyName:       string(bootstrapParams.OSType),
-		osArchKeyNAme:       string(bootstrapParams.OSArch),
-		controllerIDKeyName: l.controllerID,
-		poolIDKey:           bootstrapParams.PoolID,
+	// If the image is resolved by the Incus server, the fingerprint is recorded once
+	// the instance is created.
+	if instanceSource.Fingerprint != "" {
+		configMap[imageFingerprintKeyName] = instanceSource.Fingerprint
 	}
+	configMap[osTypeKeyName] = string(bootstrapParams.OSType)
+	configMap[osArchKeyNAme] = string(bootstrapParams.OSArch)
+	configMap[controllerIDKeyName] = l.controllerID
+	configMap[poolIDKey] = bootstrapParams.PoolID
 
 	if instanceType == config.IncusImageVirtualMachine {
 		configMap["security.secureboot"] = l.secureBootEnabled()
 	}
 
+	// Raw config keys from the extra specs never override the keys set above.
+	for key, val := range specs.Config {
+		if _, ok := configMap[key]; !ok {
+			configMap[key] = val
+		}
+	}
+
+	for key, val := range specs.limitsConfig() {
+		configMap[key] = val
+	}
+
+	devices := maps.Clone(specs.Devices)
+	rootDiskName, rootDisk, err := l.getRootDiskDevice(ctx, profiles, specs)
+	if err != nil {
+		return api.InstancesPost{}, errors.Wrap(err, "getting root disk")
+	}
+	if rootDisk != nil {
+		if devices == nil {
+			devices = map[string]map[string]string{}
+		}
+		devices[rootDiskName] = rootDisk
+	}
+
 	args := api.InstancesPost{
 		InstancePut: api.InstancePut{
 			Architecture: arch,
 			Profiles:     profiles,
 			Description:  "Github runner provisioned by garm",
 			Config:       configMap,
+			Devices:      devices,
 		},
 		Source: instanceSource,
 		Name:   bootstrapParams.Name,
@@ -255,6 +690,22 @@ func (l *Incus) getCreateInstanceArgs(ctx context.Context, bootstrapParams commo
 	return args, nil
 }
 
+// setCloneConfig sets the config of an instance cloned from a golden instance or template.
+// Clones inherit the config of the golden instance. Make sure none of the cloud-init data
+// of the golden instance is handed to the clone, and that clones of a golden template
+// are not taken for templates.
+func setCloneConfig(configMap map[string]string, golden string) {
+	for _, key := range cloudInitConfigKeys {
+		if _, ok := configMap[key]; !ok {
+			configMap[key] = ""
+		}
+	}
+	for _, key := range standbyConfigKeys {
+		configMap[key] = ""
+	}
+	configMap[goldenSourceKeyName] = golden
+}
+
 func (l *Incus) launchInstance(ctx context.Context, createArgs api.InstancesPost) error {
 	cli, err := l.getCLI(ctx)
 	if err != nil {
@@ -269,7 +720,7 @@ func (l *Incus) launchInstance(ctx context.Context, createArgs api.InstancesPost
 	// Wait for the operation to complete
 	err = op.Wait()
 	if err != nil {
-		return errors.Wrap(err, "waiting for instance creation")
+		return l.rollbackInstance(ctx, createArgs.Name, errors.Wrap(err, "waiting for instance creation"))
 	}
 
 	// Get Incus to start the instance (background operation)
@@ -280,55 +731,305 @@ func (l *Incus) launchInstance(ctx context.Context, createArgs api.InstancesPost
 
 	op, err = cli.UpdateInstanceState(createArgs.Name, reqState, "")
 	if err != nil {
-		return errors.Wrap(err, "starting instance")
+		return l.rollbackInstance(ctx, createArgs.Name, errors.Wrap(err, "starting instance"))
 	}
 
 	// Wait for the operation to complete
 	err = op.Wait()
 	if err != nil {
-		return errors.Wrap(err, "waiting for instance to start")
+		return l.rollbackInstance(ctx, createArgs.Name, errors.Wrap(err, "waiting for instance to start"))
 	}
 	return nil
 }
 
+// rollbackInstance removes an instance that failed after it was created, so we never
+// leave it behind for GARM to trip over. Diagnostics are captured from the instance
+// before it is removed, and returned as part of the error. The instance is left alone
+// if it was not created by this controller, which may happen if two controllers race
+// to create an instance with the same name.
+func (l *Incus) rollbackInstance(ctx context.Context, instanceName string, cause error) error {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return fmt.Errorf("%w (failed to remove instance: %s)", cause, err)
+	}
+	instance, _, err := cli.GetInstance(instanceName)
+	if err != nil {
+		if isNotFoundError(err) {
+			return cause
+		}
+		return fmt.Errorf("%w (failed to remove instance: %s)", cause, err)
+	}
+	if err := l.checkOwnership(instanceName, instance.ExpandedConfig); err != nil {
+		return fmt.Errorf("%w (not removing instance: %s)", cause, err)
+	}
+
+	fault := l.collectDiagnostics(ctx, instanceName)
+	if err := l.deleteInstance(ctx, instanceName); err != nil {
+		cause = fmt.Errorf("%w (failed to remove instance: %s)", cause, err)
+	}
+	return &instanceFaultError{
+		err:   cause,
+		fault: fault,
+	}
+}
+
 // CreateInstance creates a new compute instance in the provider.
 func (l *Incus) CreateInstance(ctx context.Context, bootstrapParams commonParams.BootstrapInstance) (commonParams.ProviderInstance, error) {
 	extraSpecs, err := parseExtraSpecsFromBootstrapParams(bootstrapParams)
 	if err != nil {
 		return commonParams.ProviderInstance{}, errors.Wrap(err, "parsing extra specs")
 	}
+	if extraSpecs.WarmPoolSize > 0 && bootstrapParams.OSType != commonParams.Linux {
+		return commonParams.ProviderInstance{}, runnerErrors.NewBadRequestError("warm pools only support linux instances")
+	}
+
+	worker := poolWorkerSpec{
+		PoolID:         bootstrapParams.PoolID,
+		GoldenInstance: extraSpecs.GoldenInstance,
+		WarmPoolSize:   extraSpecs.WarmPoolSize,
+	}
+	if extraSpecs.GoldenTemplate {
+		// Runners are cloned from the golden template as they would be from a golden
+		// instance, or created from the image until the pool has a template.
+		worker.Template, extraSpecs.GoldenInstance, err = l.getGoldenTemplate(ctx, bootstrapParams, extraSpecs)
+		if err != nil {
+			return commonParams.ProviderInstance{}, errors.Wrap(err, "getting golden template")
+		}
+	}
+
 	args, err := l.getCreateInstanceArgs(ctx, bootstrapParams, extraSpecs)
 	if err != nil {
 		return commonParams.ProviderInstance{}, errors.Wrap(err, "fetching create args")
 	}
 
+	// The pool worker builds the golden template and refills the warm pool in the
+	// background, once we're done with the runner.
+	worker.Clone = warmInstanceBaseArgs(args)
+	defer l.startPoolWorker(worker)
+
+	bootstrapMode := l.getBootstrapMode(extraSpecs)
+	// The warm pool only holds clones, so it is skipped while the runner is created
+	// from the image of the pool, as when the first golden template is being built.
+	warm := extraSpecs.WarmPoolSize > 0 && extraSpecs.GoldenInstance != ""
+
+	var files bootstrapFiles
+	if bootstrapMode == config.BootstrapExec || warm {
+		files, err = getBootstrapFiles(bootstrapParams, extraSpecs)
+		if err != nil {
+			return commonParams.ProviderInstance{}, errors.Wrap(err, "generating bootstrap files")
+		}
+	}
+
+	if warm {
+		instanceName, err := l.claimWarmInstance(ctx, bootstrapParams, extraSpecs.GoldenInstance)
+		if err != nil {
+			return commonParams.ProviderInstance{}, errors.Wrap(err, "claiming warm instance")
+		}
+		if instanceName != "" {
+			return l.bootstrapWarmInstance(ctx, instanceName, config.IncusImageType(args.Type), files)
+		}
+		log.Printf("no warm instance available in pool %s, creating runner %s", bootstrapParams.PoolID, bootstrapParams.Name)
+	}
+
 	if err := l.launchInstance(ctx, args); err != nil {
 		return commonParams.ProviderInstance{}, errors.Wrap(err, "creating instance")
 	}
 
 	ret, err := l.waitInstanceHasIP(ctx, args.Name)
 	if err != nil {
+		err = l.rollbackInstance(ctx, args.Name, err)
 		return commonParams.ProviderInstance{}, errors.Wrap(err, "fetching instance")
 	}
 
+	if args.Config[imageFingerprintKeyName] == "" {
+		// The fingerprint is only informational, so failing to record it does not
+		// affect the runner.
+		if err := l.recordImageFingerprint(ctx, args.Name); err != nil {
+			log.Printf("failed to record the image fingerprint of instance %s: %s", args.Name, err)
+		}
+	}
+
+	if bootstrapMode == config.BootstrapExec {
+		if err := l.execBootstrap(ctx, args.Name, config.IncusImageType(args.Type), files); err != nil {
+			err = l.rollbackInstance(ctx, args.Name, err)
+			return commonParams.ProviderInstance{}, errors.Wrap(err, "bootstrapping instance")
+		}
+	}
+
 	return ret, nil
 }
 
+// recordImageFingerprint records the fingerprint of the image an instance was created
+// from, for instances created from an image alias resolved by the Incus server or
+// cloned from a golden instance.
+func (l *Incus) recordImageFingerprint(ctx context.Context, instanceName string) error {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+
+	instance, etag, err := cli.GetInstance(instanceName)
+	if err != nil {
+		return errors.Wrap(err, "fetching instance")
+	}
+
+	fingerprint := instance.Config[baseImageKeyName]
+	if fingerprint == "" || instance.Config[imageFingerprintKeyName] == fingerprint {
+		return nil
+	}
+
+	instancePut := instance.Writable()
+	instancePut.Config[imageFingerprintKeyName] = fingerprint
+	op, err := cli.UpdateInstance(instanceName, instancePut, etag)
+	if err != nil {
+		return errors.Wrap(err, "recording image fingerprint")
+	}
+	if err := op.Wait(); err != nil {
+		return errors.Wrap(err, "waiting for image fingerprint to be recorded")
+	}
+	return nil
+}
+
+// scrubFinishedUserData removes the user data of an instance once cloud-init finished
+// running it. The instance getting an IP address is not enough, as datasources may read
+// the user data after DHCP, and a slow cloud-init run may still need it. Checking the
+// state of cloud-init takes a request per instance, so it is only done for instances
+// that still hold user data. Instances of which we can't read the state of cloud-init,
+// like virtual machines without the Incus agent, keep their user data until we can.
+// Windows instances are skipped, as there is no reliable way to tell when cloudbase-init
+// is done with the user data.
+//
+// Failing to remove the user data does not affect the runner, so errors are only logged.
+func (l *Incus) scrubFinishedUserData(ctx context.Context, instance *api.InstanceFull) {
+	if l.cfg.KeepUserData || instance.State == nil || incusStatusToProviderStatus(instance.State.Status) != commonParams.InstanceRunning {
+		return
+	}
+	if commonParams.OSType(instance.ExpandedConfig[osTypeKeyName]) == commonParams.Windows {
+		return
+	}
+	if !slices.ContainsFunc(bootstrapConfigKeys, func(key string) bool { return instance.Config[key] != "" }) {
+		return
+	}
+
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		log.Printf("failed to fetch client: %s", err)
+		return
+	}
+	finished, _, err := cli.GetInstanceFile(instance.Name, cloudInitBootFinishedPath)
+	if err != nil {
+		// cloud-init is still running, or we can't reach the instance yet.
+		return
+	}
+	finished.Close()
+
+	if err := l.scrubUserData(ctx, instance.Name); err != nil {
+		log.Printf("failed to remove user data of instance %s: %s", instance.Name, err)
+	}
+}
+
+// scrubUserData removes the bootstrap data from the config of an instance. The user data
+// holds the GARM instance token and callback URLs, which anyone with access to the project
+// could otherwise read for as long as the runner exists.
+func (l *Incus) scrubUserData(ctx context.Context, instanceName string) error {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+
+	instance, etag, err := cli.GetInstance(instanceName)
+	if err != nil {
+		return errors.Wrap(err, "fetching instance")
+	}
+
+	instancePut := instance.Writable()
+	changed := false
+	for _, key := range bootstrapConfigKeys {
+		if _, ok := instancePut.Config[key]; ok {
+			delete(instancePut.Config, key)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	op, err := cli.UpdateInstance(instanceName, instancePut, etag)
+	if err != nil {
+		return errors.Wrap(err, "removing user data")
+	}
+	if err := op.Wait(); err != nil {
+		return errors.Wrap(err, "waiting for user data removal")
+	}
+	return nil
+}
+
+// checkOwnership makes sure the instance was created by this controller. Instances
+// created by other controllers, or by hand, are reported as not found, so we never act
+// on them. The golden templates and warm clones kept for the pools of this controller
+// are owned by it as well.
+func (l *Incus) checkOwnership(instanceName string, instanceConfig map[string]string) error {
+	if l.cfg.SkipOwnershipCheck {
+		return nil
+	}
+	if id, ok := instanceConfig[controllerIDKeyName]; ok && id == l.controllerID {
+		return nil
+	}
+	if id := instanceConfig[standbyControllerIDKeyName]; id != "" && id == l.controllerID {
+		return nil
+	}
+	return errors.Wrapf(runnerErrors.ErrNotFound, "instance %s is not managed by this controller", instanceName)
+}
+
+// verifyOwnership fetches the instance and makes sure it was created by this controller.
+func (l *Incus) verifyOwnership(ctx context.Context, instanceName string) error {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+
+	instance, _, err := cli.GetInstance(instanceName)
+	if err != nil {
+		if isNotFoundError(err) {
+			return errors.Wrapf(runnerErrors.ErrNotFound, "fetching instance: %q", err)
+		}
+		return errors.Wrap(err, "fetching instance")
+	}
+	return l.checkOwnership(instanceName, instance.ExpandedConfig)
+}
+
 // GetInstance will return details about one instance.
 func (l *Incus) GetInstance(ctx context.Context, instanceName string) (commonParams.ProviderInstance, error) {
+	instance, err := l.getInstanceFull(ctx, instanceName)
+	if err != nil {
+		return commonParams.ProviderInstance{}, err
+	}
+
+	if err := l.checkOwnership(instanceName, instance.ExpandedConfig); err != nil {
+		return commonParams.ProviderInstance{}, err
+	}
+
+	ret := incusInstanceToAPIInstance(instance)
+	if ret.Status == commonParams.InstanceError {
+		ret.ProviderFault = l.collectDiagnostics(ctx, instanceName)
+	}
+	return ret, nil
+}
+
+// getInstanceFull fetches the instance, along with its state.
+func (l *Incus) getInstanceFull(ctx context.Context, instanceName string) (*api.InstanceFull, error) {
 	cli, err := l.getCLI(ctx)
 	if err != nil {
-		return commonParams.ProviderInstance{}, errors.Wrap(err, "fetching client")
+		return nil, errors.Wrap(err, "fetching client")
 	}
 	instance, _, err := cli.GetInstanceFull(instanceName)
 	if err != nil {
 		if isNotFoundError(err) {
-			return commonParams.ProviderInstance{}, errors.Wrapf(runnerErrors.ErrNotFound, "fetching instance: %q", err)
+			return nil, errors.Wrapf(runnerErrors.ErrNotFound, "fetching instance: %q", err)
 		}
-		return commonParams.ProviderInstance{}, errors.Wrap(err, "fetching instance")
+		return nil, errors.Wrap(err, "fetching instance")
 	}
-
-	return incusInstanceToAPIInstance(instance), nil
+	return instance, nil
 }
 
 // Delete instance will delete the instance in a provider.
@@ -338,6 +1039,27 @@ func (l *Incus) DeleteInstance(ctx context.Context, instance string) error {
 		return errors.Wrap(err, "fetching client")
 	}
 
+	existing, _, err := cli.GetInstance(instance)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil
+		}
+		return errors.Wrap(err, "fetching instance")
+	}
+
+	if err := l.checkOwnership(instance, existing.ExpandedConfig); err != nil {
+		return err
+	}
+	return l.deleteInstance(ctx, instance)
+}
+
+// deleteInstance force stops and removes an instance, without checking who owns it.
+func (l *Incus) deleteInstance(ctx context.Context, instance string) error {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+
 	if err := l.setState(ctx, instance, "stop", true); err != nil {
 		if isNotFoundError(err) {
 			return nil
@@ -400,6 +1122,14 @@ func (l *Incus) ListInstances(ctx context.Context, poolID string) ([]commonParam
 		return []commonParams.ProviderInstance{}, errors.Wrap(err, "fetching client")
 	}
 
+	if poolID != "" {
+		// GARM lists the runners of every pool it has, so this tells the pool workers
+		// the pool still exists.
+		if err := l.touchPool(poolID, false); err != nil {
+			log.Printf("failed to mark pool %s as seen: %s", poolID, err)
+		}
+	}
+
 	result := make(chan listResponse, 1)
 
 	go func() {
@@ -408,7 +1138,7 @@ func (l *Incus) ListInstances(ctx context.Context, poolID string) ([]commonParam
 		// external process will allow us to not care if a goroutine leaks. Once a timeout
 		// is reached, the provider can just exit with an error. Something we can't do with
 		// internal providers.
-		instances, err := cli.GetInstancesFull(api.InstanceTypeAny)
+		instances, err := l.getInstancesFull(cli, poolID)
 		result <- listResponse{
 			instances: instances,
 			err:       err,
@@ -436,6 +1166,9 @@ func (l *Incus) ListInstances(ctx context.Context, poolID string) ([]commonParam
 					// Pool ID was specified. Filter out instances belonging to other pools.
 					continue
 				}
+				// GARM lists the runners of each pool to keep track of them, so this
+				// is where we find the runners that are done with their user data.
+				l.scrubFinishedUserData(ctx, &instance)
 			}
 			ret = append(ret, incusInstanceToAPIInstance(&instance))
 		}
@@ -444,21 +1177,86 @@ func (l *Incus) ListInstances(ctx context.Context, poolID string) ([]commonParam
 	return ret, nil
 }
 
-// RemoveAllInstances will remove all instances created by this provider.
+// getInstancesFull fetches the instances created by this controller, and optionally
+// belonging to a pool. The filtering is done server side if Incus supports it, so
+// we don't fetch the full state of every instance in a shared project.
+func (l *Incus) getInstancesFull(cli InstanceServerInterface, poolID string) ([]api.InstanceFull, error) {
+	if !cli.HasExtension("api_filtering") {
+		return cli.GetInstancesFull(api.InstanceTypeAny)
+	}
+
+	filters := []string{
+		fmt.Sprintf("config.%s=%s", controllerIDKeyName, l.controllerID),
+	}
+	if poolID != "" {
+		filters = append(filters, fmt.Sprintf("config.%s=%s", poolIDKey, poolID))
+	}
+	return cli.GetInstancesFullWithFilter(api.InstanceTypeAny, filters)
+}
+
+// RemoveAllInstances will remove all instances created by this provider, along with
+// the golden templates and warm clones kept for the pools of this controller.
 func (l *Incus) RemoveAllInstances(ctx context.Context) error {
 	instances, err := l.ListInstances(ctx, "")
 	if err != nil {
 		return errors.Wrap(err, "fetching instance list")
 	}
-
+	toRemove := make([]string, 0, len(instances))
 	for _, instance := range instances {
-		// TODO: remove in parallel
-		if err := l.DeleteInstance(ctx, instance.Name); err != nil {
-			return errors.Wrapf(err, "removing instance %s", instance.Name)
+		toRemove = append(toRemove, instance.ProviderID)
+	}
+
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+	standby, err := l.getStandbyInstances(cli, "", "")
+	if err != nil {
+		return errors.Wrap(err, "fetching standby instances")
+	}
+	for _, instance := range standby {
+		toRemove = append(toRemove, instance.Name)
+	}
+
+	names := make(chan string)
+	removeErr := &aggregateError{format: "failed to remove %d instances"}
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	for i := 0; i < min(l.cfg.GetRemoveConcurrency(), len(toRemove)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				// We only list instances created by this controller, so there is
+				// no need to check who owns them again.
+				if err := l.deleteInstance(ctx, name); err != nil {
+					mux.Lock()
+					removeErr.add(name, err)
+					mux.Unlock()
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for idx, name := range toRemove {
+		select {
+		case names <- name:
+		case <-ctx.Done():
+			// Don't start removing any more instances, but report all the ones
+			// we did not get to.
+			mux.Lock()
+			for _, remaining := range toRemove[idx:] {
+				removeErr.add(remaining, ctx.Err())
+			}
+			mux.Unlock()
+			break dispatch
 		}
 	}
+	close(names)
+	wg.Wait()
 
-	return nil
+	return removeErr.errOrNil()
 }
 
 func (l *Incus) setState(ctx context.Context, instance, state string, force bool) error {
@@ -488,11 +1286,17 @@ func (l *Incus) setState(ctx context.Context, instance, state string, force bool
 
 // Stop shuts down the instance.
 func (l *Incus) Stop(ctx context.Context, instance string, force bool) error {
+	if err := l.verifyOwnership(ctx, instance); err != nil {
+		return err
+	}
 	return l.setState(ctx, instance, "stop", force)
 }
 
 // Start boots up an instance.
 func (l *Incus) Start(ctx context.Context, instance string) error {
+	if err := l.verifyOwnership(ctx, instance); err != nil {
+		return err
+	}
 	return l.setState(ctx, instance, "start", false)
 }
 
@@ -500,3 +1304,39 @@ func (l *Incus) Start(ctx context.Context, instance string) error {
 func (l *Incus) GetVersion(ctx context.Context) string {
 	return Version
 }
+
+// GetSupportedInterfaceVersions returns the supported interface versions for the current provider.
+func (l *Incus) GetSupportedInterfaceVersions(ctx context.Context) []string {
+	return []string{
+		commonExecution.Version010,
+		commonExecution.Version011,
+	}
+}
+
+// ValidatePoolInfo validates the pool info for the current provider. The image,
+// flavor and extra specs are checked against the Incus server, and all problems
+// are reported at once.
+func (l *Incus) ValidatePoolInfo(ctx context.Context, image string, flavor string, providerConfig string, extraspecs string) error {
+	if err := l.validatePool(ctx, image, flavor, extraspecs); err != nil {
+		return errors.Wrap(err, "validating pool")
+	}
+	return nil
+}
+
+// GetConfigJSONSchema returns the JSON schema for the provider's configuration.
+func (l *Incus) GetConfigJSONSchema(ctx context.Context) (string, error) {
+	schema, err := json.Marshal(config.GenerateJSONSchema())
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling config schema")
+	}
+	return string(schema), nil
+}
+
+// GetExtraSpecsJSONSchema returns the JSON schema for the provider's extra specs.
+func (l *Incus) GetExtraSpecsJSONSchema(ctx context.Context) (string, error) {
+	schema, err := json.Marshal(generateJSONSchema())
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling extra specs schema")
+	}
+	return string(schema), nil
+}
@@ -17,10 +17,19 @@ package provider
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
 	commonParams "github.com/cloudbase/garm-provider-common/params"
 	"github.com/cloudbase/garm-provider-incus/config"
+	incus "github.com/lxc/incus/client"
 	"github.com/lxc/incus/shared/api"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -49,6 +58,215 @@ func TestGetCLI(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestReconcileProject(t *testing.T) {
+	cfg := &config.Incus{
+		ProjectName:   "runners",
+		ManageProject: true,
+		Project: config.ManagedProject{
+			// Images and profiles are isolated by default.
+			Features: config.ProjectFeatures{
+				StorageVolumes: true,
+			},
+			Limits: config.ProjectLimits{
+				Instances: 20,
+				Memory:    "64GiB",
+			},
+		},
+	}
+	l := &Incus{
+		cfg:          cfg,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+	expectedConfig := map[string]string{
+		"features.images":          "true",
+		"features.profiles":        "true",
+		"features.networks":        "false",
+		"features.storage.volumes": "true",
+		"limits.instances":         "20",
+		"limits.memory":            "64GiB",
+	}
+
+	t.Run("project is created if missing", func(t *testing.T) {
+		cli := new(MockIncusServer)
+		cli.On("GetProject", "runners").Return((*api.Project)(nil), "", api.StatusErrorf(http.StatusNotFound, "Project not found"))
+		cli.On("CreateProject", api.ProjectsPost{
+			Name: "runners",
+			ProjectPut: api.ProjectPut{
+				Description: DefaultProjectDescription,
+				Config:      expectedConfig,
+			},
+		}).Return(nil)
+
+		err := l.reconcileProject(cli)
+		require.NoError(t, err)
+		cli.AssertExpectations(t)
+	})
+
+	t.Run("drift is reconciled", func(t *testing.T) {
+		cli := new(MockIncusServer)
+		cli.On("GetProject", "runners").Return(&api.Project{
+			Name: "runners",
+			ProjectPut: api.ProjectPut{
+				Description: "my runners",
+				Config: map[string]string{
+					"features.images":          "true",
+					"features.profiles":        "true",
+					"features.networks":        "false",
+					"features.storage.volumes": "true",
+					"limits.instances":         "10",
+					"limits.cpu":               "8",
+					"limits.memory":            "64GiB",
+					"restricted":               "true",
+				},
+			},
+		}, "etag", nil)
+		cli.On("UpdateProject", "runners", api.ProjectPut{
+			Description: "my runners",
+			Config: map[string]string{
+				"features.images":          "true",
+				"features.profiles":        "true",
+				"features.networks":        "false",
+				"features.storage.volumes": "true",
+				"limits.instances":         "20",
+				"limits.memory":            "64GiB",
+				"restricted":               "true",
+			},
+		}, "etag").Return(nil)
+
+		err := l.reconcileProject(cli)
+		require.NoError(t, err)
+		cli.AssertExpectations(t)
+	})
+
+	t.Run("features of existing projects are left alone", func(t *testing.T) {
+		cli := new(MockIncusServer)
+		cli.On("GetProject", "runners").Return(&api.Project{
+			Name: "runners",
+			ProjectPut: api.ProjectPut{
+				Config: map[string]string{
+					"features.images":   "false",
+					"features.profiles": "false",
+					"limits.instances":  "10",
+					"limits.memory":     "64GiB",
+				},
+			},
+		}, "etag", nil)
+		cli.On("UpdateProject", "runners", api.ProjectPut{
+			Config: map[string]string{
+				"features.images":   "false",
+				"features.profiles": "false",
+				"limits.instances":  "20",
+				"limits.memory":     "64GiB",
+			},
+		}, "etag").Return(nil)
+
+		err := l.reconcileProject(cli)
+		require.NoError(t, err)
+		cli.AssertExpectations(t)
+	})
+
+	t.Run("project is left alone if there is no drift", func(t *testing.T) {
+		cli := new(MockIncusServer)
+		cli.On("GetProject", "runners").Return(&api.Project{
+			Name: "runners",
+			ProjectPut: api.ProjectPut{
+				Config: expectedConfig,
+			},
+		}, "etag", nil)
+
+		err := l.reconcileProject(cli)
+		require.NoError(t, err)
+		cli.AssertNotCalled(t, "UpdateProject", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestEnsureFlavorProfile(t *testing.T) {
+	flavor := config.Flavor{
+		CPU:    2,
+		Memory: "4GiB",
+	}
+	l := &Incus{
+		cfg: &config.Incus{
+			Flavors: map[string]config.Flavor{
+				"small": flavor,
+			},
+		},
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+	desired := flavorToProfile(flavor)
+	desired.Config[managedFlavorKeyName] = "small"
+
+	t.Run("flavor not defined in config", func(t *testing.T) {
+		cli := new(MockIncusServer)
+		err := l.ensureFlavorProfile(cli, "handmade")
+		require.NoError(t, err)
+		cli.AssertNotCalled(t, "GetProfile", mock.Anything)
+	})
+
+	t.Run("profile is created if missing", func(t *testing.T) {
+		cli := new(MockIncusServer)
+		cli.On("GetProfile", "small").Return((*api.Profile)(nil), "", api.StatusErrorf(http.StatusNotFound, "Profile not found"))
+		cli.On("CreateProfile", api.ProfilesPost{
+			Name:       "small",
+			ProfilePut: desired,
+		}).Return(nil)
+
+		err := l.ensureFlavorProfile(cli, "small")
+		require.NoError(t, err)
+		cli.AssertExpectations(t)
+	})
+
+	t.Run("profile is updated on drift", func(t *testing.T) {
+		cli := new(MockIncusServer)
+		cli.On("GetProfile", "small").Return(&api.Profile{
+			Name: "small",
+			ProfilePut: api.ProfilePut{
+				Description: desired.Description,
+				Config: map[string]string{
+					"limits.cpu":         "1",
+					managedFlavorKeyName: "small",
+				},
+			},
+		}, "etag", nil)
+		cli.On("UpdateProfile", "small", desired, "etag").Return(nil)
+
+		err := l.ensureFlavorProfile(cli, "small")
+		require.NoError(t, err)
+		cli.AssertExpectations(t)
+	})
+
+	t.Run("profile not created by the provider is left alone", func(t *testing.T) {
+		cli := new(MockIncusServer)
+		cli.On("GetProfile", "small").Return(&api.Profile{
+			Name: "small",
+			ProfilePut: api.ProfilePut{
+				Config: map[string]string{
+					"limits.cpu": "1",
+				},
+			},
+		}, "etag", nil)
+
+		err := l.ensureFlavorProfile(cli, "small")
+		require.ErrorContains(t, err, "profile small was not created for flavor small, refusing to update it")
+		require.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+		cli.AssertNotCalled(t, "UpdateProfile", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("profile is left alone if there is no drift", func(t *testing.T) {
+		cli := new(MockIncusServer)
+		cli.On("GetProfile", "small").Return(&api.Profile{
+			Name:       "small",
+			ProfilePut: desired,
+		}, "etag", nil)
+
+		err := l.ensureFlavorProfile(cli, "small")
+		require.NoError(t, err)
+		cli.AssertNotCalled(t, "UpdateProfile", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
 func TestGetProfiles(t *testing.T) {
 	ctx := context.Background()
 	cli := new(MockIncusServer)
@@ -77,6 +295,36 @@ func TestGetProfiles(t *testing.T) {
 	require.Equal(t, expected, profiles)
 }
 
+func TestEnsureProfiles(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg: &config.Incus{
+			Flavors: map[string]config.Flavor{
+				"small": {CPU: 2},
+			},
+		},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+
+	// The profile of a flavor defined in the config is not looked up, as it is
+	// created along with the first instance of the flavor.
+	profiles, err := l.getProfiles(ctx, "small")
+	require.NoError(t, err)
+	require.Equal(t, []string{"small"}, profiles)
+	cli.AssertNotCalled(t, "GetProfileNames")
+	cli.AssertNotCalled(t, "GetProfile", mock.Anything)
+
+	cli.On("GetProfile", "small").Return((*api.Profile)(nil), "", api.StatusErrorf(http.StatusNotFound, "Profile not found"))
+	cli.On("CreateProfile", mock.Anything).Return(nil)
+	profiles, err = l.ensureProfiles(ctx, "small")
+	require.NoError(t, err)
+	require.Equal(t, []string{"small"}, profiles)
+	cli.AssertExpectations(t)
+}
+
 func TestGetCreateInstanceArgsContainer(t *testing.T) {
 	ctx := context.Background()
 	cli := new(MockIncusServer)
@@ -184,11 +432,12 @@ func TestGetCreateInstanceArgsContainer(t *testing.T) {
 					Profiles:     []string{"default", "container"},
 					Description:  "Github runner provisioned by garm",
 					Config: map[string]string{
-						"user.user-data":    `#cloud-config`,
-						osTypeKeyName:       "linux",
-						osArchKeyNAme:       "amd64",
-						controllerIDKeyName: "controller",
-						poolIDKey:           "default",
+						"user.user-data":        `#cloud-config`,
+						imageFingerprintKeyName: "123abc",
+						osTypeKeyName:           "linux",
+						osArchKeyNAme:           "amd64",
+						controllerIDKeyName:     "controller",
+						poolIDKey:               "default",
 					},
 				},
 				Source: api.InstanceSource{
@@ -291,12 +540,13 @@ func TestGetCreateInstanceArgsVM(t *testing.T) {
 					Profiles:     []string{"default", "virtual-machine"},
 					Description:  "Github runner provisioned by garm",
 					Config: map[string]string{
-						"user.user-data":      "#ps1_sysnative\n" + "#cloud-config",
-						osTypeKeyName:         "windows",
-						osArchKeyNAme:         "amd64",
-						controllerIDKeyName:   "controller",
-						poolIDKey:             "default",
-						"security.secureboot": "false",
+						"user.user-data":        "#ps1_sysnative\n" + "#cloud-config",
+						imageFingerprintKeyName: "123abc",
+						osTypeKeyName:           "windows",
+						osArchKeyNAme:           "amd64",
+						controllerIDKeyName:     "controller",
+						poolIDKey:               "default",
+						"security.secureboot":   "false",
 					},
 				},
 				Source: api.InstanceSource{
@@ -323,6 +573,225 @@ func TestGetCreateInstanceArgsVM(t *testing.T) {
 	}
 }
 
+func TestGetCreateInstanceArgsInstanceTypeOverride(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+
+	cfg := &config.Incus{
+		UnixSocket:   "/var/run/incus.sock",
+		InstanceType: "container",
+	}
+	l := &Incus{
+		cfg:          cfg,
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+	tools := []commonParams.RunnerApplicationDownload{
+		{
+			OS:           ptr("linux"),
+			Architecture: ptr("x86_64"),
+			DownloadURL:  ptr("https://example.com"),
+			Filename:     ptr("test-app"),
+		},
+	}
+	aliases := map[string]*api.ImageAliasesEntry{
+		"x86_64": {
+			Name: "ubuntu",
+			Type: "virtual-machine",
+		},
+	}
+	DefaultToolFetch = func(_ commonParams.OSType, _ commonParams.OSArch, tools []commonParams.RunnerApplicationDownload) (commonParams.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+	DefaultGetCloudconfig = func(_ commonParams.BootstrapInstance, _ commonParams.RunnerApplicationDownload, _ string) (string, error) {
+		return "#cloud-config", nil
+	}
+
+	cli.On("GetImageAliasArchitectures", config.IncusImageVirtualMachine.String(), "ubuntu").Return(aliases, nil)
+	cli.On("GetImage", aliases["x86_64"].Target).Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	cli.On("GetProfileNames").Return([]string{"default", "large"}, nil)
+	specs := extraSpecs{
+		InstanceType: config.IncusImageVirtualMachine,
+	}
+	bootstrapParams := commonParams.BootstrapInstance{
+		Name:    "test-instance",
+		Tools:   tools,
+		Image:   "ubuntu",
+		Flavor:  "large",
+		RepoURL: "mock-repo-url",
+		PoolID:  "default",
+		OSArch:  commonParams.Amd64,
+		OSType:  commonParams.Linux,
+	}
+
+	ret, err := l.getCreateInstanceArgs(ctx, bootstrapParams, specs)
+	require.NoError(t, err)
+	assert.Equal(t, api.InstanceType("virtual-machine"), ret.Type)
+	assert.Equal(t, "false", ret.Config["security.secureboot"])
+	cli.AssertExpectations(t)
+}
+
+func TestCloudInitConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      *config.Incus
+		specs    extraSpecs
+		expected map[string]string
+	}{
+		{
+			name: "legacy keys",
+			cfg:  &config.Incus{},
+			expected: map[string]string{
+				"user.user-data": "#cloud-config",
+			},
+		},
+		{
+			name: "cloud-init keys with vendor data and network config",
+			cfg: &config.Incus{
+				UseCloudInitKeys: true,
+				VendorData:       "#cloud-config\nntp:\n  servers: [ntp.example.com]",
+				NetworkConfig:    "version: 2",
+			},
+			expected: map[string]string{
+				"cloud-init.user-data":      "#cloud-config",
+				"cloud-init.vendor-data":    "#cloud-config\nntp:\n  servers: [ntp.example.com]",
+				"cloud-init.network-config": "version: 2",
+			},
+		},
+		{
+			name: "extra specs override provider config",
+			cfg: &config.Incus{
+				UseCloudInitKeys: true,
+				VendorData:       "#cloud-config\nntp:\n  servers: [ntp.example.com]",
+				NetworkConfig:    "version: 2",
+			},
+			specs: extraSpecs{
+				UseCloudInitKeys: ptr(false),
+				VendorData:       "#cloud-config\npackages: [jq]",
+			},
+			expected: map[string]string{
+				"user.user-data":      "#cloud-config",
+				"user.vendor-data":    "#cloud-config\npackages: [jq]",
+				"user.network-config": "version: 2",
+			},
+		},
+		{
+			name: "extra specs enable cloud-init keys",
+			cfg:  &config.Incus{},
+			specs: extraSpecs{
+				UseCloudInitKeys: ptr(true),
+				NetworkConfig:    "version: 2",
+			},
+			expected: map[string]string{
+				"cloud-init.user-data":      "#cloud-config",
+				"cloud-init.network-config": "version: 2",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &Incus{cfg: tt.cfg}
+			assert.Equal(t, tt.expected, l.cloudInitConfig("#cloud-config", tt.specs))
+		})
+	}
+}
+
+func TestGetRootDiskDevice(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg:          &config.Incus{},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+	cli.On("GetProfile", "default").Return(&api.Profile{
+		ProfilePut: api.ProfilePut{
+			Devices: map[string]map[string]string{
+				"root": {
+					"type": "disk",
+					"path": "/",
+					"pool": "default",
+				},
+			},
+		},
+	}, "", nil)
+	cli.On("GetProfile", "large").Return(&api.Profile{
+		ProfilePut: api.ProfilePut{
+			Devices: map[string]map[string]string{
+				"rootfs": {
+					"type": "disk",
+					"path": "/",
+					"pool": "fast",
+					"size": "10GiB",
+				},
+			},
+		},
+	}, "", nil)
+	cli.On("GetProfile", "nodisk").Return(&api.Profile{}, "", nil)
+
+	tests := []struct {
+		name         string
+		profiles     []string
+		specs        extraSpecs
+		expectedName string
+		expected     map[string]string
+		errString    string
+	}{
+		{
+			name:     "no overrides",
+			profiles: []string{"default", "large"},
+			specs:    extraSpecs{},
+		},
+		{
+			name:         "size override uses the last profile",
+			profiles:     []string{"default", "large"},
+			specs:        extraSpecs{RootDiskSize: "20GiB"},
+			expectedName: "rootfs",
+			expected: map[string]string{
+				"type": "disk",
+				"path": "/",
+				"pool": "fast",
+				"size": "20GiB",
+			},
+		},
+		{
+			name:         "pool override",
+			profiles:     []string{"nodisk"},
+			specs:        extraSpecs{RootDiskSize: "20GiB", RootDiskPool: "slow"},
+			expectedName: "root",
+			expected: map[string]string{
+				"type": "disk",
+				"path": "/",
+				"pool": "slow",
+				"size": "20GiB",
+			},
+		},
+		{
+			name:      "no root disk in profiles",
+			profiles:  []string{"nodisk"},
+			specs:     extraSpecs{RootDiskSize: "20GiB"},
+			errString: "no root disk found in profiles [nodisk]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, device, err := l.getRootDiskDevice(ctx, tt.profiles, tt.specs)
+			if tt.errString != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedName, name)
+			assert.Equal(t, tt.expected, device)
+		})
+	}
+}
+
 func TestLaunchInstance(t *testing.T) {
 	ctx := context.Background()
 	cli := new(MockIncusServer)
@@ -382,6 +851,183 @@ func TestLaunchInstance(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestLaunchInstanceRollback(t *testing.T) {
+	ctx := context.Background()
+	createArgs := api.InstancesPost{
+		Name: "test-instance",
+		Type: "container",
+	}
+	startState := api.InstanceStatePut{
+		Action:  "start",
+		Timeout: -1,
+	}
+	stopState := api.InstanceStatePut{
+		Action:  "stop",
+		Timeout: -1,
+		Force:   true,
+	}
+
+	tests := []struct {
+		name        string
+		setup       func(cli *MockIncusServer)
+		rolledBack  bool
+		errContains string
+	}{
+		{
+			name: "create request fails",
+			setup: func(cli *MockIncusServer) {
+				cli.On("CreateInstance", createArgs).Return((*MockOperation)(nil), fmt.Errorf("instance already exists"))
+			},
+			errContains: "creating instance: instance already exists",
+		},
+		{
+			name: "create operation fails",
+			setup: func(cli *MockIncusServer) {
+				failedOp := new(MockOperation)
+				failedOp.On("Wait").Return(fmt.Errorf("unpacking image failed"))
+				cli.On("CreateInstance", createArgs).Return(failedOp, nil)
+			},
+			rolledBack:  true,
+			errContains: "waiting for instance creation: unpacking image failed",
+		},
+		{
+			name: "start fails",
+			setup: func(cli *MockIncusServer) {
+				createOp := new(MockOperation)
+				createOp.On("Wait").Return(nil)
+				failedOp := new(MockOperation)
+				failedOp.On("Wait").Return(fmt.Errorf("failed to start"))
+				cli.On("CreateInstance", createArgs).Return(createOp, nil)
+				cli.On("UpdateInstanceState", "test-instance", startState, "").Return(failedOp, nil)
+			},
+			rolledBack:  true,
+			errContains: "waiting for instance to start: failed to start",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := new(MockIncusServer)
+			l := &Incus{
+				cfg:          &config.Incus{},
+				cli:          cli,
+				controllerID: "controller",
+			}
+			tt.setup(cli)
+			if tt.rolledBack {
+				cli.On("GetInstance", "test-instance").Return(&api.Instance{
+					Name:           "test-instance",
+					ExpandedConfig: map[string]string{controllerIDKeyName: "controller"},
+				}, "", nil)
+				stopOp := new(MockOperation)
+				stopOp.On("WaitContext", mock.Anything).Return(nil)
+				cli.On("GetInstanceConsoleLog", "test-instance", mock.Anything).Return(io.NopCloser(strings.NewReader("kernel panic")), nil)
+				cli.On("GetInstanceFile", "test-instance", "/var/log/cloud-init-output.log").Return(nil, nil, fmt.Errorf("not found"))
+				cli.On("GetInstanceLogfiles", "test-instance").Return(nil, fmt.Errorf("not found"))
+				cli.On("UpdateInstanceState", "test-instance", stopState, "").Return(stopOp, nil)
+				cli.On("DeleteInstance", "test-instance").Return(stopOp, nil)
+			}
+
+			err := l.launchInstance(ctx, createArgs)
+			require.ErrorContains(t, err, tt.errContains)
+			if tt.rolledBack {
+				assert.ErrorContains(t, err, "==> console <==\nkernel panic\n")
+			}
+			cli.AssertExpectations(t)
+		})
+	}
+}
+
+func TestRollbackInstanceNotOwned(t *testing.T) {
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg:          &config.Incus{},
+		cli:          cli,
+		controllerID: "controller",
+	}
+	cli.On("GetInstance", "test-instance").Return(&api.Instance{
+		Name:           "test-instance",
+		ExpandedConfig: map[string]string{controllerIDKeyName: "other-controller"},
+	}, "", nil)
+
+	err := l.rollbackInstance(context.Background(), "test-instance", fmt.Errorf("instance already exists"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "instance already exists (not removing instance: instance test-instance is not managed by this controller")
+	cli.AssertNotCalled(t, "DeleteInstance", mock.Anything)
+	cli.AssertNotCalled(t, "GetInstanceConsoleLog", mock.Anything, mock.Anything)
+}
+
+func TestCreateInstanceRollbackOnIPTimeout(t *testing.T) {
+	defaultInterval := ipPollInterval
+	ipPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { ipPollInterval = defaultInterval })
+
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg: &config.Incus{
+			UnixSocket:    "/var/run/incus.sock",
+			InstanceType:  "container",
+			IPWaitTimeout: 1,
+		},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+	DefaultToolFetch = func(_ commonParams.OSType, _ commonParams.OSArch, tools []commonParams.RunnerApplicationDownload) (commonParams.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+	DefaultGetCloudconfig = func(_ commonParams.BootstrapInstance, _ commonParams.RunnerApplicationDownload, _ string) (string, error) {
+		return "#cloud-config", nil
+	}
+	aliases := map[string]*api.ImageAliasesEntry{
+		"x86_64": {ImageAliasesEntryPut: api.ImageAliasesEntryPut{Target: "123abc"}},
+	}
+	mockOp := new(MockOperation)
+	mockOp.On("Wait").Return(nil)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+	cli.On("GetImageAliasArchitectures", "container", "ubuntu").Return(aliases, nil)
+	cli.On("GetImage", "123abc").Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	cli.On("GetProfileNames").Return([]string{"default"}, nil)
+	cli.On("CreateInstance", mock.Anything).Return(mockOp, nil)
+	cli.On("UpdateInstanceState", "test-instance", api.InstanceStatePut{Action: "start", Timeout: -1}, "").Return(mockOp, nil)
+	cli.On("GetEvents").Return(nil, fmt.Errorf("events not supported"))
+	cli.On("GetInstanceFull", "test-instance").Return(&api.InstanceFull{
+		Instance: api.Instance{Name: "test-instance"},
+		State:    &api.InstanceState{Status: "Running"},
+	}, "", nil)
+	cli.On("GetInstance", "test-instance").Return(&api.Instance{
+		Name:           "test-instance",
+		ExpandedConfig: map[string]string{controllerIDKeyName: "controller"},
+	}, "", nil)
+	cli.On("GetInstanceConsoleLog", "test-instance", mock.Anything).Return(nil, fmt.Errorf("console log not available"))
+	cli.On("GetInstanceFile", "test-instance", "/var/log/cloud-init-output.log").Return(io.NopCloser(strings.NewReader("Cloud-init v. 23.1 finished")), &incus.InstanceFileResponse{}, nil)
+	cli.On("GetInstanceLogfiles", "test-instance").Return([]string{"console.log", "lxc.conf", "lxc.log"}, nil)
+	cli.On("GetInstanceLogfile", "test-instance", "lxc.log").Return(io.NopCloser(strings.NewReader("lxc test-instance ERROR")), nil)
+	cli.On("UpdateInstanceState", "test-instance", api.InstanceStatePut{Action: "stop", Timeout: -1, Force: true}, "").Return(mockOp, nil)
+	cli.On("DeleteInstance", "test-instance").Return(mockOp, nil)
+
+	ret, err := l.CreateInstance(ctx, commonParams.BootstrapInstance{
+		Name:   "test-instance",
+		Image:  "ubuntu",
+		Flavor: "default",
+		OSArch: commonParams.Amd64,
+		OSType: commonParams.Linux,
+		Tools: []commonParams.RunnerApplicationDownload{
+			{
+				OS:           ptr("linux"),
+				Architecture: ptr("x64"),
+				DownloadURL:  ptr("https://example.com"),
+				Filename:     ptr("test-app"),
+			},
+		},
+	})
+	require.ErrorIs(t, err, runnerErrors.ErrTimeout)
+	assert.Equal(t, commonParams.ProviderInstance{}, ret)
+	assert.ErrorContains(t, err, "==> /var/log/cloud-init-output.log <==\nCloud-init v. 23.1 finished\n==> lxc.log <==\nlxc test-instance ERROR\n")
+	cli.AssertCalled(t, "DeleteInstance", "test-instance")
+}
+
 func TestCreateInstance(t *testing.T) {
 	ctx := context.Background()
 	cli := new(MockIncusServer)
@@ -482,10 +1128,225 @@ func TestCreateInstance(t *testing.T) {
 			},
 		},
 	}, "", nil)
+	cli.On("GetEvents").Return(nil, fmt.Errorf("events not supported"))
 
 	ret, err := l.CreateInstance(ctx, boostrapParams)
 	require.NoError(t, err)
 	assert.Equal(t, expectedOutput, ret)
+	// The user data is only removed once cloud-init is done with it.
+	cli.AssertNotCalled(t, "UpdateInstance", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestScrubFinishedUserData(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name         string
+		config       map[string]string
+		osType       string
+		keepUserData bool
+		finished     bool
+		expectWrite  bool
+	}{
+		{
+			name:        "cloud-init finished",
+			config:      map[string]string{"user.user-data": "#cloud-config"},
+			osType:      "linux",
+			finished:    true,
+			expectWrite: true,
+		},
+		{
+			name:   "cloud-init still running",
+			config: map[string]string{"user.user-data": "#cloud-config"},
+			osType: "linux",
+		},
+		{
+			name:     "windows instance",
+			config:   map[string]string{"user.user-data": "#ps1_sysnative"},
+			osType:   "windows",
+			finished: true,
+		},
+		{
+			name:         "user data is kept",
+			config:       map[string]string{"user.user-data": "#cloud-config"},
+			osType:       "linux",
+			keepUserData: true,
+			finished:     true,
+		},
+		{
+			name:     "user data already removed",
+			config:   map[string]string{"user.user-data": ""},
+			osType:   "linux",
+			finished: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := new(MockIncusServer)
+			l := &Incus{
+				cfg: &config.Incus{KeepUserData: tt.keepUserData},
+				cli: cli,
+			}
+			instance := &api.InstanceFull{
+				Instance: api.Instance{
+					Name: "test-instance",
+					InstancePut: api.InstancePut{
+						Config: maps.Clone(tt.config),
+					},
+					ExpandedConfig: map[string]string{osTypeKeyName: tt.osType},
+				},
+				State: &api.InstanceState{Status: "Running"},
+			}
+			if tt.finished {
+				cli.On("GetInstanceFile", "test-instance", cloudInitBootFinishedPath).Return(io.NopCloser(strings.NewReader("")), &incus.InstanceFileResponse{}, nil)
+			} else {
+				cli.On("GetInstanceFile", "test-instance", cloudInitBootFinishedPath).Return(nil, nil, fmt.Errorf("not found"))
+			}
+			cli.On("GetInstance", "test-instance").Return(&instance.Instance, "etag", nil)
+			mockOp := new(MockOperation)
+			mockOp.On("Wait").Return(nil)
+			cli.On("UpdateInstance", "test-instance", mock.Anything, "etag").Return(mockOp, nil)
+
+			l.scrubFinishedUserData(ctx, instance)
+			if !tt.expectWrite {
+				cli.AssertNotCalled(t, "UpdateInstance", mock.Anything, mock.Anything, mock.Anything)
+				return
+			}
+			cli.AssertCalled(t, "UpdateInstance", "test-instance", api.InstancePut{Config: map[string]string{}}, "etag")
+		})
+	}
+}
+
+func TestScrubUserData(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name        string
+		config      map[string]string
+		updateErr   error
+		expectWrite bool
+		errContains string
+	}{
+		{
+			name: "user data is removed",
+			config: map[string]string{
+				"user.user-data":    "#cloud-config",
+				controllerIDKeyName: "controller",
+			},
+			expectWrite: true,
+		},
+		{
+			name: "nothing to remove",
+			config: map[string]string{
+				controllerIDKeyName: "controller",
+			},
+		},
+		{
+			name: "update fails",
+			config: map[string]string{
+				"user.user-data": "#cloud-config",
+			},
+			updateErr:   fmt.Errorf("permission denied"),
+			expectWrite: true,
+			errContains: "removing user data: permission denied",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := new(MockIncusServer)
+			l := &Incus{
+				cfg: &config.Incus{},
+				cli: cli,
+			}
+			cli.On("GetInstance", "test-instance").Return(&api.Instance{
+				Name: "test-instance",
+				InstancePut: api.InstancePut{
+					Config: maps.Clone(tt.config),
+				},
+			}, "etag", nil)
+			mockOp := new(MockOperation)
+			mockOp.On("Wait").Return(nil)
+			cli.On("UpdateInstance", "test-instance", mock.Anything, "etag").Return(mockOp, tt.updateErr)
+
+			err := l.scrubUserData(ctx, "test-instance")
+			if tt.errContains != "" {
+				require.ErrorContains(t, err, tt.errContains)
+			} else {
+				require.NoError(t, err)
+			}
+
+			if !tt.expectWrite {
+				cli.AssertNotCalled(t, "UpdateInstance", mock.Anything, mock.Anything, mock.Anything)
+				return
+			}
+			expected := maps.Clone(tt.config)
+			delete(expected, "user.user-data")
+			cli.AssertCalled(t, "UpdateInstance", "test-instance", api.InstancePut{Config: expected}, "etag")
+		})
+	}
+}
+
+func TestRecordImageFingerprint(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name        string
+		config      map[string]string
+		expectWrite bool
+	}{
+		{
+			name: "fingerprint is recorded",
+			config: map[string]string{
+				baseImageKeyName:    "4a3f5b2c1d0e9f8a",
+				controllerIDKeyName: "controller",
+			},
+			expectWrite: true,
+		},
+		{
+			name: "fingerprint inherited from a golden instance is replaced",
+			config: map[string]string{
+				baseImageKeyName:        "4a3f5b2c1d0e9f8a",
+				imageFingerprintKeyName: "0000000000000000",
+			},
+			expectWrite: true,
+		},
+		{
+			name: "fingerprint already recorded",
+			config: map[string]string{
+				baseImageKeyName:        "4a3f5b2c1d0e9f8a",
+				imageFingerprintKeyName: "4a3f5b2c1d0e9f8a",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := new(MockIncusServer)
+			l := &Incus{
+				cfg: &config.Incus{},
+				cli: cli,
+			}
+			cli.On("GetInstance", "test-instance").Return(&api.Instance{
+				Name: "test-instance",
+				InstancePut: api.InstancePut{
+					Config: maps.Clone(tt.config),
+				},
+			}, "etag", nil)
+			mockOp := new(MockOperation)
+			mockOp.On("Wait").Return(nil)
+			cli.On("UpdateInstance", "test-instance", mock.Anything, "etag").Return(mockOp, nil)
+
+			err := l.recordImageFingerprint(ctx, "test-instance")
+			require.NoError(t, err)
+
+			if !tt.expectWrite {
+				cli.AssertNotCalled(t, "UpdateInstance", mock.Anything, mock.Anything, mock.Anything)
+				return
+			}
+			expected := maps.Clone(tt.config)
+			expected[imageFingerprintKeyName] = "4a3f5b2c1d0e9f8a"
+			cli.AssertCalled(t, "UpdateInstance", "test-instance", api.InstancePut{Config: expected}, "etag")
+		})
+	}
 }
 
 func TestGetInstance(t *testing.T) {
@@ -516,8 +1377,10 @@ func TestGetInstance(t *testing.T) {
 			},
 			Name: "test-instance",
 			ExpandedConfig: map[string]string{
-				"image.os":      "windows",
-				"image.release": "",
+				"image.os":              "windows",
+				"image.release":         "",
+				controllerIDKeyName:     "controller",
+				imageFingerprintKeyName: "4a3f5b2c1d0e9f8a7b6c5d4e3f2a1b0c",
 			},
 			Type: "container",
 		},
@@ -577,6 +1440,12 @@ func TestDeleteInstance(t *testing.T) {
 		},
 		controllerID: "controller",
 	}
+	cli.On("GetInstance", instanceName).Return(&api.Instance{
+		Name: instanceName,
+		ExpandedConfig: map[string]string{
+			controllerIDKeyName: "controller",
+		},
+	}, "", nil)
 	mockOp := new(MockOperation)
 	mockOp.On("WaitContext", mock.Anything).Return(nil)
 	cli.On("DeleteInstance", "test-instance").Return(mockOp, nil)
@@ -617,6 +1486,7 @@ func TestListInstances(t *testing.T) {
 	DefaultGetCloudconfig = func(_ commonParams.BootstrapInstance, _ commonParams.RunnerApplicationDownload, _ string) (string, error) {
 		return "#cloud-config", nil
 	}
+	cli.On("HasExtension", "api_filtering").Return(false)
 	cli.On("GetInstancesFull", api.InstanceTypeAny).Return([]api.InstanceFull{
 		{
 			Instance: api.Instance{
@@ -670,6 +1540,135 @@ func TestListInstances(t *testing.T) {
 	assert.Equal(t, expectedOutput, ret)
 }
 
+func TestListInstancesServerSideFilter(t *testing.T) {
+	ctx := context.Background()
+	instance := api.InstanceFull{
+		Instance: api.Instance{
+			Name: "test-instance",
+			ExpandedConfig: map[string]string{
+				controllerIDKeyName: "controller",
+				poolIDKey:           "test-pool-id",
+				osTypeKeyName:       "linux",
+			},
+		},
+		State: &api.InstanceState{
+			Status: "Running",
+		},
+	}
+
+	tests := []struct {
+		name    string
+		poolID  string
+		filters []string
+	}{
+		{
+			name:   "pool instances",
+			poolID: "test-pool-id",
+			filters: []string{
+				"config.user.runner-controller-id=controller",
+				"config.user.runner-pool-id=test-pool-id",
+			},
+		},
+		{
+			name:   "all controller instances",
+			poolID: "",
+			filters: []string{
+				"config.user.runner-controller-id=controller",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := new(MockIncusServer)
+			l := &Incus{
+				cfg:          &config.Incus{},
+				cli:          cli,
+				controllerID: "controller",
+			}
+			cli.On("HasExtension", "api_filtering").Return(true)
+			cli.On("GetInstancesFullWithFilter", api.InstanceTypeAny, tt.filters).Return([]api.InstanceFull{instance}, nil)
+
+			instances, err := l.ListInstances(ctx, tt.poolID)
+			require.NoError(t, err)
+			require.Len(t, instances, 1)
+			assert.Equal(t, "test-instance", instances[0].Name)
+			cli.AssertExpectations(t)
+			cli.AssertNotCalled(t, "GetInstancesFull", mock.Anything)
+		})
+	}
+}
+
+func TestListInstancesScrubsUserData(t *testing.T) {
+	ctx := context.Background()
+	newInstance := func(name string, config map[string]string) api.InstanceFull {
+		return api.InstanceFull{
+			Instance: api.Instance{
+				Name: name,
+				InstancePut: api.InstancePut{
+					Config: config,
+				},
+				ExpandedConfig: map[string]string{
+					controllerIDKeyName: "controller",
+					poolIDKey:           "test-pool-id",
+					osTypeKeyName:       "linux",
+				},
+			},
+			State: &api.InstanceState{Status: "Running"},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		poolID      string
+		expectWrite bool
+	}{
+		{
+			name:        "pool instances",
+			poolID:      "test-pool-id",
+			expectWrite: true,
+		},
+		{
+			// RemoveAllInstances lists the instances of all pools, which are about
+			// to be removed anyway.
+			name:   "all controller instances",
+			poolID: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			booting := newInstance("booting", map[string]string{userDataKeyName: "#cloud-config"})
+			scrubbed := newInstance("scrubbed", map[string]string{userDataKeyName: ""})
+			cli := new(MockIncusServer)
+			l := &Incus{
+				cfg:          &config.Incus{},
+				cli:          cli,
+				controllerID: "controller",
+			}
+			cli.On("HasExtension", "api_filtering").Return(false)
+			cli.On("GetInstancesFull", api.InstanceTypeAny).Return([]api.InstanceFull{booting, scrubbed}, nil)
+			cli.On("GetInstanceFile", "booting", cloudInitBootFinishedPath).Return(io.NopCloser(strings.NewReader("")), &incus.InstanceFileResponse{}, nil)
+			cli.On("GetInstance", "booting").Return(&booting.Instance, "etag", nil)
+			mockOp := new(MockOperation)
+			mockOp.On("Wait").Return(nil)
+			cli.On("UpdateInstance", "booting", mock.Anything, "etag").Return(mockOp, nil)
+
+			instances, err := l.ListInstances(ctx, tt.poolID)
+			require.NoError(t, err)
+			require.Len(t, instances, 2)
+			// Only instances that still hold user data are checked.
+			cli.AssertNotCalled(t, "GetInstanceFile", "scrubbed", mock.Anything)
+			if !tt.expectWrite {
+				cli.AssertNotCalled(t, "GetInstanceFile", mock.Anything, mock.Anything)
+				cli.AssertNotCalled(t, "UpdateInstance", mock.Anything, mock.Anything, mock.Anything)
+				return
+			}
+			cli.AssertCalled(t, "UpdateInstance", "booting", api.InstancePut{Config: map[string]string{}}, "etag")
+		})
+	}
+}
+
 func TestRemoveAllInstances(t *testing.T) {
 	ctx := context.Background()
 	cli := new(MockIncusServer)
@@ -698,6 +1697,7 @@ func TestRemoveAllInstances(t *testing.T) {
 	DefaultGetCloudconfig = func(_ commonParams.BootstrapInstance, _ commonParams.RunnerApplicationDownload, _ string) (string, error) {
 		return "#cloud-config", nil
 	}
+	cli.On("HasExtension", "api_filtering").Return(false)
 	cli.On("GetInstancesFull", api.InstanceTypeAny).Return([]api.InstanceFull{
 		{
 			Instance: api.Instance{
@@ -731,6 +1731,64 @@ func TestRemoveAllInstances(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestRemoveAllInstancesParallel(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg: &config.Incus{
+			RemoveConcurrency: 3,
+		},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+
+	instances := []api.InstanceFull{}
+	for i := 0; i < 20; i++ {
+		instances = append(instances, api.InstanceFull{
+			Instance: api.Instance{
+				Name: fmt.Sprintf("runner-%02d", i),
+				ExpandedConfig: map[string]string{
+					controllerIDKeyName: "controller",
+				},
+			},
+			State: &api.InstanceState{
+				Status: "Running",
+			},
+		})
+	}
+	cli.On("HasExtension", "api_filtering").Return(false)
+	cli.On("GetInstancesFull", api.InstanceTypeAny).Return(instances, nil)
+
+	var running, maxRunning atomic.Int32
+	mockOp := new(MockOperation)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+	cli.On("UpdateInstanceState", mock.Anything, api.InstanceStatePut{
+		Action:  "stop",
+		Timeout: -1,
+		Force:   true,
+	}, "").Return(mockOp, nil).Run(func(mock.Arguments) {
+		current := running.Add(1)
+		for {
+			prev := maxRunning.Load()
+			if current <= prev || maxRunning.CompareAndSwap(prev, current) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		running.Add(-1)
+	})
+	cli.On("DeleteInstance", "runner-04").Return((*MockOperation)(nil), fmt.Errorf("storage pool is busy"))
+	cli.On("DeleteInstance", "runner-13").Return((*MockOperation)(nil), fmt.Errorf("instance is protected"))
+	cli.On("DeleteInstance", mock.Anything).Return(mockOp, nil)
+
+	err := l.RemoveAllInstances(ctx)
+	require.EqualError(t, err, "failed to remove 2 instances: runner-04: removing instance: storage pool is busy; runner-13: removing instance: instance is protected")
+	cli.AssertNumberOfCalls(t, "DeleteInstance", 20)
+	assert.LessOrEqual(t, maxRunning.Load(), int32(3))
+	assert.Greater(t, maxRunning.Load(), int32(1))
+}
+
 func TestStop(t *testing.T) {
 	ctx := context.Background()
 	cli := new(MockIncusServer)
@@ -742,6 +1800,12 @@ func TestStop(t *testing.T) {
 		imageManager: &image{},
 		controllerID: "controller",
 	}
+	cli.On("GetInstance", instanceName).Return(&api.Instance{
+		Name: instanceName,
+		ExpandedConfig: map[string]string{
+			controllerIDKeyName: "controller",
+		},
+	}, "", nil)
 	mockOp := new(MockOperation)
 	mockOp.On("WaitContext", mock.Anything).Return(nil)
 	cli.On("UpdateInstanceState", instanceName, api.InstanceStatePut{
@@ -763,6 +1827,12 @@ func TestStart(t *testing.T) {
 		imageManager: &image{},
 		controllerID: "controller",
 	}
+	cli.On("GetInstance", instanceName).Return(&api.Instance{
+		Name: instanceName,
+		ExpandedConfig: map[string]string{
+			controllerIDKeyName: "controller",
+		},
+	}, "", nil)
 	mockOp := new(MockOperation)
 	mockOp.On("WaitContext", mock.Anything).Return(nil)
 	cli.On("UpdateInstanceState", instanceName, api.InstanceStatePut{
@@ -773,3 +1843,187 @@ func TestStart(t *testing.T) {
 	err := l.Start(ctx, instanceName)
 	require.NoError(t, err)
 }
+
+func TestOwnershipVerification(t *testing.T) {
+	ctx := context.Background()
+	foreignConfigs := map[string]map[string]string{
+		"other controller": {
+			controllerIDKeyName: "other-controller",
+		},
+		"hand made instance": {},
+	}
+
+	for name, instanceConfig := range foreignConfigs {
+		t.Run(name, func(t *testing.T) {
+			cli := new(MockIncusServer)
+			l := &Incus{
+				cfg:          &config.Incus{},
+				cli:          cli,
+				controllerID: "controller",
+			}
+			cli.On("GetInstance", "test-instance").Return(&api.Instance{
+				Name:           "test-instance",
+				ExpandedConfig: instanceConfig,
+			}, "", nil)
+			cli.On("GetInstanceFull", "test-instance").Return(&api.InstanceFull{
+				Instance: api.Instance{
+					Name:           "test-instance",
+					ExpandedConfig: instanceConfig,
+				},
+				State: &api.InstanceState{Status: "Running"},
+			}, "", nil)
+
+			require.ErrorIs(t, l.DeleteInstance(ctx, "test-instance"), runnerErrors.ErrNotFound)
+			require.ErrorIs(t, l.Stop(ctx, "test-instance", true), runnerErrors.ErrNotFound)
+			require.ErrorIs(t, l.Start(ctx, "test-instance"), runnerErrors.ErrNotFound)
+			_, err := l.GetInstance(ctx, "test-instance")
+			require.ErrorIs(t, err, runnerErrors.ErrNotFound)
+
+			cli.AssertNotCalled(t, "UpdateInstanceState", mock.Anything, mock.Anything, mock.Anything)
+			cli.AssertNotCalled(t, "DeleteInstance", mock.Anything)
+		})
+	}
+}
+
+func TestSkipOwnershipCheck(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg: &config.Incus{
+			SkipOwnershipCheck: true,
+		},
+		cli:          cli,
+		controllerID: "controller",
+	}
+	cli.On("GetInstance", "test-instance").Return(&api.Instance{
+		Name: "test-instance",
+		ExpandedConfig: map[string]string{
+			controllerIDKeyName: "other-controller",
+		},
+	}, "", nil)
+	mockOp := new(MockOperation)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+	cli.On("UpdateInstanceState", "test-instance", api.InstanceStatePut{
+		Action:  "stop",
+		Timeout: -1,
+		Force:   true,
+	}, "").Return(mockOp, nil)
+	cli.On("DeleteInstance", "test-instance").Return(mockOp, nil)
+
+	require.NoError(t, l.DeleteInstance(ctx, "test-instance"))
+	cli.AssertCalled(t, "DeleteInstance", "test-instance")
+}
+
+func TestDeleteMissingInstance(t *testing.T) {
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg:          &config.Incus{},
+		cli:          cli,
+		controllerID: "controller",
+	}
+	cli.On("GetInstance", "test-instance").Return(nil, "", api.StatusErrorf(http.StatusNotFound, "Instance not found"))
+
+	require.NoError(t, l.DeleteInstance(context.Background(), "test-instance"))
+	cli.AssertNotCalled(t, "DeleteInstance", mock.Anything)
+}
+
+func TestGetSupportedInterfaceVersions(t *testing.T) {
+	ctx := context.Background()
+	l := &Incus{
+		cfg:          &config.Incus{},
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+	versions := l.GetSupportedInterfaceVersions(ctx)
+	assert.Equal(t, []string{"v0.1.0", "v0.1.1"}, versions)
+}
+
+func TestValidatePoolInfo(t *testing.T) {
+	ctx := context.Background()
+	l := &Incus{
+		cfg:          &config.Incus{},
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+	tests := []struct {
+		name       string
+		extraSpecs string
+		errString  string
+	}{
+		{
+			name:       "empty extra specs",
+			extraSpecs: "",
+		},
+		{
+			name:       "valid extra specs",
+			extraSpecs: `{"disable_updates": true}`,
+		},
+		{
+			name:       "invalid extra specs",
+			extraSpecs: `{"disable_updates": "true"}`,
+			errString:  "extra_specs: failed to validate extra specs",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := l.ValidatePoolInfo(ctx, "", "", "", tt.extraSpecs)
+			if tt.errString != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errString)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestGetJSONSchemas(t *testing.T) {
+	ctx := context.Background()
+	l := &Incus{
+		cfg:          &config.Incus{},
+		imageManager: &image{},
+		controllerID: "controller",
+	}
+
+	extraSpecsSchema, err := l.GetExtraSpecsJSONSchema(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, extraSpecsSchema, `"disable_updates"`)
+
+	configSchema, err := l.GetConfigJSONSchema(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, configSchema, `"unix_socket_path"`)
+	assert.Contains(t, configSchema, `"image_remotes"`)
+}
+
+func TestGetCreateInstanceArgsProcessesVirtualMachine(t *testing.T) {
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg: &config.Incus{
+			UnixSocket: "/var/run/incus.sock",
+		},
+		cli:          cli,
+		imageManager: &image{},
+	}
+	aliases := map[string]*api.ImageAliasesEntry{
+		"x86_64": {
+			Name: "ubuntu",
+			Type: "virtual-machine",
+		},
+	}
+	cli.On("GetImageAliasArchitectures", config.IncusImageVirtualMachine.String(), "ubuntu").Return(aliases, nil)
+	cli.On("GetImage", aliases["x86_64"].Target).Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	cli.On("GetProfileNames").Return([]string{"default"}, nil)
+
+	// The instance type comes from the provider config, so the extra specs can
+	// not be checked on their own.
+	_, err := l.getCreateInstanceArgs(context.Background(), commonParams.BootstrapInstance{
+		Name:   "test-instance",
+		Image:  "ubuntu",
+		Flavor: "default",
+		OSArch: commonParams.Amd64,
+		OSType: commonParams.Linux,
+	}, extraSpecs{Processes: 500})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "processes can only be used with container instances")
+}
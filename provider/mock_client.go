@@ -16,6 +16,8 @@
 package provider
 
 import (
+	"io"
+
 	incus "github.com/lxc/incus/client"
 	"github.com/lxc/incus/shared/api"
 	"github.com/stretchr/testify/mock"
@@ -30,6 +32,16 @@ func (m *MockIncusServer) GetProject(name string) (project *api.Project, ETag st
 	return args.Get(0).(*api.Project), args.String(1), args.Error(2)
 }
 
+func (m *MockIncusServer) CreateProject(project api.ProjectsPost) (err error) {
+	args := m.Called(project)
+	return args.Error(0)
+}
+
+func (m *MockIncusServer) UpdateProject(name string, project api.ProjectPut, ETag string) (err error) {
+	args := m.Called(name, project, ETag)
+	return args.Error(0)
+}
+
 func (m *MockIncusServer) UseProject(name string) (client incus.InstanceServer) {
 	args := m.Called(name)
 	return args.Get(0).(incus.InstanceServer)
@@ -40,6 +52,21 @@ func (m *MockIncusServer) GetProfileNames() (profiles []string, err error) {
 	return args.Get(0).([]string), args.Error(1)
 }
 
+func (m *MockIncusServer) GetProfile(name string) (profile *api.Profile, ETag string, err error) {
+	args := m.Called(name)
+	return args.Get(0).(*api.Profile), args.String(1), args.Error(2)
+}
+
+func (m *MockIncusServer) CreateProfile(profile api.ProfilesPost) (err error) {
+	args := m.Called(profile)
+	return args.Error(0)
+}
+
+func (m *MockIncusServer) UpdateProfile(name string, profile api.ProfilePut, ETag string) (err error) {
+	args := m.Called(name, profile, ETag)
+	return args.Error(0)
+}
+
 func (m *MockIncusServer) CreateInstance(instance api.InstancesPost) (op incus.Operation, err error) {
 	args := m.Called(instance)
 	return args.Get(0).(incus.Operation), args.Error(1)
@@ -55,6 +82,14 @@ func (m *MockIncusServer) GetInstanceFull(name string) (instance *api.InstanceFu
 	return args.Get(0).(*api.InstanceFull), args.String(1), args.Error(2)
 }
 
+func (m *MockIncusServer) GetInstanceSnapshot(instanceName string, name string) (*api.InstanceSnapshot, string, error) {
+	args := m.Called(instanceName, name)
+	if args.Get(0) == nil {
+		return nil, args.String(1), args.Error(2)
+	}
+	return args.Get(0).(*api.InstanceSnapshot), args.String(1), args.Error(2)
+}
+
 func (m *MockIncusServer) DeleteInstance(name string) (op incus.Operation, err error) {
 	args := m.Called(name)
 	return args.Get(0).(incus.Operation), args.Error(1)
@@ -72,5 +107,128 @@ func (m *MockIncusServer) GetImageAliasArchitectures(imageType string, name stri
 
 func (m *MockIncusServer) GetImage(name string) (image *api.Image, ETag string, err error) {
 	args := m.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.String(1), args.Error(2)
+	}
 	return args.Get(0).(*api.Image), args.String(1), args.Error(2)
 }
+
+func (m *MockIncusServer) GetImages() ([]api.Image, error) {
+	args := m.Called()
+	return args.Get(0).([]api.Image), args.Error(1)
+}
+
+func (m *MockIncusServer) DeleteImage(fingerprint string) (incus.Operation, error) {
+	args := m.Called(fingerprint)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(incus.Operation), args.Error(1)
+}
+
+func (m *MockIncusServer) CreateImage(image api.ImagesPost, imageArgs *incus.ImageCreateArgs) (incus.Operation, error) {
+	args := m.Called(image, imageArgs)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(incus.Operation), args.Error(1)
+}
+
+func (m *MockIncusServer) GetImageAlias(name string) (*api.ImageAliasesEntry, string, error) {
+	args := m.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.String(1), args.Error(2)
+	}
+	return args.Get(0).(*api.ImageAliasesEntry), args.String(1), args.Error(2)
+}
+
+func (m *MockIncusServer) CreateImageAlias(alias api.ImageAliasesPost) error {
+	args := m.Called(alias)
+	return args.Error(0)
+}
+
+func (m *MockIncusServer) UpdateImageAlias(name string, alias api.ImageAliasesEntryPut, ETag string) error {
+	args := m.Called(name, alias, ETag)
+	return args.Error(0)
+}
+
+func (m *MockIncusServer) GetImageSecret(fingerprint string) (secret string, err error) {
+	args := m.Called(fingerprint)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockIncusServer) GetEvents() (*incus.EventListener, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*incus.EventListener), args.Error(1)
+}
+
+func (m *MockIncusServer) GetInstanceConsoleLog(instanceName string, args *incus.InstanceConsoleLogArgs) (io.ReadCloser, error) {
+	ret := m.Called(instanceName, args)
+	if ret.Get(0) == nil {
+		return nil, ret.Error(1)
+	}
+	return ret.Get(0).(io.ReadCloser), ret.Error(1)
+}
+
+func (m *MockIncusServer) GetInstanceLogfiles(name string) (logfiles []string, err error) {
+	args := m.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockIncusServer) GetInstanceLogfile(name string, filename string) (content io.ReadCloser, err error) {
+	args := m.Called(name, filename)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+
+func (m *MockIncusServer) GetInstanceFile(instanceName string, path string) (content io.ReadCloser, resp *incus.InstanceFileResponse, err error) {
+	args := m.Called(instanceName, path)
+	if args.Get(0) == nil {
+		return nil, nil, args.Error(2)
+	}
+	return args.Get(0).(io.ReadCloser), args.Get(1).(*incus.InstanceFileResponse), args.Error(2)
+}
+
+func (m *MockIncusServer) CreateInstanceFile(instanceName string, path string, fileArgs incus.InstanceFileArgs) error {
+	args := m.Called(instanceName, path, fileArgs)
+	return args.Error(0)
+}
+
+func (m *MockIncusServer) ExecInstance(instanceName string, exec api.InstanceExecPost, execArgs *incus.InstanceExecArgs) (incus.Operation, error) {
+	args := m.Called(instanceName, exec, execArgs)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(incus.Operation), args.Error(1)
+}
+
+func (m *MockIncusServer) GetInstancesFullWithFilter(instanceType api.InstanceType, filters []string) (instances []api.InstanceFull, err error) {
+	args := m.Called(instanceType, filters)
+	return args.Get(0).([]api.InstanceFull), args.Error(1)
+}
+
+func (m *MockIncusServer) HasExtension(extension string) bool {
+	args := m.Called(extension)
+	return args.Bool(0)
+}
+
+func (m *MockIncusServer) GetInstance(name string) (*api.Instance, string, error) {
+	args := m.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.String(1), args.Error(2)
+	}
+	return args.Get(0).(*api.Instance), args.String(1), args.Error(2)
+}
+
+func (m *MockIncusServer) UpdateInstance(name string, instance api.InstancePut, ETag string) (incus.Operation, error) {
+	args := m.Called(name, instance, ETag)
+	return args.Get(0).(incus.Operation), args.Error(1)
+}
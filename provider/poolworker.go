@@ -0,0 +1,393 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lxc/incus/shared/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	// poolWorkerTimeout is the time a pool worker may run for.
+	poolWorkerTimeout = time.Hour
+	// standbyPoolTTL is the time after which a pool that was not seen is considered
+	// deleted, and its golden templates and warm clones are removed. GARM lists the
+	// runners of every pool it has every few minutes.
+	standbyPoolTTL = 24 * time.Hour
+)
+
+// poolWorkerSpec describes the golden template and warm pool a pool should have.
+type poolWorkerSpec struct {
+	PoolID string `json:"pool_id"`
+	// GoldenInstance is the golden instance of the pool, for pools cloned from a golden
+	// instance prepared by the user.
+	GoldenInstance string `json:"golden_instance,omitempty"`
+	// Template is what the golden template of the pool is built from, for pools that
+	// have the provider keep a golden template.
+	Template     *goldenTemplate `json:"template,omitempty"`
+	WarmPoolSize uint            `json:"warm_pool_size,omitempty"`
+	// Clone holds the arguments of the warm clones, without their source.
+	Clone api.InstancesPost `json:"clone"`
+}
+
+// needsWorker returns true if the pool has a golden template or a warm pool to maintain.
+func (s poolWorkerSpec) needsWorker() bool {
+	return s.Template != nil || s.WarmPoolSize > 0
+}
+
+// startPoolWorker starts the pool worker of a pool in the background, if the pool has
+// a golden template or a warm pool, or had one. Failing to start the worker only delays
+// building the golden template and refilling the warm pool, so errors are logged.
+func (l *Incus) startPoolWorker(spec poolWorkerSpec) {
+	if spec.PoolID == "" {
+		return
+	}
+	if !spec.needsWorker() {
+		// The worker still has to remove the golden templates and warm clones of a
+		// pool that no longer needs them.
+		if _, err := l.poolLastSeen(spec.PoolID); err != nil {
+			return
+		}
+	} else if err := l.touchPool(spec.PoolID, true); err != nil {
+		log.Printf("failed to mark pool %s as seen: %s", spec.PoolID, err)
+	}
+
+	if err := spawnPoolWorker(l, spec); err != nil {
+		log.Printf("failed to start the worker of pool %s: %s", spec.PoolID, err)
+	}
+}
+
+var spawnPoolWorker = startDetachedPoolWorker
+
+// startDetachedPoolWorker runs the pool-worker subcommand of the provider as a detached
+// process, so it outlives the provider. The spec is passed through stdin, as it may hold
+// the token needed to download the runner.
+func startDetachedPoolWorker(l *Incus, spec poolWorkerSpec) error {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return errors.Wrap(err, "marshaling spec")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "finding executable")
+	}
+
+	cmd := exec.Command(executable, "pool-worker", "--config", l.configFile, "--controller-id", l.controllerID)
+	cmd.SysProcAttr = detachedProcess()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return errors.Wrap(err, "creating stdin pipe")
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "starting worker")
+	}
+	defer cmd.Process.Release()
+
+	_, err = stdin.Write(data)
+	if closeErr := stdin.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "passing spec to worker")
+	}
+	return nil
+}
+
+func runPoolWorker(ctx context.Context, args []string, _ io.Writer) error {
+	fs, configFile := newFlagSet("pool-worker", "", "Build the golden template and refill the warm pool of the pool described by the spec read from stdin. Started by the provider when creating runners")
+	controllerID := fs.String("controller-id", os.Getenv("GARM_CONTROLLER_ID"), "ID of the controller the pool belongs to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlags(fs, "config", "controller-id"); err != nil {
+		return err
+	}
+
+	var spec poolWorkerSpec
+	if err := json.NewDecoder(os.Stdin).Decode(&spec); err != nil {
+		return errors.Wrap(err, "decoding spec")
+	}
+
+	l, err := newIncus(*configFile, *controllerID)
+	if err != nil {
+		return errors.Wrap(err, "creating provider")
+	}
+
+	unlock, err := l.lockPool(spec.PoolID)
+	if err != nil {
+		return errors.Wrapf(err, "locking pool %s", spec.PoolID)
+	}
+	if unlock == nil {
+		// Another worker is waiting for the pool, and will see the latest state of it.
+		return nil
+	}
+	defer unlock()
+
+	logPath, err := l.poolStatePath(spec.PoolID, ".log", true)
+	if err != nil {
+		return err
+	}
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return errors.Wrap(err, "creating log file")
+	}
+	defer logFile.Close()
+	log.SetOutput(logFile)
+
+	ctx, cancel := context.WithTimeout(ctx, poolWorkerTimeout)
+	defer cancel()
+
+	if err := l.reconcilePool(ctx, spec); err != nil {
+		log.Printf("failed to reconcile pool %s: %s", spec.PoolID, err)
+	}
+	if err := l.removeDeletedPools(ctx, spec.PoolID); err != nil {
+		log.Printf("failed to remove the instances of deleted pools: %s", err)
+	}
+	return nil
+}
+
+// reconcilePool builds the golden template of a pool if there is none for the current
+// image and runner version, and refills the warm pool. The warm pool is refilled from the
+// template we have before a new one is built, so runners can still be claimed while it
+// builds. Golden templates and warm clones the pool no longer needs are removed.
+//
+// Only one worker runs for a pool at a time, so templates that are not ready were left
+// behind by a worker that died, and are removed.
+func (l *Incus) reconcilePool(ctx context.Context, spec poolWorkerSpec) error {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+
+	templates, err := l.getStandbyInstances(cli, goldenPoolIDKey, spec.PoolID)
+	if err != nil {
+		return errors.Wrap(err, "fetching golden templates")
+	}
+
+	golden, current := spec.GoldenInstance, true
+	if spec.Template != nil {
+		golden, current = pickGoldenTemplate(templates, spec.Template.Args.Config[goldenVersionKeyName])
+	}
+	// While a new template is built, the previous one is kept.
+	l.removeGoldenTemplates(ctx, templates, golden)
+
+	if err := l.reconcileWarmPool(ctx, spec, golden); err != nil {
+		return errors.Wrap(err, "refilling warm pool")
+	}
+
+	if !spec.needsWorker() {
+		remaining, err := l.getStandbyInstances(cli, "", "")
+		if err != nil {
+			return errors.Wrap(err, "fetching standby instances")
+		}
+		if !slices.ContainsFunc(remaining, func(instance api.InstanceFull) bool { return standbyPoolID(instance) == spec.PoolID }) {
+			return l.forgetPool(spec.PoolID)
+		}
+		return nil
+	}
+	if current {
+		return nil
+	}
+
+	name, err := l.buildGoldenTemplate(ctx, *spec.Template)
+	if err != nil {
+		return errors.Wrap(err, "building golden template")
+	}
+	if err := l.reconcileWarmPool(ctx, spec, name); err != nil {
+		return errors.Wrap(err, "refilling warm pool")
+	}
+	l.removeGoldenTemplates(ctx, templates, "")
+	return nil
+}
+
+// removeDeletedPools removes the golden templates and warm clones of the pools that were
+// not seen for standbyPoolTTL. GARM does not tell providers when a pool is deleted, so
+// we rely on GARM listing the runners of every pool it has. Pools we never saw, as when
+// the state directory was cleaned up, are considered seen now.
+func (l *Incus) removeDeletedPools(ctx context.Context, currentPool string) error {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+
+	standby, err := l.getStandbyInstances(cli, "", "")
+	if err != nil {
+		return errors.Wrap(err, "fetching standby instances")
+	}
+	pools := map[string][]string{}
+	for _, instance := range standby {
+		poolID := standbyPoolID(instance)
+		if poolID == "" || poolID == currentPool {
+			continue
+		}
+		pools[poolID] = append(pools[poolID], instance.Name)
+	}
+
+	for poolID, names := range pools {
+		seen, err := l.poolLastSeen(poolID)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Printf("failed to check when pool %s was last seen: %s", poolID, err)
+				continue
+			}
+			if err := l.touchPool(poolID, true); err != nil {
+				log.Printf("failed to mark pool %s as seen: %s", poolID, err)
+			}
+			continue
+		}
+		if time.Since(seen) < standbyPoolTTL {
+			continue
+		}
+
+		unlock, err := l.tryLockPool(poolID)
+		if err != nil || unlock == nil {
+			// The pool has a worker, so it is not gone.
+			continue
+		}
+		log.Printf("pool %s was last seen on %s, removing its golden templates and warm clones", poolID, seen.Format(time.RFC3339))
+		for _, name := range names {
+			if err := l.deleteInstance(ctx, name); err != nil {
+				log.Printf("failed to remove instance %s: %s", name, err)
+			}
+		}
+		if err := l.forgetPool(poolID); err != nil {
+			log.Printf("failed to forget pool %s: %s", poolID, err)
+		}
+		unlock()
+	}
+	return nil
+}
+
+// standbyPoolID returns the ID of the pool a golden template or warm clone belongs to.
+func standbyPoolID(instance api.InstanceFull) string {
+	return cmp.Or(instance.Config[goldenPoolIDKey], instance.Config[warmPoolIDKey])
+}
+
+// poolStatePath returns the path of a file in the state directory, for the given pool.
+// The state directory is created if create is true.
+func (l *Incus) poolStatePath(poolID string, suffix string, create bool) (string, error) {
+	if poolID == "" || poolID != filepath.Base(poolID) || strings.HasPrefix(poolID, ".") {
+		return "", fmt.Errorf("invalid pool ID %q", poolID)
+	}
+	if create {
+		if err := os.MkdirAll(l.stateDir, 0o700); err != nil {
+			return "", errors.Wrap(err, "creating state directory")
+		}
+	}
+	return filepath.Join(l.stateDir, poolID+suffix), nil
+}
+
+// touchPool records that a pool was seen. If create is false, only pools that have a
+// golden template or a warm pool, or had one, are recorded.
+func (l *Incus) touchPool(poolID string, create bool) error {
+	path, err := l.poolStatePath(poolID, "", create)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	err = os.Chtimes(path, now, now)
+	switch {
+	case err == nil:
+		return nil
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	case !create:
+		return nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// poolLastSeen returns when a pool was last seen.
+func (l *Incus) poolLastSeen(poolID string) (time.Time, error) {
+	path, err := l.poolStatePath(poolID, "", false)
+	if err != nil {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// forgetPool removes the record of a pool that no longer has a golden template or a
+// warm pool, so no worker is started for it any more.
+func (l *Incus) forgetPool(poolID string) error {
+	path, err := l.poolStatePath(poolID, "", false)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// lockPool makes sure only one worker runs for a pool at a time. Workers queue up for
+// the pool, but only one of them waits: a worker that finds another one waiting returns
+// a nil unlock function, as the waiting worker has not looked at the pool yet.
+func (l *Incus) lockPool(poolID string) (func(), error) {
+	queuePath, err := l.poolStatePath(poolID, ".queue", true)
+	if err != nil {
+		return nil, err
+	}
+	queue, err := lockFile(queuePath, false)
+	if err != nil || queue == nil {
+		return nil, err
+	}
+	defer queue.Close()
+
+	lockPath, err := l.poolStatePath(poolID, ".lock", true)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(lockPath, true)
+	if err != nil {
+		return nil, err
+	}
+	return func() { lock.Close() }, nil
+}
+
+// tryLockPool locks a pool if no worker runs for it. Returns a nil unlock function if
+// a worker runs for the pool.
+func (l *Incus) tryLockPool(poolID string) (func(), error) {
+	lockPath, err := l.poolStatePath(poolID, ".lock", true)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(lockPath, false)
+	if err != nil || lock == nil {
+		return nil, err
+	}
+	return func() { lock.Close() }, nil
+}
@@ -0,0 +1,266 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cloudbase/garm-provider-incus/config"
+	"github.com/lxc/incus/shared/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartPoolWorker(t *testing.T) {
+	l := &Incus{stateDir: t.TempDir()}
+	var started []poolWorkerSpec
+	spawnPoolWorker = func(_ *Incus, spec poolWorkerSpec) error {
+		started = append(started, spec)
+		return nil
+	}
+	t.Cleanup(func() {
+		spawnPoolWorker = startDetachedPoolWorker
+	})
+
+	// Pools that never had a golden template or a warm pool need no worker.
+	l.startPoolWorker(poolWorkerSpec{PoolID: "pool", GoldenInstance: "golden"})
+	assert.Empty(t, started)
+
+	l.startPoolWorker(poolWorkerSpec{PoolID: "pool", GoldenInstance: "golden", WarmPoolSize: 2})
+	require.Len(t, started, 1)
+	_, err := l.poolLastSeen("pool")
+	require.NoError(t, err)
+
+	// The warm pool was disabled, so the worker has to remove the clones.
+	l.startPoolWorker(poolWorkerSpec{PoolID: "pool", GoldenInstance: "golden"})
+	require.Len(t, started, 2)
+	assert.Equal(t, uint(0), started[1].WarmPoolSize)
+}
+
+func TestTouchPool(t *testing.T) {
+	l := &Incus{stateDir: t.TempDir()}
+
+	require.NoError(t, l.touchPool("pool", false))
+	_, err := l.poolLastSeen("pool")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, l.touchPool("pool", true))
+	path, err := l.poolStatePath("pool", "", false)
+	require.NoError(t, err)
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(path, past, past))
+
+	require.NoError(t, l.touchPool("pool", false))
+	seen, err := l.poolLastSeen("pool")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), seen, time.Minute)
+
+	require.NoError(t, l.forgetPool("pool"))
+	_, err = l.poolLastSeen("pool")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	require.Error(t, l.touchPool("../pool", true))
+}
+
+func TestLockPool(t *testing.T) {
+	l := &Incus{stateDir: t.TempDir()}
+
+	unlock, err := l.lockPool("pool")
+	require.NoError(t, err)
+	require.NotNil(t, unlock)
+
+	locked, err := l.tryLockPool("pool")
+	require.NoError(t, err)
+	assert.Nil(t, locked)
+
+	// The second worker waits for the first one.
+	waiting := make(chan func())
+	go func() {
+		unlock, err := l.lockPool("pool")
+		assert.NoError(t, err)
+		waiting <- unlock
+	}()
+	queuePath, err := l.poolStatePath("pool", ".queue", false)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		queue, err := lockFile(queuePath, false)
+		if err != nil || queue == nil {
+			return true
+		}
+		queue.Close()
+		return false
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// The third worker has nothing to do, as the second one has not looked at the pool yet.
+	third, err := l.lockPool("pool")
+	require.NoError(t, err)
+	assert.Nil(t, third)
+
+	unlock()
+	select {
+	case unlock := <-waiting:
+		require.NotNil(t, unlock)
+		unlock()
+	case <-time.After(10 * time.Second):
+		t.Fatal("waiting worker did not get the lock")
+	}
+
+	locked, err = l.tryLockPool("pool")
+	require.NoError(t, err)
+	require.NotNil(t, locked)
+	locked()
+}
+
+func TestReconcilePool(t *testing.T) {
+	ctx := context.Background()
+	l, cli, bootstrapParams, version := goldenTemplateTestSetup(t)
+	now := time.Now()
+	templates := []api.InstanceFull{
+		goldenTemplateInstance("garm-golden-old", "outdated", true, now.Add(-48*time.Hour)),
+		goldenTemplateInstance("garm-golden-abandoned", "outdated", false, now.Add(-time.Hour)),
+		goldenTemplateInstance("garm-golden-current", version, true, now.Add(-time.Hour)),
+	}
+	cli.On("GetInstancesFullWithFilter", api.InstanceTypeAny, []string{
+		"config.user.runner-standby-controller-id=controller",
+		"config.user.runner-golden-pool-id=6f1c5e4a-0d8b-4c3e-9a7f-2b1d3c4e5f60",
+	}).Return(templates, nil)
+	cli.On("GetInstancesFullWithFilter", api.InstanceTypeAny, []string{
+		"config.user.runner-standby-controller-id=controller",
+		"config.user.runner-warm-pool-id=6f1c5e4a-0d8b-4c3e-9a7f-2b1d3c4e5f60",
+	}).Return([]api.InstanceFull{}, nil)
+	mockOp := new(MockOperation)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+	cli.On("UpdateInstanceState", mock.Anything, mock.Anything, "").Return(mockOp, nil)
+	cli.On("DeleteInstance", mock.Anything).Return(mockOp, nil)
+
+	template, _, err := l.getGoldenTemplate(ctx, bootstrapParams, extraSpecs{GoldenTemplate: true})
+	require.NoError(t, err)
+	require.NoError(t, l.reconcilePool(ctx, poolWorkerSpec{PoolID: bootstrapParams.PoolID, Template: template}))
+
+	cli.AssertNumberOfCalls(t, "DeleteInstance", 2)
+	cli.AssertCalled(t, "DeleteInstance", "garm-golden-old")
+	cli.AssertCalled(t, "DeleteInstance", "garm-golden-abandoned")
+	cli.AssertNotCalled(t, "CreateInstance", mock.Anything)
+}
+
+func TestReconcilePoolBuildsTemplate(t *testing.T) {
+	ctx := context.Background()
+	l, cli, bootstrapParams, _ := goldenTemplateTestSetup(t)
+	previous := goldenTemplateInstance("garm-golden-old", "outdated", true, time.Now().Add(-48*time.Hour))
+	cli.On("GetInstancesFullWithFilter", api.InstanceTypeAny, []string{
+		"config.user.runner-standby-controller-id=controller",
+		"config.user.runner-golden-pool-id=6f1c5e4a-0d8b-4c3e-9a7f-2b1d3c4e5f60",
+	}).Return([]api.InstanceFull{previous}, nil)
+	cli.On("GetInstancesFullWithFilter", api.InstanceTypeAny, []string{
+		"config.user.runner-standby-controller-id=controller",
+		"config.user.runner-warm-pool-id=6f1c5e4a-0d8b-4c3e-9a7f-2b1d3c4e5f60",
+	}).Return([]api.InstanceFull{}, nil)
+
+	template, _, err := l.getGoldenTemplate(ctx, bootstrapParams, extraSpecs{GoldenTemplate: true})
+	require.NoError(t, err)
+
+	mockOp := new(MockOperation)
+	mockOp.On("Wait").Return(nil)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+	// Building the template fails on the first step, so we only check the order.
+	cli.On("GetInstance", "garm-golden-old").Return(&api.Instance{
+		Name:       "garm-golden-old",
+		Type:       "container",
+		StatusCode: api.Stopped,
+	}, "", nil)
+	cli.On("CreateInstance", mock.MatchedBy(func(args api.InstancesPost) bool {
+		return args.Source.Type == "copy"
+	})).Return(mockOp, nil)
+	cli.On("CreateInstance", mock.MatchedBy(func(args api.InstancesPost) bool {
+		return args.Source.Type == "image"
+	})).Return((*MockOperation)(nil), assert.AnError)
+	cli.On("UpdateInstanceState", mock.Anything, mock.Anything, "").Return(mockOp, nil)
+
+	spec := poolWorkerSpec{PoolID: bootstrapParams.PoolID, Template: template, WarmPoolSize: 1}
+	require.ErrorIs(t, l.reconcilePool(ctx, spec), assert.AnError)
+
+	// The warm pool is refilled from the previous template before a new one is built,
+	// and the previous template is kept as the new one failed to build.
+	cli.AssertCalled(t, "CreateInstance", mock.MatchedBy(func(args api.InstancesPost) bool {
+		return args.Source.Source == "garm-golden-old" && args.Config[warmPoolIDKey] == bootstrapParams.PoolID
+	}))
+	cli.AssertCalled(t, "CreateInstance", mock.MatchedBy(func(args api.InstancesPost) bool {
+		return args.Source.Fingerprint == "123abc" && args.Config[goldenPoolIDKey] == bootstrapParams.PoolID
+	}))
+	cli.AssertNotCalled(t, "DeleteInstance", "garm-golden-old")
+}
+
+func TestRemoveDeletedPools(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg:          &config.Incus{},
+		cli:          cli,
+		controllerID: "controller",
+		stateDir:     t.TempDir(),
+	}
+	standby := func(name string, key string, poolID string) api.InstanceFull {
+		return api.InstanceFull{
+			Instance: api.Instance{
+				Name: name,
+				InstancePut: api.InstancePut{
+					Config: map[string]string{
+						standbyControllerIDKeyName: "controller",
+						key:                        poolID,
+					},
+				},
+			},
+		}
+	}
+	cli.On("HasExtension", "api_filtering").Return(true)
+	cli.On("GetInstancesFullWithFilter", api.InstanceTypeAny, []string{
+		"config.user.runner-standby-controller-id=controller",
+	}).Return([]api.InstanceFull{
+		standby("garm-golden-current", goldenPoolIDKey, "current"),
+		standby("garm-golden-alive", goldenPoolIDKey, "alive"),
+		standby("garm-warm-alive", warmPoolIDKey, "alive"),
+		standby("garm-golden-gone", goldenPoolIDKey, "gone"),
+		standby("garm-warm-gone", warmPoolIDKey, "gone"),
+		standby("garm-warm-unknown", warmPoolIDKey, "unknown"),
+	}, nil)
+	mockOp := new(MockOperation)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+	cli.On("UpdateInstanceState", mock.Anything, mock.Anything, "").Return(mockOp, nil)
+	cli.On("DeleteInstance", mock.Anything).Return(mockOp, nil)
+
+	require.NoError(t, l.touchPool("alive", true))
+	require.NoError(t, l.touchPool("gone", true))
+	gonePath, err := l.poolStatePath("gone", "", false)
+	require.NoError(t, err)
+	past := time.Now().Add(-standbyPoolTTL - time.Hour)
+	require.NoError(t, os.Chtimes(gonePath, past, past))
+
+	require.NoError(t, l.removeDeletedPools(ctx, "current"))
+
+	cli.AssertNumberOfCalls(t, "DeleteInstance", 2)
+	cli.AssertCalled(t, "DeleteInstance", "garm-golden-gone")
+	cli.AssertCalled(t, "DeleteInstance", "garm-warm-gone")
+	_, err = l.poolLastSeen("gone")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	// Pools we never saw are given standbyPoolTTL from now.
+	seen, err := l.poolLastSeen("unknown")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), seen, time.Minute)
+}
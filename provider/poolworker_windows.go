@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build windows
+
+package provider
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	// errorSharingViolation is returned when opening a file another process holds
+	// open without sharing it.
+	errorSharingViolation syscall.Errno = 32
+	// detachedProcessFlag starts a process without a console.
+	detachedProcessFlag = 0x00000008
+)
+
+// lockFile takes an exclusive lock on a file, creating it if needed, by opening it
+// without sharing it. If wait is false and the file is locked by another process, a
+// nil file is returned. The lock is held until the file is closed, or the process exits.
+func lockFile(path string, wait bool) (*os.File, error) {
+	pathp, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		handle, err := syscall.CreateFile(pathp, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+		if err == nil {
+			return os.NewFile(uintptr(handle), path), nil
+		}
+		if !errors.Is(err, errorSharingViolation) {
+			return nil, err
+		}
+		if !wait {
+			return nil, nil
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// detachedProcess returns the attributes of a process that keeps running once the
+// provider exits.
+func detachedProcess() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP | detachedProcessFlag}
+}
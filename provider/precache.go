@@ -0,0 +1,210 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-incus/config"
+	"github.com/pkg/errors"
+
+	"github.com/lxc/incus/shared/api"
+)
+
+// precacheResult describes an image copied into the local image store by the
+// precache command.
+type precacheResult struct {
+	image       string
+	arch        commonParams.OSArch
+	fingerprint string
+	size        int64
+	// cached is true if the image was already in the local image store.
+	cached bool
+}
+
+func runPrecache(ctx context.Context, args []string, out io.Writer) error {
+	fs, configFile := newFlagSet("precache", "<image>...", "Copy the images of pools into the local image store, for all architectures, and keep them up to date")
+	instanceType := fs.String("instance-type", "", "instance type of the images: container or virtual-machine (default: the instance type in the provider config)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlags(fs, "config"); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no images given")
+	}
+
+	l, err := newIncus(*configFile, "")
+	if err != nil {
+		return errors.Wrap(err, "creating provider")
+	}
+
+	imageType, err := parseInstanceType(*instanceType, l.cfg)
+	if err != nil {
+		return err
+	}
+
+	results, err := l.precacheImages(ctx, fs.Args(), imageType)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tARCH\tFINGERPRINT\tSIZE\tSTATUS")
+	for _, result := range results {
+		status := "copied"
+		if result.cached {
+			status = "cached"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", result.image, result.arch, result.fingerprint, result.size, status)
+	}
+	if flushErr := w.Flush(); flushErr != nil {
+		return errors.Wrap(flushErr, "writing results")
+	}
+	return err
+}
+
+// precacheImages copies the given images into the local image store, for every
+// architecture the provider supports and the remote has the image for. Images are
+// copied with auto update enabled, so the Incus server keeps them up to date. Failing
+// images are reported in the returned error, after all other images were precached.
+func (l *Incus) precacheImages(ctx context.Context, images []string, imageType config.IncusImageType) ([]precacheResult, error) {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching client")
+	}
+
+	ret := []precacheResult{}
+	precacheErr := &aggregateError{format: "failed to precache %d images"}
+	for _, imageName := range images {
+		results, err := l.imageManager.precacheImage(ctx, cli, imageName, imageType)
+		ret = append(ret, results...)
+		if err != nil {
+			precacheErr.add(imageName, err)
+		}
+	}
+	return ret, precacheErr.errOrNil()
+}
+
+// precacheImage copies an image from a remote into the local image store, for every
+// architecture the provider supports and the remote has the image for.
+func (i *image) precacheImage(ctx context.Context, cli InstanceServerInterface, imageName string, imageType config.IncusImageType) ([]precacheResult, error) {
+	if !strings.Contains(imageName, ":") {
+		return nil, runnerErrors.NewBadRequestError("image %s does not include a remote", imageName)
+	}
+	remote, parsedName, err := i.parseImageName(imageName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing image name: %s", imageName)
+	}
+	switch remote.Protocol {
+	case config.SimpleStreams, config.IncusProtocol:
+	default:
+		return nil, runnerErrors.NewBadRequestError("images on %s remotes can not be precached", remote.Protocol)
+	}
+	if isImageSelector(parsedName) {
+		// Selectors don't name an alias the Incus server could update the image from.
+		return nil, runnerErrors.NewBadRequestError("image selector %s can not be precached, use the alias of the image instead", parsedName)
+	}
+
+	srv, err := i.getRemoteImageServer(remote)
+	if err != nil {
+		return nil, errors.Wrapf(err, "connecting to remote %s", remote.Address)
+	}
+
+	aliases, err := srv.GetImageAliasArchitectures(imageType.String(), parsedName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving alias: %s", parsedName)
+	}
+
+	ret := []precacheResult{}
+	for _, osArch := range slices.Sorted(maps.Keys(configToIncusArchMap)) {
+		alias, ok := aliases[configToIncusArchMap[osArch]]
+		if !ok {
+			continue
+		}
+
+		result, err := precacheImageArch(ctx, cli, srv, remote, parsedName, alias.Target, imageType)
+		if err != nil {
+			return ret, errors.Wrapf(err, "precaching %s image", osArch)
+		}
+		result.image = imageName
+		result.arch = osArch
+		ret = append(ret, result)
+	}
+
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no image found for image type %s with name %s", imageType, parsedName)
+	}
+	return ret, nil
+}
+
+// precacheImageArch copies a single image from a remote into the local image store,
+// unless it is already there.
+func precacheImageArch(ctx context.Context, cli InstanceServerInterface, srv ImageServerInterface, remote config.IncusImageRemote, alias string, fingerprint string, imageType config.IncusImageType) (precacheResult, error) {
+	remoteImage, _, err := srv.GetImage(fingerprint)
+	if err != nil {
+		return precacheResult{}, errors.Wrap(err, "fetching image details")
+	}
+
+	result := precacheResult{
+		fingerprint: remoteImage.Fingerprint,
+		size:        remoteImage.Size,
+	}
+	if _, _, err := cli.GetImage(remoteImage.Fingerprint); err == nil {
+		result.cached = true
+		return result, nil
+	} else if !isNotFoundError(err) {
+		return precacheResult{}, errors.Wrap(err, "fetching local image")
+	}
+
+	certificate, secret, err := remoteImageCredentials(srv, remote, remoteImage)
+	if err != nil {
+		return precacheResult{}, errors.Wrap(err, "fetching image credentials")
+	}
+
+	// The alias is recorded as the source of the image, which is what the Incus
+	// server uses to look for new versions of the image.
+	op, err := cli.CreateImage(api.ImagesPost{
+		ImagePut: api.ImagePut{
+			AutoUpdate: true,
+		},
+		Source: &api.ImagesPostSource{
+			ImageSource: api.ImageSource{
+				Alias:       alias,
+				Certificate: certificate,
+				Protocol:    string(remote.Protocol),
+				Server:      remote.Address,
+				ImageType:   imageType.String(),
+			},
+			Type:        "image",
+			Mode:        "pull",
+			Fingerprint: remoteImage.Fingerprint,
+			Secret:      secret,
+		},
+	}, nil)
+	if err != nil {
+		return precacheResult{}, errors.Wrap(err, "copying image")
+	}
+	if err := op.WaitContext(ctx); err != nil {
+		return precacheResult{}, errors.Wrap(err, "waiting for image to be copied")
+	}
+	return result, nil
+}
@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-incus/config"
+	incus "github.com/lxc/incus/client"
+	"github.com/lxc/incus/shared/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrecacheImages(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+	srv := new(MockIncusServer)
+	remote := config.IncusImageRemote{
+		Address:  "https://images.linuxcontainers.org",
+		Public:   true,
+		Protocol: config.SimpleStreams,
+	}
+	l := &Incus{
+		cfg: &config.Incus{
+			UnixSocket: "/var/run/incus.sock",
+		},
+		cli: cli,
+		imageManager: &image{
+			remotes: map[string]config.IncusImageRemote{
+				"images": remote,
+				"docker": {
+					Address:  "https://docker.io",
+					Protocol: config.OCI,
+				},
+			},
+			connectRemote: func(config.IncusImageRemote) (ImageServerInterface, error) {
+				return srv, nil
+			},
+		},
+	}
+
+	srv.On("GetImageAliasArchitectures", "container", "ubuntu/22.04/cloud").Return(map[string]*api.ImageAliasesEntry{
+		"x86_64":  {ImageAliasesEntryPut: api.ImageAliasesEntryPut{Target: "amd64-fingerprint"}},
+		"aarch64": {ImageAliasesEntryPut: api.ImageAliasesEntryPut{Target: "arm64-fingerprint"}},
+		"riscv64": {ImageAliasesEntryPut: api.ImageAliasesEntryPut{Target: "riscv64-fingerprint"}},
+	}, nil)
+	srv.On("GetImage", "amd64-fingerprint").Return(&api.Image{Fingerprint: "amd64-fingerprint", Size: 100, ImagePut: api.ImagePut{Public: true}}, "", nil)
+	srv.On("GetImage", "arm64-fingerprint").Return(&api.Image{Fingerprint: "arm64-fingerprint", Size: 200, ImagePut: api.ImagePut{Public: true}}, "", nil)
+	cli.On("GetImage", "amd64-fingerprint").Return(&api.Image{Fingerprint: "amd64-fingerprint"}, "", nil)
+	cli.On("GetImage", "arm64-fingerprint").Return(nil, "", api.StatusErrorf(http.StatusNotFound, "Image not found"))
+	op := new(MockOperation)
+	op.On("WaitContext", mock.Anything).Return(nil)
+	cli.On("CreateImage", api.ImagesPost{
+		ImagePut: api.ImagePut{
+			AutoUpdate: true,
+		},
+		Source: &api.ImagesPostSource{
+			ImageSource: api.ImageSource{
+				Alias:     "ubuntu/22.04/cloud",
+				Protocol:  "simplestreams",
+				Server:    "https://images.linuxcontainers.org",
+				ImageType: "container",
+			},
+			Type:        "image",
+			Mode:        "pull",
+			Fingerprint: "arm64-fingerprint",
+		},
+	}, (*incus.ImageCreateArgs)(nil)).Return(op, nil)
+
+	results, err := l.precacheImages(ctx, []string{"images:ubuntu/22.04/cloud", "docker:ubuntu:22.04", "images:ubuntu/22.04?variant=cloud", "ubuntu"}, config.IncusImageContainer)
+	require.Error(t, err)
+	assert.Equal(t, "failed to precache 3 images: docker:ubuntu:22.04: images on oci remotes can not be precached; images:ubuntu/22.04?variant=cloud: image selector ubuntu/22.04?variant=cloud can not be precached, use the alias of the image instead; ubuntu: image ubuntu does not include a remote", err.Error())
+	assert.Equal(t, []precacheResult{
+		{
+			image:       "images:ubuntu/22.04/cloud",
+			arch:        commonParams.Amd64,
+			fingerprint: "amd64-fingerprint",
+			size:        100,
+			cached:      true,
+		},
+		{
+			image:       "images:ubuntu/22.04/cloud",
+			arch:        commonParams.Arm64,
+			fingerprint: "arm64-fingerprint",
+			size:        200,
+		},
+	}, results)
+	cli.AssertNumberOfCalls(t, "CreateImage", 1)
+}
+
+func TestPrecacheImageNotFound(t *testing.T) {
+	srv := new(MockIncusServer)
+	i := &image{
+		remotes: map[string]config.IncusImageRemote{
+			"images": {
+				Address:  "https://images.linuxcontainers.org",
+				Protocol: config.SimpleStreams,
+			},
+		},
+		connectRemote: func(config.IncusImageRemote) (ImageServerInterface, error) {
+			return srv, nil
+		},
+	}
+	srv.On("GetImageAliasArchitectures", "virtual-machine", "alpine/edge").Return(map[string]*api.ImageAliasesEntry{}, nil)
+
+	_, err := i.precacheImage(context.Background(), new(MockIncusServer), "images:alpine/edge", config.IncusImageVirtualMachine)
+	require.ErrorContains(t, err, "no image found for image type virtual-machine with name alpine/edge")
+}
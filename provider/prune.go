@@ -0,0 +1,245 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/lxc/incus/shared/api"
+)
+
+// defaultPruneRetention is the default time unused images are kept for.
+const defaultPruneRetention = 7 * 24 * time.Hour
+
+// imageRef is a reference to an image, as used in the image of a pool.
+type imageRef struct {
+	// server is the address of the remote of the image, or empty for local images.
+	server string
+	alias  string
+	// fingerprints are the fingerprints (or prefixes) of the images the pool is pulled
+	// by, for pools that pin the image and for image selectors.
+	fingerprints []string
+}
+
+// matches returns true if the local image is the one referenced. Local images are
+// matched by their aliases, and images copied from a remote by the alias they are
+// kept up to date from. Images pulled by fingerprint are matched by it.
+func (r imageRef) matches(image api.Image) bool {
+	if slices.ContainsFunc(r.fingerprints, func(fingerprint string) bool { return strings.HasPrefix(image.Fingerprint, fingerprint) }) {
+		return true
+	}
+	if r.server == "" {
+		return slices.ContainsFunc(image.Aliases, func(alias api.ImageAlias) bool {
+			return alias.Name == r.alias
+		})
+	}
+	return image.UpdateSource != nil && image.UpdateSource.Server == r.server && image.UpdateSource.Alias == r.alias
+}
+
+// isPrunable returns true if the local image may have been produced by GARM: cached
+// by the Incus server when a runner was created from a remote, copied by the precache
+// command or published by the bake command. Images uploaded by hand are never removed.
+func isPrunable(image api.Image) bool {
+	return image.Cached || image.UpdateSource != nil || image.Properties[bakedFromPropertyName] != ""
+}
+
+// pruneOptions holds the options of the prune command.
+type pruneOptions struct {
+	images    []string
+	retention time.Duration
+	dryRun    bool
+}
+
+// pruneResult describes a local image removed by the prune command.
+type pruneResult struct {
+	fingerprint string
+	description string
+	size        int64
+	// lastUsed is when the image was last used or uploaded, whichever is later.
+	// This is what the retention is checked against.
+	lastUsed time.Time
+}
+
+func runPrune(ctx context.Context, args []string, out io.Writer) error {
+	fs, configFile := newFlagSet("prune", "<image>...", "Remove the local images that are not used by runners or by the given pool images")
+	opts := pruneOptions{}
+	fs.DurationVar(&opts.retention, "retention", defaultPruneRetention, "how long images are kept after they were last used or uploaded")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "list the images that would be removed, without removing them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlags(fs, "config"); err != nil {
+		return err
+	}
+	opts.images = fs.Args()
+
+	l, err := newIncus(*configFile, "")
+	if err != nil {
+		return errors.Wrap(err, "creating provider")
+	}
+
+	results, err := l.pruneImages(ctx, opts)
+	status := "removed"
+	if opts.dryRun {
+		status = "would remove"
+	}
+	var total int64
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FINGERPRINT\tDESCRIPTION\tSIZE\tLAST USED\tSTATUS")
+	for _, result := range results {
+		lastUsed := "never"
+		if !result.lastUsed.IsZero() {
+			lastUsed = result.lastUsed.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", result.fingerprint, result.description, result.size, lastUsed, status)
+		total += result.size
+	}
+	if flushErr := w.Flush(); flushErr != nil {
+		return errors.Wrap(flushErr, "writing results")
+	}
+	fmt.Fprintf(out, "%s %d images, %d bytes\n", status, len(results), total)
+	return err
+}
+
+// parseImageRef parses the image of a pool into a reference to a local image. The
+// image of a pool that pins the image fingerprint is given as image@fingerprint.
+// Image selectors are resolved to the images they currently select.
+func (i *image) parseImageRef(imageName string) (imageRef, error) {
+	ref := imageRef{}
+	if idx := strings.LastIndex(imageName, "@"); idx != -1 && fingerprintRegex.MatchString(imageName[idx+1:]) {
+		ref.fingerprints = append(ref.fingerprints, imageName[idx+1:])
+		imageName = imageName[:idx]
+	}
+	if !strings.Contains(imageName, ":") {
+		ref.alias = imageName
+		return ref, nil
+	}
+	remote, parsedName, err := i.parseImageName(imageName)
+	if err != nil {
+		return imageRef{}, errors.Wrapf(err, "parsing image name: %s", imageName)
+	}
+	ref.server = remote.Address
+	ref.alias = parsedName
+
+	if isImageSelector(parsedName) {
+		fingerprints, err := i.resolveImageSelectorFingerprints(remote, parsedName)
+		if err != nil {
+			return imageRef{}, errors.Wrapf(err, "resolving image %s", imageName)
+		}
+		ref.fingerprints = append(ref.fingerprints, fingerprints...)
+	}
+	return ref, nil
+}
+
+// pruneImages removes the local images that are not used by any instance, are not
+// referenced by any of the given pool images, and were not used or uploaded during
+// the retention window. Projects without their own image store share the one of the
+// default project, so the images of instances not created by GARM are kept as well,
+// and only images GARM may have produced are removed. Images that fail to be removed
+// are reported in the returned error, along with the images that were removed.
+func (l *Incus) pruneImages(ctx context.Context, opts pruneOptions) ([]pruneResult, error) {
+	// Parse all the pool images before removing anything, so a typo can't get
+	// the image of a pool removed.
+	refs := make([]imageRef, 0, len(opts.images))
+	for _, imageName := range opts.images {
+		ref, err := l.imageManager.parseImageRef(imageName)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching client")
+	}
+
+	instances, err := cli.GetInstancesFull(api.InstanceTypeAny)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching instances")
+	}
+	used := map[string]struct{}{}
+	for _, instance := range instances {
+		used[instance.Config[baseImageKeyName]] = struct{}{}
+	}
+
+	images, err := cli.GetImages()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching images")
+	}
+
+	cutoff := time.Now().Add(-opts.retention)
+	ret := []pruneResult{}
+	pruneErr := &aggregateError{format: "failed to remove %d images"}
+	for _, image := range images {
+		if !isPrunable(image) {
+			continue
+		}
+		if _, ok := used[image.Fingerprint]; ok {
+			continue
+		}
+		if slices.ContainsFunc(refs, func(ref imageRef) bool { return ref.matches(image) }) {
+			continue
+		}
+		lastUsed := image.LastUsedAt
+		if image.UploadedAt.After(lastUsed) {
+			lastUsed = image.UploadedAt
+		}
+		if lastUsed.After(cutoff) {
+			continue
+		}
+
+		if !opts.dryRun {
+			if err := deleteImage(ctx, cli, image.Fingerprint); err != nil {
+				pruneErr.add(image.Fingerprint, err)
+				continue
+			}
+		}
+		ret = append(ret, pruneResult{
+			fingerprint: image.Fingerprint,
+			description: image.Properties["description"],
+			size:        image.Size,
+			lastUsed:    lastUsed,
+		})
+	}
+	return ret, pruneErr.errOrNil()
+}
+
+// deleteImage removes a local image.
+func deleteImage(ctx context.Context, cli InstanceServerInterface, fingerprint string) error {
+	op, err := cli.DeleteImage(fingerprint)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil
+		}
+		return errors.Wrap(err, "removing image")
+	}
+	if err := op.WaitContext(ctx); err != nil {
+		if isNotFoundError(err) {
+			return nil
+		}
+		return errors.Wrap(err, "waiting for image removal")
+	}
+	return nil
+}
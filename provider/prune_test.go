@@ -0,0 +1,221 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloudbase/garm-provider-incus/config"
+	"github.com/lxc/incus/shared/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruneImages(t *testing.T) {
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	images := []api.Image{
+		{
+			// Used by a runner.
+			Fingerprint: "used",
+			UploadedAt:  old,
+			Cached:      true,
+		},
+		{
+			// Referenced by a pool through a local alias.
+			Fingerprint: "baked",
+			UploadedAt:  old,
+			Aliases:     []api.ImageAlias{{Name: "garm-ubuntu"}},
+			ImagePut: api.ImagePut{
+				Properties: map[string]string{
+					bakedFromPropertyName: "images:ubuntu/22.04/cloud",
+				},
+			},
+		},
+		{
+			// Referenced by a pool through a remote.
+			Fingerprint: "remote",
+			UploadedAt:  old,
+			UpdateSource: &api.ImageSource{
+				Server: "https://images.linuxcontainers.org",
+				Alias:  "ubuntu/22.04/cloud",
+			},
+		},
+		{
+			// Pulled by fingerprint for a pool that pins it.
+			Fingerprint: "4a3f5b2c1d0e9f8a",
+			UploadedAt:  old,
+			UpdateSource: &api.ImageSource{
+				Server: "https://images.linuxcontainers.org",
+			},
+		},
+		{
+			// Pulled by fingerprint for a pool that uses an image selector.
+			Fingerprint: "aaa222",
+			UploadedAt:  old,
+			UpdateSource: &api.ImageSource{
+				Server: "https://images.linuxcontainers.org",
+			},
+		},
+		{
+			// Used recently.
+			Fingerprint: "recent",
+			UploadedAt:  old,
+			LastUsedAt:  time.Now().Add(-time.Hour),
+			Cached:      true,
+		},
+		{
+			// Used by an instance not created by GARM.
+			Fingerprint: "unmanaged",
+			UploadedAt:  old,
+			Cached:      true,
+		},
+		{
+			// Uploaded by hand.
+			Fingerprint: "uploaded",
+			UploadedAt:  old,
+			LastUsedAt:  old,
+			Aliases:     []api.ImageAlias{{Name: "my-image"}},
+		},
+		{
+			Fingerprint: "cached",
+			UploadedAt:  old,
+			LastUsedAt:  old,
+			Size:        100,
+			Cached:      true,
+		},
+		{
+			Fingerprint: "stale",
+			UploadedAt:  old,
+			LastUsedAt:  old,
+			Size:        200,
+			Aliases:     []api.ImageAlias{{Name: "garm-ubuntu/v1"}},
+			ImagePut: api.ImagePut{
+				Properties: map[string]string{
+					"description":         "GARM runner image baked from images:ubuntu/22.04/cloud",
+					bakedFromPropertyName: "images:ubuntu/22.04/cloud",
+				},
+			},
+		},
+	}
+	instances := []api.InstanceFull{
+		{
+			Instance: api.Instance{
+				Name: "garm-runner",
+				InstancePut: api.InstancePut{
+					Config: map[string]string{
+						controllerIDKeyName: "controller",
+						baseImageKeyName:    "used",
+					},
+				},
+				ExpandedConfig: map[string]string{
+					controllerIDKeyName: "controller",
+				},
+			},
+		},
+		{
+			Instance: api.Instance{
+				Name: "other",
+				InstancePut: api.InstancePut{
+					Config: map[string]string{
+						baseImageKeyName: "unmanaged",
+					},
+				},
+			},
+		},
+	}
+
+	srv := new(MockIncusServer)
+	srv.On("GetImages").Return([]api.Image{
+		simplestreamsImage("aaa111", "jammy", "cloud", "x86_64", "container", old),
+		simplestreamsImage("aaa222", "jammy", "cloud", "x86_64", "container", old.Add(time.Hour)),
+	}, nil)
+	newProvider := func(cli *MockIncusServer) *Incus {
+		return &Incus{
+			cfg: &config.Incus{
+				UnixSocket: "/var/run/incus.sock",
+			},
+			cli: cli,
+			imageManager: &image{
+				remotes: map[string]config.IncusImageRemote{
+					"images": {
+						Address:  "https://images.linuxcontainers.org",
+						Protocol: config.SimpleStreams,
+					},
+				},
+				connectRemote: func(config.IncusImageRemote) (ImageServerInterface, error) {
+					return srv, nil
+				},
+			},
+		}
+	}
+	expected := []pruneResult{
+		{
+			fingerprint: "cached",
+			size:        100,
+			lastUsed:    old,
+		},
+		{
+			fingerprint: "stale",
+			description: "GARM runner image baked from images:ubuntu/22.04/cloud",
+			size:        200,
+			lastUsed:    old,
+		},
+	}
+	opts := pruneOptions{
+		images:    []string{"garm-ubuntu", "images:ubuntu/22.04/cloud", "images:debian/12/cloud@4a3f5b2c1d0e", "images:ubuntu/22.04?variant=cloud"},
+		retention: 24 * time.Hour,
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		cli := new(MockIncusServer)
+		cli.On("GetInstancesFull", api.InstanceTypeAny).Return(instances, nil)
+		cli.On("GetImages").Return(images, nil)
+
+		dryRun := opts
+		dryRun.dryRun = true
+		results, err := newProvider(cli).pruneImages(context.Background(), dryRun)
+		require.NoError(t, err)
+		assert.Equal(t, expected, results)
+		cli.AssertNotCalled(t, "DeleteImage", mock.Anything)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		cli := new(MockIncusServer)
+		cli.On("GetInstancesFull", api.InstanceTypeAny).Return(instances, nil)
+		cli.On("GetImages").Return(images, nil)
+		op := new(MockOperation)
+		op.On("WaitContext", mock.Anything).Return(nil)
+		cli.On("DeleteImage", "cached").Return(nil, assert.AnError)
+		cli.On("DeleteImage", "stale").Return(op, nil)
+
+		results, err := newProvider(cli).pruneImages(context.Background(), opts)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to remove 1 images: cached: removing image")
+		assert.Equal(t, expected[1:], results)
+		cli.AssertNumberOfCalls(t, "DeleteImage", 2)
+	})
+
+	t.Run("unknown remote", func(t *testing.T) {
+		cli := new(MockIncusServer)
+		_, err := newProvider(cli).pruneImages(context.Background(), pruneOptions{images: []string{"missing:ubuntu/22.04"}})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "parsing image name: missing:ubuntu/22.04")
+		cli.AssertNotCalled(t, "GetImages")
+	})
+}
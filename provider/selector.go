@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-incus/config"
+	"github.com/lxc/incus/shared/api"
+	"github.com/pkg/errors"
+)
+
+// imageSelector selects an image on a simplestreams remote by its properties instead
+// of by alias. Selectors are written as os/release?key=value&key=value, for example
+// ubuntu/22.04?variant=cloud.
+type imageSelector struct {
+	os         string
+	release    string
+	properties url.Values
+}
+
+// isImageSelector returns true if the image name (without the remote) is a selector.
+func isImageSelector(imageName string) bool {
+	return strings.Contains(imageName, "?")
+}
+
+func parseImageSelector(selector string) (imageSelector, error) {
+	path, query, _ := strings.Cut(selector, "?")
+	osName, release, ok := strings.Cut(path, "/")
+	if !ok || osName == "" || release == "" || strings.Contains(release, "/") {
+		return imageSelector{}, runnerErrors.NewBadRequestError("invalid image selector %q, expected os/release?key=value", selector)
+	}
+
+	properties, err := url.ParseQuery(query)
+	if err != nil {
+		return imageSelector{}, runnerErrors.NewBadRequestError("invalid image selector %q: %s", selector, err)
+	}
+	for key, values := range properties {
+		if key == "" || len(values) != 1 || values[0] == "" {
+			return imageSelector{}, runnerErrors.NewBadRequestError("invalid image selector %q: expected a single value for %q", selector, key)
+		}
+	}
+
+	return imageSelector{
+		os:         osName,
+		release:    release,
+		properties: properties,
+	}, nil
+}
+
+// matchesRelease returns true if the image is of the OS and release of the selector.
+// The release may be given either as a name or as a version (jammy or 22.04). Not all
+// remotes set the version property, so the aliases of the image (ubuntu/22.04/cloud)
+// are checked as well.
+func (s imageSelector) matchesRelease(img api.Image) bool {
+	if !strings.EqualFold(img.Properties["os"], s.os) {
+		return false
+	}
+	if img.Properties["release"] == s.release || img.Properties["version"] == s.release {
+		return true
+	}
+	prefix := strings.ToLower(s.os + "/" + s.release)
+	return slices.ContainsFunc(img.Aliases, func(alias api.ImageAlias) bool {
+		name := strings.ToLower(alias.Name)
+		return name == prefix || strings.HasPrefix(name, prefix+"/")
+	})
+}
+
+func (s imageSelector) matches(img api.Image) bool {
+	if !s.matchesRelease(img) {
+		return false
+	}
+	for key := range s.properties {
+		if img.Properties[key] != s.properties.Get(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// imageSelectorName returns the selector that matches only the product the image is
+// part of. It is used to list the images that are available when a selector does not
+// match exactly one product.
+func imageSelectorName(img api.Image) string {
+	name := fmt.Sprintf("%s/%s", strings.ToLower(img.Properties["os"]), img.Properties["release"])
+	if variant := img.Properties["variant"]; variant != "" {
+		name = fmt.Sprintf("%s?variant=%s", name, variant)
+	}
+	return name
+}
+
+// fetchSelectorImages fetches the index of the simplestreams remote a selector is
+// resolved against.
+func (i *image) fetchSelectorImages(remote config.IncusImageRemote, selector string) (imageSelector, []api.Image, error) {
+	if remote.Protocol != config.SimpleStreams {
+		return imageSelector{}, nil, runnerErrors.NewBadRequestError("image selectors can not be used for images on %s remotes", remote.Protocol)
+	}
+
+	parsed, err := parseImageSelector(selector)
+	if err != nil {
+		return imageSelector{}, nil, err
+	}
+
+	srv, err := i.getRemoteImageServer(remote)
+	if err != nil {
+		return imageSelector{}, nil, errors.Wrapf(err, "connecting to remote %s", remote.Address)
+	}
+
+	images, err := srv.GetImages()
+	if err != nil {
+		return imageSelector{}, nil, errors.Wrapf(err, "fetching images from remote %s", remote.Address)
+	}
+	return parsed, images, nil
+}
+
+// resolveImageSelector resolves a selector against the index of a simplestreams remote,
+// for the given image type and architecture.
+func (i *image) resolveImageSelector(remote config.IncusImageRemote, selector string, imageType config.IncusImageType, arch string) (*api.Image, error) {
+	parsed, images, err := i.fetchSelectorImages(remote, selector)
+	if err != nil {
+		return nil, err
+	}
+	return selectImage(selector, parsed, images, imageType, arch)
+}
+
+// resolveImageSelectorFingerprints resolves a selector for every architecture the
+// provider supports and for both image types, and returns the fingerprints of the
+// images it currently resolves to.
+func (i *image) resolveImageSelectorFingerprints(remote config.IncusImageRemote, selector string) ([]string, error) {
+	parsed, images, err := i.fetchSelectorImages(remote, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints := []string{}
+	for _, arch := range slices.Sorted(maps.Values(configToIncusArchMap)) {
+		for _, imageType := range []config.IncusImageType{config.IncusImageContainer, config.IncusImageVirtualMachine} {
+			img, err := selectImage(selector, parsed, images, imageType, arch)
+			if err != nil {
+				continue
+			}
+			fingerprints = append(fingerprints, img.Fingerprint)
+		}
+	}
+	if len(fingerprints) == 0 {
+		return nil, runnerErrors.NewBadRequestError("image selector %s does not match a single image for any architecture and image type", selector)
+	}
+	return fingerprints, nil
+}
+
+// selectImage returns the image a selector resolves to, for the given image type and
+// architecture. The selector must match a single product of the remote, of which the
+// latest build is returned. Otherwise, the error lists the products that are available
+// for the image type and architecture.
+func selectImage(selector string, parsed imageSelector, images []api.Image, imageType config.IncusImageType, arch string) (*api.Image, error) {
+	available := map[string]struct{}{}
+	products := map[string]*api.Image{}
+	for idx := range images {
+		img := &images[idx]
+		if img.Architecture != arch || img.Type != imageType.String() || !parsed.matchesRelease(*img) {
+			continue
+		}
+
+		name := imageSelectorName(*img)
+		available[name] = struct{}{}
+		if !parsed.matches(*img) {
+			continue
+		}
+
+		// Products have a build for every serial the remote still carries.
+		if latest, ok := products[name]; !ok || img.CreatedAt.After(latest.CreatedAt) {
+			products[name] = img
+		}
+	}
+
+	switch len(products) {
+	case 1:
+		for _, img := range products {
+			return img, nil
+		}
+	case 0:
+		if len(available) == 0 {
+			return nil, runnerErrors.NewBadRequestError("no %s/%s images found for arch %s and image type %s", parsed.os, parsed.release, arch, imageType)
+		}
+		return nil, runnerErrors.NewBadRequestError("image selector %s matches no images for arch %s and image type %s, available: %s", selector, arch, imageType, strings.Join(slices.Sorted(maps.Keys(available)), ", "))
+	}
+
+	return nil, runnerErrors.NewBadRequestError("image selector %s matches more than one image for arch %s and image type %s: %s", selector, arch, imageType, strings.Join(slices.Sorted(maps.Keys(products)), ", "))
+}
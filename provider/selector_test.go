@@ -0,0 +1,233 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-incus/config"
+	"github.com/lxc/incus/shared/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseImageSelector(t *testing.T) {
+	tests := []struct {
+		name      string
+		selector  string
+		expected  imageSelector
+		errString string
+	}{
+		{
+			name:     "with variant",
+			selector: "ubuntu/22.04?variant=cloud",
+			expected: imageSelector{
+				os:         "ubuntu",
+				release:    "22.04",
+				properties: map[string][]string{"variant": {"cloud"}},
+			},
+		},
+		{
+			name:     "without properties",
+			selector: "debian/bookworm?",
+			expected: imageSelector{
+				os:         "debian",
+				release:    "bookworm",
+				properties: map[string][]string{},
+			},
+		},
+		{
+			name:      "missing release",
+			selector:  "ubuntu?variant=cloud",
+			errString: `invalid image selector "ubuntu?variant=cloud", expected os/release?key=value`,
+		},
+		{
+			name:      "too many path elements",
+			selector:  "ubuntu/22.04/cloud?variant=cloud",
+			errString: `invalid image selector "ubuntu/22.04/cloud?variant=cloud", expected os/release?key=value`,
+		},
+		{
+			name:      "repeated property",
+			selector:  "ubuntu/22.04?variant=cloud&variant=default",
+			errString: `invalid image selector "ubuntu/22.04?variant=cloud&variant=default": expected a single value for "variant"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := parseImageSelector(tt.selector)
+			if tt.errString != "" {
+				require.Error(t, err)
+				assert.Equal(t, tt.errString, err.Error())
+				assert.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, selector)
+		})
+	}
+}
+
+// simplestreamsImage returns an image shaped like the ones in the index of
+// images.linuxcontainers.org, which only has the release name as property, and the
+// version in the aliases.
+func simplestreamsImage(fingerprint, release, variant, arch, imageType string, createdAt time.Time) api.Image {
+	version := map[string]string{"jammy": "22.04", "noble": "24.04"}[release]
+	aliases := []api.ImageAlias{}
+	for _, name := range []string{release, version} {
+		aliases = append(aliases, api.ImageAlias{Name: fmt.Sprintf("ubuntu/%s/%s", name, variant)})
+		if variant == "default" {
+			aliases = append(aliases, api.ImageAlias{Name: "ubuntu/" + name})
+		}
+	}
+	return api.Image{
+		Fingerprint:  fingerprint,
+		Architecture: arch,
+		Type:         imageType,
+		CreatedAt:    createdAt,
+		Aliases:      aliases,
+		ImagePut: api.ImagePut{
+			Properties: map[string]string{
+				"os":      "Ubuntu",
+				"release": release,
+				"variant": variant,
+			},
+		},
+	}
+}
+
+func TestGetInstanceSourceSelector(t *testing.T) {
+	older := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(24 * time.Hour)
+
+	srv := new(MockIncusServer)
+	i := &image{
+		remotes: map[string]config.IncusImageRemote{
+			"images": {
+				Address:  "https://images.linuxcontainers.org",
+				Public:   true,
+				Protocol: config.SimpleStreams,
+			},
+			"docker": {
+				Address:  "https://docker.io",
+				Public:   true,
+				Protocol: config.OCI,
+			},
+		},
+		connectRemote: func(config.IncusImageRemote) (ImageServerInterface, error) {
+			return srv, nil
+		},
+	}
+	srv.On("GetImages").Return([]api.Image{
+		simplestreamsImage("aaa111", "jammy", "cloud", "x86_64", "container", older),
+		simplestreamsImage("aaa222", "jammy", "cloud", "x86_64", "container", newer),
+		simplestreamsImage("bbb111", "jammy", "default", "x86_64", "container", newer),
+		simplestreamsImage("ccc111", "jammy", "cloud", "x86_64", "virtual-machine", newer),
+		simplestreamsImage("ddd111", "jammy", "default", "aarch64", "container", newer),
+		simplestreamsImage("eee111", "noble", "cloud", "x86_64", "container", newer),
+	}, nil)
+
+	tests := []struct {
+		name      string
+		image     string
+		imageType config.IncusImageType
+		arch      string
+		expected  api.InstanceSource
+		errString string
+	}{
+		{
+			name:      "latest build of the variant",
+			image:     "images:ubuntu/22.04?variant=cloud",
+			imageType: config.IncusImageContainer,
+			arch:      "x86_64",
+			expected: api.InstanceSource{
+				Type:        "image",
+				Server:      "https://images.linuxcontainers.org",
+				Protocol:    "simplestreams",
+				Fingerprint: "aaa222",
+			},
+		},
+		{
+			name:      "release name",
+			image:     "images:ubuntu/jammy?variant=cloud",
+			imageType: config.IncusImageVirtualMachine,
+			arch:      "x86_64",
+			expected: api.InstanceSource{
+				Type:        "image",
+				Server:      "https://images.linuxcontainers.org",
+				Protocol:    "simplestreams",
+				Fingerprint: "ccc111",
+			},
+		},
+		{
+			name:      "single match without variant",
+			image:     "images:ubuntu/22.04?",
+			imageType: config.IncusImageContainer,
+			arch:      "aarch64",
+			expected: api.InstanceSource{
+				Type:        "image",
+				Server:      "https://images.linuxcontainers.org",
+				Protocol:    "simplestreams",
+				Fingerprint: "ddd111",
+			},
+		},
+		{
+			name:      "ambiguous selector",
+			image:     "images:ubuntu/22.04?",
+			imageType: config.IncusImageContainer,
+			arch:      "x86_64",
+			errString: "image selector ubuntu/22.04? matches more than one image for arch x86_64 and image type container: ubuntu/jammy?variant=cloud, ubuntu/jammy?variant=default",
+		},
+		{
+			name:      "missing variant",
+			image:     "images:ubuntu/22.04?variant=cloud",
+			imageType: config.IncusImageContainer,
+			arch:      "aarch64",
+			errString: "image selector ubuntu/22.04?variant=cloud matches no images for arch aarch64 and image type container, available: ubuntu/jammy?variant=default",
+		},
+		{
+			name:      "missing release",
+			image:     "images:ubuntu/20.04?variant=cloud",
+			imageType: config.IncusImageContainer,
+			arch:      "x86_64",
+			errString: "no ubuntu/20.04 images found for arch x86_64 and image type container",
+		},
+		{
+			name:      "OCI remote",
+			image:     "docker:ubuntu/22.04?variant=cloud",
+			imageType: config.IncusImageContainer,
+			arch:      "x86_64",
+			errString: "image selectors can not be used for images on oci remotes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := i.getInstanceSource(tt.image, tt.imageType, tt.arch, new(MockIncusServer))
+			if tt.errString != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errString)
+				assert.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, source)
+		})
+	}
+}
@@ -18,17 +18,55 @@ package provider
 import (
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/cloudbase/garm-provider-common/cloudconfig"
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
 	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-incus/config"
+	"github.com/lxc/incus/shared/units"
 	"github.com/pkg/errors"
 	"github.com/xeipuuv/gojsonschema"
 )
 
+// fingerprintRegex matches image fingerprints, or prefixes of them long enough to be
+// unambiguous.
+var fingerprintRegex = regexp.MustCompile(`^[0-9a-f]{12,64}$`)
+
 type extraSpecs struct {
 	ExtraPackages   []string `json:"extra_packages,omitempty" jsonschema:"description=A list of packages that cloud-init should install on the instance."`
 	DisableUpdates  bool     `json:"disable_updates,omitempty" jsonschema:"description=Whether to disable updates when cloud-init comes online."`
 	EnableBootDebug bool     `json:"enable_boot_debug,omitempty" jsonschema:"description=Allows providers to set the -x flag in the runner install script."`
+	// InstanceType overrides the instance type set in the provider config.
+	InstanceType config.IncusImageType `json:"instance_type,omitempty" jsonschema:"enum=virtual-machine,enum=container,description=The type of instance to create for this pool. Overrides the instance_type set in the provider config."`
+	// Resource limits are layered on top of the profile selected by the flavor.
+	CPU          uint   `json:"cpu,omitempty" jsonschema:"description=The number of CPUs the instance can use. Sets limits.cpu on the instance."`
+	Memory       string `json:"memory,omitempty" jsonschema:"description=The amount of memory the instance can use (ex: 4GiB or 50%). Sets limits.memory on the instance."`
+	Processes    uint   `json:"processes,omitempty" jsonschema:"description=The maximum number of processes that can run in a container. Sets limits.processes on the instance. Can not be used with virtual machines."`
+	RootDiskSize string `json:"root_disk_size,omitempty" jsonschema:"description=The size of the root disk of the instance (ex: 20GiB)."`
+	RootDiskPool string `json:"root_disk_pool,omitempty" jsonschema:"description=The storage pool of the root disk. Defaults to the pool of the root disk defined in the profiles."`
+	// Raw config keys and devices are subject to the passthrough policy in the
+	// provider config.
+	Config  map[string]string            `json:"config,omitempty" jsonschema:"description=Raw Incus config keys to set on the instance. Only keys allowed by the provider config may be used."`
+	Devices map[string]map[string]string `json:"devices,omitempty" jsonschema:"description=Raw Incus devices to add to the instance. Only device types allowed by the provider config may be used."`
+	// The cloud-init settings override the ones in the provider config.
+	UseCloudInitKeys *bool  `json:"use_cloud_init_keys,omitempty" jsonschema:"description=Use the cloud-init.* config keys instead of the legacy user.* keys for the cloud-init data. Overrides use_cloud_init_keys in the provider config."`
+	VendorData       string `json:"vendor_data,omitempty" jsonschema:"description=The cloud-init vendor data set on the instance. Overrides the vendor_data set in the provider config."`
+	NetworkConfig    string `json:"network_config,omitempty" jsonschema:"description=The cloud-init network config set on the instance. Overrides the network_config set in the provider config."`
+	// GoldenInstance replaces the image of the pool as the source of new runners.
+	GoldenInstance string `json:"golden_instance,omitempty" jsonschema:"description=A stopped instance (or instance/snapshot) you prepared in the project that new runners are cloned from instead of being created from the pool image. The runner should be pre-installed in /home/runner/actions-runner."`
+	// GoldenTemplate has the provider build and maintain the golden instance of the pool.
+	GoldenTemplate bool `json:"golden_template,omitempty" jsonschema:"description=Have the provider keep a golden template of the pool, created from the pool image with the runner pre-installed, that new runners are cloned from. The template is rebuilt when the image or the runner version changes. Only supports linux."`
+	// WarmPoolSize is the number of clones kept booted for the pool.
+	WarmPoolSize uint `json:"warm_pool_size,omitempty" jsonschema:"description=The number of clones of the golden instance or template that are kept booted. New runners claim one of them and are registered through the Incus exec API. Requires golden_instance or golden_template. Only supports linux."`
+	// ImageFingerprint pins the image of the pool to a specific build.
+	ImageFingerprint string `json:"image_fingerprint,omitempty" jsonschema:"description=The fingerprint (or a prefix of at least 12 characters) the image of the pool is expected to resolve to. Runners are not created if the image resolves to a different fingerprint."`
+	// BootstrapMode overrides the bootstrap mode set in the provider config.
+	BootstrapMode config.BootstrapMode `json:"bootstrap_mode,omitempty" jsonschema:"enum=cloud-init,enum=exec,description=How the runner install script is run on the instance. Use exec for images without cloud-init. Overrides the bootstrap_mode set in the provider config."`
 	cloudconfig.CloudConfigSpec
 }
 
@@ -59,5 +97,143 @@ func parseExtraSpecsFromBootstrapParams(bootstrapParams commonParams.BootstrapIn
 	if err := json.Unmarshal(bootstrapParams.ExtraSpecs, &specs); err != nil {
 		return specs, errors.Wrap(err, "unmarshaling extra specs")
 	}
+
+	if err := specs.validate(); err != nil {
+		return extraSpecs{}, errors.Wrap(err, "validating extra specs")
+	}
 	return specs, nil
 }
+
+// validate checks the values that can not be expressed in the JSON schema.
+func (e extraSpecs) validate() error {
+	if e.Memory != "" {
+		if pct, ok := strings.CutSuffix(e.Memory, "%"); ok {
+			if val, err := strconv.Atoi(pct); err != nil || val <= 0 || val > 100 {
+				return fmt.Errorf("invalid memory percentage: %s", e.Memory)
+			}
+		} else if _, err := units.ParseByteSizeString(e.Memory); err != nil {
+			return errors.Wrapf(err, "parsing memory")
+		}
+	}
+
+	if e.RootDiskSize != "" {
+		if _, err := units.ParseByteSizeString(e.RootDiskSize); err != nil {
+			return errors.Wrapf(err, "parsing root_disk_size")
+		}
+	}
+
+	if e.BootstrapMode == config.BootstrapExec {
+		if err := e.checkExecBootstrap(); err != nil {
+			return err
+		}
+	}
+
+	if e.InstanceType != "" {
+		if err := e.checkInstanceType(e.InstanceType); err != nil {
+			return err
+		}
+	}
+
+	if e.ImageFingerprint != "" {
+		if !fingerprintRegex.MatchString(e.ImageFingerprint) {
+			return fmt.Errorf("invalid image_fingerprint %s: expected at least 12 hexadecimal characters", e.ImageFingerprint)
+		}
+		if e.GoldenInstance != "" {
+			return fmt.Errorf("image_fingerprint can not be used with golden_instance")
+		}
+	}
+
+	if e.GoldenTemplate && e.GoldenInstance != "" {
+		return fmt.Errorf("golden_template can not be used with golden_instance")
+	}
+
+	if e.WarmPoolSize > 0 {
+		if !e.GoldenTemplate && e.GoldenInstance == "" {
+			return fmt.Errorf("warm_pool_size requires golden_instance or golden_template")
+		}
+		// Runners claimed from the warm pool are already booted, so they are always
+		// registered through the exec API.
+		if err := e.checkExecBootstrap(); err != nil {
+			return errors.Wrap(err, "checking warm pool")
+		}
+	}
+	return nil
+}
+
+// checkExecBootstrap makes sure that no specs handled by cloud-init are set, as they
+// would be silently ignored in the exec bootstrap mode.
+func (e extraSpecs) checkExecBootstrap() error {
+	unsupported := []string{}
+	if len(e.ExtraPackages) > 0 {
+		unsupported = append(unsupported, "extra_packages")
+	}
+	if e.DisableUpdates {
+		unsupported = append(unsupported, "disable_updates")
+	}
+	if e.UseCloudInitKeys != nil {
+		unsupported = append(unsupported, "use_cloud_init_keys")
+	}
+	if e.VendorData != "" {
+		unsupported = append(unsupported, "vendor_data")
+	}
+	if e.NetworkConfig != "" {
+		unsupported = append(unsupported, "network_config")
+	}
+	if len(unsupported) > 0 {
+		last := len(unsupported) - 1
+		specs := unsupported[last]
+		if last > 0 {
+			specs = strings.Join(unsupported[:last], ", ") + " and " + specs
+		}
+		return runnerErrors.NewBadRequestError("%s can not be used with the %s bootstrap mode", specs, config.BootstrapExec)
+	}
+	return nil
+}
+
+// checkInstanceType makes sure that no specs only supported by containers are set
+// for virtual machines, as Incus refuses to create the instance.
+func (e extraSpecs) checkInstanceType(instanceType config.IncusImageType) error {
+	if e.Processes > 0 && instanceType == config.IncusImageVirtualMachine {
+		return runnerErrors.NewBadRequestError("processes can only be used with %s instances", config.IncusImageContainer)
+	}
+	return nil
+}
+
+// limitsConfig returns the instance config keys for the resource limits set in
+// the extra specs.
+func (e extraSpecs) limitsConfig() map[string]string {
+	ret := map[string]string{}
+	if e.CPU > 0 {
+		ret["limits.cpu"] = strconv.FormatUint(uint64(e.CPU), 10)
+	}
+	if e.Memory != "" {
+		ret["limits.memory"] = e.Memory
+	}
+	if e.Processes > 0 {
+		ret["limits.processes"] = strconv.FormatUint(uint64(e.Processes), 10)
+	}
+	return ret
+}
+
+// checkPassthrough makes sure that the raw config keys and devices in the extra specs
+// are allowed by the passthrough policy set by the operator in the provider config.
+func checkPassthrough(specs extraSpecs, policy config.Passthrough) error {
+	denied := []string{}
+	for key := range specs.Config {
+		if slices.Contains(providerManagedConfigKeys, key) || !policy.IsConfigKeyAllowed(key) {
+			denied = append(denied, fmt.Sprintf("config key %s", key))
+		}
+	}
+
+	for name, device := range specs.Devices {
+		if !policy.IsDeviceTypeAllowed(device["type"]) {
+			denied = append(denied, fmt.Sprintf("device %s of type %q", name, device["type"]))
+		}
+	}
+
+	if len(denied) > 0 {
+		sort.Strings(denied)
+		return runnerErrors.NewBadRequestError("not allowed by the provider passthrough policy: %s", strings.Join(denied, ", "))
+	}
+	return nil
+}
@@ -21,6 +21,7 @@ import (
 
 	"github.com/cloudbase/garm-provider-common/cloudconfig"
 	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-incus/config"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -104,6 +105,76 @@ var testCases = []struct {
 		},
 		errString: "",
 	},
+	{
+		name:  "specs just with instance_type",
+		input: json.RawMessage(`{"instance_type": "container"}`),
+		expectedOutput: extraSpecs{
+			InstanceType: config.IncusImageContainer,
+		},
+		errString: "",
+	},
+	{
+		name:  "specs with resource limits",
+		input: json.RawMessage(`{"cpu": 4, "memory": "8GiB", "processes": 500, "root_disk_size": "20GiB", "root_disk_pool": "fast"}`),
+		expectedOutput: extraSpecs{
+			CPU:          4,
+			Memory:       "8GiB",
+			Processes:    500,
+			RootDiskSize: "20GiB",
+			RootDiskPool: "fast",
+		},
+		errString: "",
+	},
+	{
+		name:  "specs with memory percentage",
+		input: json.RawMessage(`{"memory": "50%"}`),
+		expectedOutput: extraSpecs{
+			Memory: "50%",
+		},
+		errString: "",
+	},
+	{
+		name:  "specs with raw config and devices",
+		input: json.RawMessage(`{"config": {"linux.kernel_modules": "overlay"}, "devices": {"web": {"type": "proxy"}}}`),
+		expectedOutput: extraSpecs{
+			Config: map[string]string{
+				"linux.kernel_modules": "overlay",
+			},
+			Devices: map[string]map[string]string{
+				"web": {
+					"type": "proxy",
+				},
+			},
+		},
+		errString: "",
+	},
+	{
+		name:  "specs with cloud-init settings",
+		input: json.RawMessage(`{"use_cloud_init_keys": false, "vendor_data": "#cloud-config\npackages: [jq]", "network_config": "version: 2"}`),
+		expectedOutput: extraSpecs{
+			UseCloudInitKeys: ptr(false),
+			VendorData:       "#cloud-config\npackages: [jq]",
+			NetworkConfig:    "version: 2",
+		},
+		errString: "",
+	},
+	{
+		name:  "specs with image fingerprint",
+		input: json.RawMessage(`{"image_fingerprint": "4a3f5b2c1d0e"}`),
+		expectedOutput: extraSpecs{
+			ImageFingerprint: "4a3f5b2c1d0e",
+		},
+		errString: "",
+	},
+	{
+		name:  "specs with golden template and warm pool",
+		input: json.RawMessage(`{"golden_template": true, "warm_pool_size": 3}`),
+		expectedOutput: extraSpecs{
+			GoldenTemplate: true,
+			WarmPoolSize:   3,
+		},
+		errString: "",
+	},
 	{
 		name:           "empty specs",
 		input:          json.RawMessage(`{}`),
@@ -152,6 +223,90 @@ var testCases = []struct {
 		expectedOutput: extraSpecs{},
 		errString:      "schema validation failed: [extra_context: Invalid type. Expected: object, given: array]",
 	},
+	{
+		name:           "invalid input for instance_type - unknown instance type",
+		input:          json.RawMessage(`{"instance_type": "bogus"}`),
+		expectedOutput: extraSpecs{},
+		errString:      "schema validation failed: [instance_type: instance_type must be one of the following: \"virtual-machine\", \"container\"]",
+	},
+	{
+		name:           "invalid input for memory - bad size",
+		input:          json.RawMessage(`{"memory": "lots"}`),
+		expectedOutput: extraSpecs{},
+		errString:      "validating extra specs: parsing memory",
+	},
+	{
+		name:           "invalid input for memory - bad percentage",
+		input:          json.RawMessage(`{"memory": "150%"}`),
+		expectedOutput: extraSpecs{},
+		errString:      "invalid memory percentage: 150%",
+	},
+	{
+		name:           "invalid input for root_disk_size - bad size",
+		input:          json.RawMessage(`{"root_disk_size": "20 apples"}`),
+		expectedOutput: extraSpecs{},
+		errString:      "validating extra specs: parsing root_disk_size",
+	},
+	{
+		name:           "invalid input for cpu - wrong data type",
+		input:          json.RawMessage(`{"cpu": "4"}`),
+		expectedOutput: extraSpecs{},
+		errString:      "schema validation failed: [cpu: Invalid type. Expected: integer, given: string]",
+	},
+	{
+		name:           "invalid input for image_fingerprint - too short",
+		input:          json.RawMessage(`{"image_fingerprint": "4a3f"}`),
+		expectedOutput: extraSpecs{},
+		errString:      "invalid image_fingerprint 4a3f: expected at least 12 hexadecimal characters",
+	},
+	{
+		name:           "invalid input for image_fingerprint - used with golden_instance",
+		input:          json.RawMessage(`{"image_fingerprint": "4a3f5b2c1d0e", "golden_instance": "golden"}`),
+		expectedOutput: extraSpecs{},
+		errString:      "image_fingerprint can not be used with golden_instance",
+	},
+	{
+		name:           "invalid input for golden_template - used with golden_instance",
+		input:          json.RawMessage(`{"golden_template": true, "golden_instance": "golden"}`),
+		expectedOutput: extraSpecs{},
+		errString:      "golden_template can not be used with golden_instance",
+	},
+	{
+		name:           "invalid input for warm_pool_size - no golden instance",
+		input:          json.RawMessage(`{"warm_pool_size": 2}`),
+		expectedOutput: extraSpecs{},
+		errString:      "warm_pool_size requires golden_instance or golden_template",
+	},
+	{
+		name:           "invalid input for warm_pool_size - cloud-init specs",
+		input:          json.RawMessage(`{"golden_instance": "golden", "warm_pool_size": 2, "extra_packages": ["curl"]}`),
+		expectedOutput: extraSpecs{},
+		errString:      "checking warm pool: extra_packages can not be used with the exec bootstrap mode",
+	},
+	{
+		name:           "invalid input for bootstrap_mode - cloud-init specs in exec mode",
+		input:          json.RawMessage(`{"bootstrap_mode": "exec", "extra_packages": ["curl"], "disable_updates": true}`),
+		expectedOutput: extraSpecs{},
+		errString:      "extra_packages and disable_updates can not be used with the exec bootstrap mode",
+	},
+	{
+		name:           "invalid input for bootstrap_mode - cloud-init data in exec mode",
+		input:          json.RawMessage(`{"bootstrap_mode": "exec", "use_cloud_init_keys": true, "vendor_data": "#cloud-config", "network_config": "version: 2"}`),
+		expectedOutput: extraSpecs{},
+		errString:      "use_cloud_init_keys, vendor_data and network_config can not be used with the exec bootstrap mode",
+	},
+	{
+		name:           "invalid input for bootstrap_mode - vendor data in exec mode",
+		input:          json.RawMessage(`{"bootstrap_mode": "exec", "vendor_data": "#cloud-config"}`),
+		expectedOutput: extraSpecs{},
+		errString:      "vendor_data can not be used with the exec bootstrap mode",
+	},
+	{
+		name:           "invalid input for processes - virtual machine instance type",
+		input:          json.RawMessage(`{"instance_type": "virtual-machine", "processes": 500}`),
+		expectedOutput: extraSpecs{},
+		errString:      "processes can only be used with container instances",
+	},
 	{
 		name:           "invalid input - additional property",
 		input:          json.RawMessage(`{"additional_property": true}`),
@@ -174,3 +329,104 @@ func TestParseExtraSpecsFromBootstrapParams(t *testing.T) {
 		})
 	}
 }
+
+func TestLimitsConfig(t *testing.T) {
+	specs := extraSpecs{
+		CPU:       2,
+		Memory:    "4GiB",
+		Processes: 100,
+	}
+	assert.Equal(t, map[string]string{
+		"limits.cpu":       "2",
+		"limits.memory":    "4GiB",
+		"limits.processes": "100",
+	}, specs.limitsConfig())
+	assert.Equal(t, map[string]string{}, extraSpecs{}.limitsConfig())
+}
+
+func TestCheckPassthrough(t *testing.T) {
+	policy := config.Passthrough{
+		AllowedConfigPrefixes: []string{"linux.", "user."},
+		AllowedDeviceTypes:    []string{"proxy"},
+	}
+	tests := []struct {
+		name      string
+		specs     extraSpecs
+		policy    config.Passthrough
+		errString string
+	}{
+		{
+			name:   "nothing to pass through",
+			specs:  extraSpecs{},
+			policy: config.Passthrough{},
+		},
+		{
+			name: "allowed keys and devices",
+			specs: extraSpecs{
+				Config: map[string]string{
+					"linux.kernel_modules": "overlay",
+				},
+				Devices: map[string]map[string]string{
+					"web": {
+						"type":    "proxy",
+						"listen":  "tcp:0.0.0.0:80",
+						"connect": "tcp:127.0.0.1:80",
+					},
+				},
+			},
+			policy: policy,
+		},
+		{
+			name: "passthrough disabled",
+			specs: extraSpecs{
+				Config: map[string]string{
+					"linux.kernel_modules": "overlay",
+				},
+			},
+			policy:    config.Passthrough{},
+			errString: "not allowed by the provider passthrough policy: config key linux.kernel_modules",
+		},
+		{
+			name: "denied keys and devices",
+			specs: extraSpecs{
+				Config: map[string]string{
+					"security.privileged": "true",
+					controllerIDKeyName:   "other-controller",
+				},
+				Devices: map[string]map[string]string{
+					"host": {
+						"type":   "disk",
+						"source": "/",
+						"path":   "/host",
+					},
+				},
+			},
+			policy:    policy,
+			errString: `config key security.privileged, config key user.runner-controller-id, device host of type "disk"`,
+		},
+		{
+			name: "cloud-init keys",
+			specs: extraSpecs{
+				Config: map[string]string{
+					"cloud-init.vendor-data": "#cloud-config",
+				},
+			},
+			policy: config.Passthrough{
+				AllowedConfigPrefixes: []string{"cloud-init."},
+			},
+			errString: "config key cloud-init.vendor-data",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPassthrough(tt.specs, tt.policy)
+			if tt.errString != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errString)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
@@ -16,23 +16,30 @@
 package provider
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"log"
+	"maps"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
 	commonParams "github.com/cloudbase/garm-provider-common/params"
 
 	"github.com/cloudbase/garm-provider-common/util"
 	"github.com/cloudbase/garm-provider-incus/config"
 
 	"github.com/invopop/jsonschema"
-	"github.com/juju/clock"
-	"github.com/juju/retry"
 	incus "github.com/lxc/incus/client"
 	"github.com/lxc/incus/shared/api"
 	"github.com/pkg/errors"
@@ -90,10 +97,12 @@ func incusInstanceToAPIInstance(instance *api.InstanceFull) commonParams.Provide
 	}
 	instanceArch := incusToConfigArch[instance.Architecture]
 
+	// Runners claimed from a warm pool keep the name of the warm clone, so the name
+	// of the runner is taken from their config.
 	return commonParams.ProviderInstance{
 		OSArch:     instanceArch,
 		ProviderID: instance.Name,
-		Name:       instance.Name,
+		Name:       cmp.Or(instance.ExpandedConfig[runnerNameKeyName], instance.Name),
 		OSType:     osType,
 		OSName:     strings.ToLower(incusOS),
 		OSVersion:  osRelease,
@@ -108,6 +117,8 @@ func incusStatusToProviderStatus(status string) commonParams.InstanceStatus {
 		return commonParams.InstanceRunning
 	case "Stopped":
 		return commonParams.InstanceStopped
+	case "Error":
+		return commonParams.InstanceError
 	default:
 		return commonParams.InstanceStatusUnknown
 	}
@@ -118,12 +129,65 @@ func getClientFromConfig(ctx context.Context, cfg *config.Incus) (cli incus.Inst
 		return nil, fmt.Errorf("no Incus configuration found")
 	}
 
-	if cfg.UnixSocket != "" {
-		return incus.ConnectIncusUnixWithContext(ctx, cfg.UnixSocket, &incus.ConnectionArgs{SkipGetServer: true})
+	endpoints := cfg.GetEndpoints()
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no URL or UnixSocket specified")
 	}
 
-	if cfg.URL == "" {
-		return nil, fmt.Errorf("no URL or UnixSocket specified")
+	if len(endpoints) == 1 {
+		return connectEndpoint(ctx, cfg, endpoints[0])
+	}
+
+	// With more than one endpoint, we need to make sure the one we pick actually
+	// responds, otherwise we would never fail over to the next one. GARM runs the
+	// provider in a new process for every call, so nothing we find out here outlives
+	// the call. All endpoints are checked in parallel, so endpoints that are down
+	// delay each call by at most endpointHealthCheckTimeout, no matter how many
+	// of them there are.
+	results := make([]chan error, len(endpoints))
+	for idx, endpoint := range endpoints {
+		results[idx] = make(chan error, 1)
+		go func() {
+			results[idx] <- checkEndpointHealth(ctx, cfg, endpoint)
+		}()
+	}
+
+	endpointErrors := make([]string, 0, len(endpoints))
+	for idx, endpoint := range endpoints {
+		if err := <-results[idx]; err != nil {
+			endpointErrors = append(endpointErrors, fmt.Sprintf("%s: %s", endpoint, err))
+			continue
+		}
+
+		return connectEndpoint(ctx, cfg, endpoint)
+	}
+	return nil, fmt.Errorf("failed to connect to any Incus endpoint: %s", strings.Join(endpointErrors, "; "))
+}
+
+// checkEndpointHealth connects to the endpoint and fetches the server info. The
+// client used here is discarded, as the Incus client holds on to the context it was
+// created with, and we don't want the timeout to apply to all future requests.
+func checkEndpointHealth(ctx context.Context, cfg *config.Incus, endpoint string) error {
+	healthCtx, cancel := context.WithTimeout(ctx, endpointHealthCheckTimeout)
+	defer cancel()
+
+	cli, err := connectEndpoint(healthCtx, cfg, endpoint)
+	if err != nil {
+		return err
+	}
+	defer cli.Disconnect()
+
+	if _, _, err := cli.GetServer(); err != nil {
+		return errors.Wrap(err, "fetching server info")
+	}
+	return nil
+}
+
+// connectEndpoint returns a client for a single Incus endpoint, which can be either
+// a unix socket or an https URL.
+func connectEndpoint(ctx context.Context, cfg *config.Incus, endpoint string) (cli incus.InstanceServer, err error) {
+	if socket, ok := config.UnixSocketPath(endpoint); ok {
+		return incus.ConnectIncusUnixWithContext(ctx, socket, &incus.ConnectionArgs{SkipGetServer: true})
 	}
 
 	var srvCrtContents, tlsCAContents, clientCertContents, clientKeyContents []byte
@@ -164,7 +228,7 @@ func getClientFromConfig(ctx context.Context, cfg *config.Incus) (cli incus.Inst
 		SkipGetServer: true,
 	}
 
-	incusCLI, err := incus.ConnectIncus(cfg.URL, &connectArgs)
+	incusCLI, err := incus.ConnectIncusWithContext(ctx, endpoint, &connectArgs)
 	if err != nil {
 		return nil, errors.Wrap(err, "connecting to Incus")
 	}
@@ -172,6 +236,60 @@ func getClientFromConfig(ctx context.Context, cfg *config.Incus) (cli incus.Inst
 	return incusCLI, nil
 }
 
+// getImageServerFromRemote connects to an image remote that uses the incus or the
+// simplestreams protocol.
+func getImageServerFromRemote(remote config.IncusImageRemote) (incus.ImageServer, error) {
+	connectArgs := incus.ConnectionArgs{
+		InsecureSkipVerify: remote.InsecureSkipVerify,
+		SkipGetServer:      true,
+	}
+
+	switch remote.Protocol {
+	case config.SimpleStreams:
+		srv, err := incus.ConnectSimpleStreams(remote.Address, &connectArgs)
+		if err != nil {
+			return nil, errors.Wrap(err, "connecting to remote")
+		}
+		return srv, nil
+	case config.IncusProtocol:
+	default:
+		return nil, fmt.Errorf("connecting to %s remotes is not supported", remote.Protocol)
+	}
+
+	if remote.TLSServerCert != "" {
+		srvCrtContents, err := os.ReadFile(remote.TLSServerCert)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading TLSServerCert")
+		}
+		connectArgs.TLSServerCert = string(srvCrtContents)
+	}
+
+	if remote.Public {
+		srv, err := incus.ConnectPublicIncus(remote.Address, &connectArgs)
+		if err != nil {
+			return nil, errors.Wrap(err, "connecting to remote")
+		}
+		return srv, nil
+	}
+
+	clientCertContents, err := os.ReadFile(remote.ClientCertificate)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading ClientCertificate")
+	}
+	clientKeyContents, err := os.ReadFile(remote.ClientKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading ClientKey")
+	}
+	connectArgs.TLSClientCert = string(clientCertContents)
+	connectArgs.TLSClientKey = string(clientKeyContents)
+
+	srv, err := incus.ConnectIncus(remote.Address, &connectArgs)
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting to remote")
+	}
+	return srv, nil
+}
+
 func projectName(cfg *config.Incus) string {
 	if cfg != nil && cfg.ProjectName != "" {
 		return cfg.ProjectName
@@ -179,6 +297,89 @@ func projectName(cfg *config.Incus) string {
 	return DefaultProjectName
 }
 
+// managedProjectConfig returns the project config keys managed by the provider. An
+// empty value means the key must not be set on the project.
+func managedProjectConfig(project config.ManagedProject) map[string]string {
+	ret := map[string]string{
+		"features.images":          strconv.FormatBool(project.Features.GetImages()),
+		"features.profiles":        strconv.FormatBool(project.Features.GetProfiles()),
+		"features.networks":        strconv.FormatBool(project.Features.Networks),
+		"features.storage.volumes": strconv.FormatBool(project.Features.StorageVolumes),
+		"limits.instances":         "",
+		"limits.cpu":               "",
+		"limits.memory":            project.Limits.Memory,
+	}
+	if project.Limits.Instances > 0 {
+		ret["limits.instances"] = strconv.FormatUint(uint64(project.Limits.Instances), 10)
+	}
+	if project.Limits.CPU > 0 {
+		ret["limits.cpu"] = strconv.FormatUint(uint64(project.Limits.CPU), 10)
+	}
+	return ret
+}
+
+// flavorToProfile translates a flavor from the provider config into an Incus profile.
+func flavorToProfile(flavor config.Flavor) api.ProfilePut {
+	profileConfig := map[string]string{}
+	maps.Copy(profileConfig, flavor.Config)
+	if flavor.CPU > 0 {
+		profileConfig["limits.cpu"] = strconv.FormatUint(uint64(flavor.CPU), 10)
+	}
+	if flavor.Memory != "" {
+		profileConfig["limits.memory"] = flavor.Memory
+	}
+
+	devices := map[string]map[string]string{}
+	if flavor.DiskPool != "" {
+		devices["root"] = map[string]string{
+			"type": "disk",
+			"path": "/",
+			"pool": flavor.DiskPool,
+		}
+		if flavor.DiskSize != "" {
+			devices["root"]["size"] = flavor.DiskSize
+		}
+	}
+
+	for name, nic := range flavor.NICs {
+		device := map[string]string{
+			"type": "nic",
+			"name": name,
+		}
+		if nic.Network != "" {
+			device["network"] = nic.Network
+		} else {
+			device["nictype"] = nic.NICType
+			device["parent"] = nic.Parent
+		}
+		devices[name] = device
+	}
+
+	description := flavor.Description
+	if description == "" {
+		description = "Flavor managed by garm"
+	}
+
+	return api.ProfilePut{
+		Description: description,
+		Config:      profileConfig,
+		Devices:     devices,
+	}
+}
+
+// profileMatches returns true if the current profile matches the desired one.
+func profileMatches(current, desired api.ProfilePut) bool {
+	if current.Description != desired.Description {
+		return false
+	}
+	if !maps.Equal(current.Config, desired.Config) {
+		return false
+	}
+	return maps.EqualFunc(current.Devices, desired.Devices, func(a, b map[string]string) bool {
+		return maps.Equal(a, b)
+	})
+}
+
 func resolveArchitecture(osArch commonParams.OSArch) (string, error) {
 	if string(osArch) == "" {
 		return configToIncusArchMap[commonParams.Amd64], nil
@@ -190,40 +391,205 @@ func resolveArchitecture(osArch commonParams.OSArch) (string, error) {
 	return arch, nil
 }
 
-// waitDeviceActive is a function capable of figuring out when a Equinix Metal
-// device is active
+// isInstanceEvent returns true if the event may signal a change in the state or the
+// addresses of the instance. Network events are included, as a change to the network
+// the instance is attached to may change its addresses.
+func isInstanceEvent(instanceName string, event api.Event) bool {
+	if event.Type != api.EventTypeLifecycle {
+		return false
+	}
+
+	lifecycle := api.EventLifecycle{}
+	if err := json.Unmarshal(event.Metadata, &lifecycle); err != nil {
+		return false
+	}
+
+	if strings.HasPrefix(lifecycle.Action, "network-") {
+		return true
+	}
+
+	source, err := url.Parse(lifecycle.Source)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(source.Path, "/1.0/instances/") && path.Base(source.Path) == instanceName
+}
+
+// watchInstanceEvents subscribes to the Incus event stream and sends a notification on
+// the returned channel every time an event concerning the instance is received. The
+// returned function must be called to stop watching.
+func watchInstanceEvents(cli InstanceServerInterface, instanceName string) (<-chan struct{}, func(), error) {
+	listener, err := cli.GetEvents()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "fetching event listener")
+	}
+
+	notify := make(chan struct{}, 1)
+	_, err = listener.AddHandler([]string{api.EventTypeLifecycle}, func(event api.Event) {
+		if !isInstanceEvent(instanceName, event) {
+			return
+		}
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		listener.Disconnect()
+		return nil, nil, errors.Wrap(err, "adding event handler")
+	}
+	return notify, listener.Disconnect, nil
+}
+
+func hasIPv4Address(instance commonParams.ProviderInstance) bool {
+	for _, addr := range instance.Addresses {
+		ip := net.ParseIP(addr.Address)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() == nil {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// waitInstanceHasIP waits for the instance to get an IPv4 address. The instance is
+// checked every time Incus sends an event about it, and periodically, as acquiring a
+// DHCP lease does not generate any event. If the event stream is not available, we
+// log why and fall back to polling. Instances that stop or end up in error state
+// will never get an address, so we give up on them right away.
 func (l *Incus) waitInstanceHasIP(ctx context.Context, instanceName string) (commonParams.ProviderInstance, error) {
-	var p commonParams.ProviderInstance
-	var errIPNotFound error = fmt.Errorf("ip not found")
-	err := retry.Call(retry.CallArgs{
-		Func: func() error {
-			var err error
-			p, err = l.GetInstance(ctx, instanceName)
-			if err != nil {
-				return errors.Wrap(err, "fetching instance")
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return commonParams.ProviderInstance{}, errors.Wrap(err, "fetching client")
+	}
+
+	timeout := l.cfg.GetIPWaitTimeout()
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	notify, stop, err := watchInstanceEvents(cli, instanceName)
+	if err != nil {
+		log.Printf("failed to watch events of instance %s, polling instead: %s", instanceName, err)
+		notify = nil
+	} else {
+		defer stop()
+	}
+
+	ticker := time.NewTicker(ipPollInterval)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		var instance commonParams.ProviderInstance
+		instanceFull, err := l.getInstanceFull(waitCtx, instanceName)
+		if err == nil {
+			instance = incusInstanceToAPIInstance(instanceFull)
+		}
+		switch {
+		case err == nil:
+			if hasIPv4Address(instance) {
+				return instance, nil
 			}
-			for _, addr := range p.Addresses {
-				ip := net.ParseIP(addr.Address)
-				if ip == nil {
-					continue
-				}
-				if ip.To4() == nil {
-					continue
-				}
-				return nil
+			switch instance.Status {
+			case commonParams.InstanceStopped:
+				return commonParams.ProviderInstance{}, fmt.Errorf("instance %s stopped before getting an IP address", instanceName)
+			case commonParams.InstanceError:
+				return commonParams.ProviderInstance{}, fmt.Errorf("instance %s is in error state before getting an IP address", instanceName)
 			}
-			return errIPNotFound
-		},
-		Attempts: 20,
-		Delay:    5 * time.Second,
-		Clock:    clock.WallClock,
+			lastErr = nil
+		case errors.Is(err, runnerErrors.ErrNotFound):
+			return commonParams.ProviderInstance{}, errors.Wrap(err, "fetching instance")
+		default:
+			lastErr = err
+		}
+
+		select {
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return commonParams.ProviderInstance{}, errors.Wrap(ctx.Err(), "waiting for instance IP")
+			}
+			if lastErr != nil {
+				return commonParams.ProviderInstance{}, runnerErrors.NewTimeoutError("timed out after %s waiting for instance %s to get an IP address: %s", timeout, instanceName, lastErr)
+			}
+			return commonParams.ProviderInstance{}, runnerErrors.NewTimeoutError("timed out after %s waiting for instance %s to get an IP address", timeout, instanceName)
+		case <-notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// aggregateFailure is a single failure recorded in an aggregateError.
+type aggregateFailure struct {
+	Name string
+	Err  error
+}
+
+// aggregateError collects the failures of an operation acting on several items, like
+// instances, images or the fields of a pool, so they are all reported at once instead
+// of one at a time.
+type aggregateError struct {
+	// format summarizes the error, and is given the number of failures.
+	format   string
+	Failures []aggregateFailure
+	// badRequest allows callers to treat the error as a bad request.
+	badRequest bool
+}
+
+func (a *aggregateError) add(name string, err error) {
+	a.Failures = append(a.Failures, aggregateFailure{
+		Name: name,
+		Err:  err,
 	})
+}
 
-	if err != nil && err != errIPNotFound {
-		return commonParams.ProviderInstance{}, err
+func (a *aggregateError) Error() string {
+	// Failures may be recorded in any order by parallel workers, so we sort them
+	// to get a stable message.
+	failures := slices.Clone(a.Failures)
+	slices.SortStableFunc(failures, func(x, y aggregateFailure) int {
+		return strings.Compare(x.Name, y.Name)
+	})
+	msgs := make([]string, 0, len(failures))
+	for _, failure := range failures {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", failure.Name, failure.Err))
 	}
+	return fmt.Sprintf("%s: %s", fmt.Sprintf(a.format, len(failures)), strings.Join(msgs, "; "))
+}
+
+func (a *aggregateError) Is(target error) bool {
+	_, ok := target.(*runnerErrors.BadRequestError)
+	return a.badRequest && ok
+}
+
+// errOrNil returns nil if no failures were recorded.
+func (a *aggregateError) errOrNil() error {
+	if len(a.Failures) == 0 {
+		return nil
+	}
+	return a
+}
+
+// instanceFaultError is returned when an instance failed after it was created. It holds
+// the diagnostics captured from the instance before it was removed.
+type instanceFaultError struct {
+	err   error
+	fault []byte
+}
+
+// Error includes the diagnostics, as GARM does not look at the instance returned
+// along with an error, and uses the error message as the provider fault instead.
+func (e *instanceFaultError) Error() string {
+	if len(e.fault) == 0 {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("%s\n%s", e.err, e.fault)
+}
 
-	return p, nil
+func (e *instanceFaultError) Unwrap() error {
+	return e.err
 }
 
 func ptr[T any](v T) *T {
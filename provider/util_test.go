@@ -17,12 +17,21 @@ package provider
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"testing"
+	"time"
 
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
 	commonParams "github.com/cloudbase/garm-provider-common/params"
 	"github.com/cloudbase/garm-provider-incus/config"
 	"github.com/lxc/incus/shared/api"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestIncusInstanceToAPIInstance(t *testing.T) {
@@ -72,6 +81,12 @@ func TestIncusInstanceToAPIInstance(t *testing.T) {
 
 	apiInstance := incusInstanceToAPIInstance(instance)
 	assert.Equal(t, expectedOutput, apiInstance)
+
+	// The fingerprint of the image is only kept in the instance config, so the OS
+	// version stays the release of the image.
+	instance.ExpandedConfig[imageFingerprintKeyName] = "4a3f5b2c1d0e9f8a7b6c5d4e3f2a1b0c"
+	apiInstance = incusInstanceToAPIInstance(instance)
+	assert.Equal(t, "20.04", apiInstance.OSVersion)
 }
 
 func TestGetClientFromConfig(t *testing.T) {
@@ -139,3 +154,260 @@ func TestGetClientFromConfig(t *testing.T) {
 	}
 
 }
+
+// fakeIncusSocket starts a minimal Incus API on a unix socket, that only answers
+// requests for the server info.
+func fakeIncusSocket(t *testing.T) string {
+	socket := filepath.Join(t.TempDir(), "incus.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"type": "sync", "status": "Success", "status_code": 200, "metadata": {"api_version": "1.0", "auth": "trusted"}}`)
+	}))
+	srv.Listener = listener
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return socket
+}
+
+func TestGetClientFromConfigFailover(t *testing.T) {
+	ctx := context.Background()
+	deadSocket := filepath.Join(t.TempDir(), "dead.sock")
+	liveSocket := fakeIncusSocket(t)
+
+	cli, err := getClientFromConfig(ctx, &config.Incus{
+		UnixSocket: deadSocket,
+		Endpoints:  []string{liveSocket},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, cli)
+	info, err := cli.GetConnectionInfo()
+	require.NoError(t, err)
+	require.Equal(t, liveSocket, info.SocketPath)
+
+	_, err = getClientFromConfig(ctx, &config.Incus{
+		UnixSocket: deadSocket,
+		Endpoints:  []string{"unix://" + deadSocket + ".2"},
+	})
+	require.ErrorContains(t, err, "failed to connect to any Incus endpoint")
+	require.ErrorContains(t, err, fmt.Sprintf("unix://%s: ", deadSocket))
+	require.ErrorContains(t, err, fmt.Sprintf("unix://%s.2: ", deadSocket))
+}
+
+func TestIsInstanceEvent(t *testing.T) {
+	lifecycleEvent := func(action, source string) api.Event {
+		metadata, err := json.Marshal(api.EventLifecycle{Action: action, Source: source})
+		require.NoError(t, err)
+		return api.Event{Type: api.EventTypeLifecycle, Metadata: metadata}
+	}
+
+	tests := []struct {
+		name     string
+		event    api.Event
+		expected bool
+	}{
+		{
+			name:     "instance started",
+			event:    lifecycleEvent(api.EventLifecycleInstanceStarted, "/1.0/instances/test-instance?project=garm"),
+			expected: true,
+		},
+		{
+			name:     "other instance",
+			event:    lifecycleEvent(api.EventLifecycleInstanceStarted, "/1.0/instances/other-instance"),
+			expected: false,
+		},
+		{
+			name:     "network updated",
+			event:    lifecycleEvent(api.EventLifecycleNetworkUpdated, "/1.0/networks/incusbr0"),
+			expected: true,
+		},
+		{
+			name:     "profile named like the instance",
+			event:    lifecycleEvent("profile-updated", "/1.0/profiles/test-instance"),
+			expected: false,
+		},
+		{
+			name:     "operation event",
+			event:    api.Event{Type: api.EventTypeOperation, Metadata: json.RawMessage(`{}`)},
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isInstanceEvent("test-instance", tt.event))
+		})
+	}
+}
+
+func instanceWithState(status string, addresses ...string) *api.InstanceFull {
+	network := map[string]api.InstanceStateNetwork{}
+	if len(addresses) > 0 {
+		eth0 := api.InstanceStateNetwork{}
+		for _, addr := range addresses {
+			eth0.Addresses = append(eth0.Addresses, api.InstanceStateNetworkAddress{Address: addr, Scope: "global"})
+		}
+		network["eth0"] = eth0
+	}
+	return &api.InstanceFull{
+		Instance: api.Instance{
+			Name: "test-instance",
+			InstancePut: api.InstancePut{
+				Architecture: "x86_64",
+			},
+		},
+		State: &api.InstanceState{
+			Status:  status,
+			Network: network,
+		},
+	}
+}
+
+func TestWaitInstanceHasIP(t *testing.T) {
+	defaultInterval := ipPollInterval
+	ipPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { ipPollInterval = defaultInterval })
+
+	tests := []struct {
+		name        string
+		setup       func(cli *MockIncusServer)
+		errIs       error
+		errContains string
+	}{
+		{
+			name: "address after a few checks",
+			setup: func(cli *MockIncusServer) {
+				cli.On("GetInstanceFull", "test-instance").Return(instanceWithState("Running"), "", nil).Twice()
+				cli.On("GetInstanceFull", "test-instance").Return(instanceWithState("Running", "fe80::1", "10.10.0.2"), "", nil).Once()
+			},
+		},
+		{
+			name: "no address",
+			setup: func(cli *MockIncusServer) {
+				cli.On("GetInstanceFull", "test-instance").Return(instanceWithState("Running", "fe80::1"), "", nil)
+			},
+			errIs:       runnerErrors.ErrTimeout,
+			errContains: "timed out after 1s waiting for instance test-instance to get an IP address",
+		},
+		{
+			name: "instance stopped",
+			setup: func(cli *MockIncusServer) {
+				cli.On("GetInstanceFull", "test-instance").Return(instanceWithState("Stopped"), "", nil)
+			},
+			errContains: "instance test-instance stopped before getting an IP address",
+		},
+		{
+			name: "instance in error state",
+			setup: func(cli *MockIncusServer) {
+				cli.On("GetInstanceFull", "test-instance").Return(instanceWithState("Error"), "", nil).Once()
+			},
+			errContains: "instance test-instance is in error state before getting an IP address",
+		},
+		{
+			name: "instance deleted",
+			setup: func(cli *MockIncusServer) {
+				cli.On("GetInstanceFull", "test-instance").Return((*api.InstanceFull)(nil), "", api.StatusErrorf(http.StatusNotFound, "not found"))
+			},
+			errIs: runnerErrors.ErrNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := new(MockIncusServer)
+			cli.On("GetEvents").Return(nil, fmt.Errorf("events not supported"))
+			tt.setup(cli)
+			l := &Incus{
+				cfg: &config.Incus{IPWaitTimeout: 1},
+				cli: cli,
+			}
+
+			instance, err := l.waitInstanceHasIP(context.Background(), "test-instance")
+			if tt.errIs == nil && tt.errContains == "" {
+				require.NoError(t, err)
+				assert.Equal(t, "test-instance", instance.Name)
+				assert.True(t, hasIPv4Address(instance))
+				cli.AssertExpectations(t)
+				return
+			}
+			if tt.errIs != nil {
+				require.ErrorIs(t, err, tt.errIs)
+			}
+			if tt.errContains != "" {
+				require.ErrorContains(t, err, tt.errContains)
+			}
+		})
+	}
+}
+
+func TestWaitInstanceHasIPContextCanceled(t *testing.T) {
+	cli := new(MockIncusServer)
+	cli.On("GetEvents").Return(nil, fmt.Errorf("events not supported"))
+	cli.On("GetInstanceFull", "test-instance").Return(instanceWithState("Running"), "", nil)
+	l := &Incus{
+		cfg: &config.Incus{},
+		cli: cli,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := l.waitInstanceHasIP(ctx, "test-instance")
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestFlavorToProfile(t *testing.T) {
+	flavor := config.Flavor{
+		CPU:      4,
+		Memory:   "8GiB",
+		DiskSize: "40GiB",
+		DiskPool: "fast",
+		NICs: map[string]config.FlavorNIC{
+			"eth0": {
+				Network: "runners",
+			},
+			"eth1": {
+				NICType: "macvlan",
+				Parent:  "enp5s0",
+			},
+		},
+		Config: map[string]string{
+			"security.nesting": "true",
+		},
+	}
+	expected := api.ProfilePut{
+		Description: "Flavor managed by garm",
+		Config: map[string]string{
+			"limits.cpu":       "4",
+			"limits.memory":    "8GiB",
+			"security.nesting": "true",
+		},
+		Devices: map[string]map[string]string{
+			"root": {
+				"type": "disk",
+				"path": "/",
+				"pool": "fast",
+				"size": "40GiB",
+			},
+			"eth0": {
+				"type":    "nic",
+				"name":    "eth0",
+				"network": "runners",
+			},
+			"eth1": {
+				"type":    "nic",
+				"name":    "eth1",
+				"nictype": "macvlan",
+				"parent":  "enp5s0",
+			},
+		},
+	}
+
+	profile := flavorToProfile(flavor)
+	assert.Equal(t, expected, profile)
+	assert.True(t, profileMatches(expected, profile))
+
+	expected.Devices["root"]["size"] = "20GiB"
+	assert.False(t, profileMatches(expected, profile))
+}
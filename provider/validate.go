@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-incus/config"
+	"github.com/pkg/errors"
+)
+
+// validateImage attempts to resolve the image for every architecture we support.
+// The image is considered valid as long as it resolves for at least one of them,
+// as pools are usually defined for a single architecture. If the image is pinned to
+// a fingerprint, it must resolve to that fingerprint.
+func (l *Incus) validateImage(ctx context.Context, imageName string, instanceType config.IncusImageType, pinned string) error {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+
+	archs := make([]string, 0, len(configToIncusArchMap))
+	for _, arch := range configToIncusArchMap {
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+
+	archErrs := []string{}
+	for _, arch := range archs {
+		source, err := l.imageManager.getInstanceSource(imageName, instanceType, arch, cli)
+		if err != nil {
+			archErrs = append(archErrs, fmt.Sprintf("%s: %s", arch, err))
+			continue
+		}
+		switch {
+		case pinned != "":
+			if err := l.imageManager.pinInstanceSource(&source, imageName, instanceType, arch, pinned); err != nil {
+				archErrs = append(archErrs, fmt.Sprintf("%s: %s", arch, err))
+				continue
+			}
+		case source.Fingerprint == "" && source.Protocol == string(config.SimpleStreams):
+			// Aliases on simplestreams remotes are only resolved by the Incus server
+			// when the instance is created, so we resolve them here to catch typos.
+			if err := l.validateRemoteAlias(imageName, instanceType, arch); err != nil {
+				archErrs = append(archErrs, fmt.Sprintf("%s: %s", arch, err))
+				continue
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("could not resolve %s image %s for any architecture (%s)", instanceType, imageName, strings.Join(archErrs, ", "))
+}
+
+// validateRemoteAlias makes sure an image alias exists on a simplestreams remote for
+// the given image type and architecture.
+func (l *Incus) validateRemoteAlias(imageName string, instanceType config.IncusImageType, arch string) error {
+	remote, parsedName, err := l.imageManager.parseImageName(imageName)
+	if err != nil {
+		return errors.Wrapf(err, "parsing image name: %s", imageName)
+	}
+	if _, _, err := l.imageManager.resolveRemoteImage(remote, parsedName, instanceType, arch); err != nil {
+		return errors.Wrapf(err, "resolving image %s", imageName)
+	}
+	return nil
+}
+
+// validatePool checks the image, flavor and extra specs of a pool against the
+// Incus server we are connected to.
+func (l *Incus) validatePool(ctx context.Context, image, flavor, extraspecs string) error {
+	validationErr := &aggregateError{
+		format:     "invalid pool (%d errors)",
+		badRequest: true,
+	}
+
+	specs := extraSpecs{}
+	if extraspecs != "" {
+		var err error
+		specs, err = parseExtraSpecsFromBootstrapParams(commonParams.BootstrapInstance{
+			ExtraSpecs: json.RawMessage(extraspecs),
+		})
+		if err != nil {
+			validationErr.add("extra_specs", err)
+		} else if err := checkPassthrough(specs, l.cfg.Passthrough); err != nil {
+			validationErr.add("extra_specs", err)
+		} else if l.getBootstrapMode(specs) == config.BootstrapExec {
+			if err := specs.checkExecBootstrap(); err != nil {
+				validationErr.add("extra_specs", err)
+			}
+		}
+	}
+
+	// The image is not used by pools that clone runners from a golden instance.
+	instanceType := l.getInstanceType(specs)
+	if specs.GoldenInstance != "" {
+		var err error
+		if _, instanceType, err = l.getGoldenInstanceSource(ctx, specs.GoldenInstance, ""); err != nil {
+			validationErr.add("golden_instance", err)
+		}
+	} else if image != "" {
+		if err := l.validateImage(ctx, image, instanceType, specs.ImageFingerprint); err != nil {
+			validationErr.add("image", err)
+		}
+	}
+	if err := specs.checkInstanceType(instanceType); err != nil {
+		validationErr.add("extra_specs", err)
+	}
+
+	if flavor != "" {
+		if _, err := l.getProfiles(ctx, flavor); err != nil {
+			validationErr.add("flavor", err)
+		}
+	}
+
+	return validationErr.errOrNil()
+}
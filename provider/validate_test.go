@@ -0,0 +1,201 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-incus/config"
+	"github.com/lxc/incus/shared/api"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePool(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+	srv := new(MockIncusServer)
+	l := &Incus{
+		cfg: &config.Incus{
+			InstanceType: "container",
+			Flavors: map[string]config.Flavor{
+				"medium": {CPU: 4},
+			},
+		},
+		cli: cli,
+		imageManager: &image{
+			remotes: map[string]config.IncusImageRemote{
+				"images": {
+					Address:  "https://images.linuxcontainers.org",
+					Protocol: config.SimpleStreams,
+				},
+			},
+			connectRemote: func(config.IncusImageRemote) (ImageServerInterface, error) {
+				return srv, nil
+			},
+		},
+		controllerID: "controller",
+	}
+	aliases := map[string]*api.ImageAliasesEntry{
+		"aarch64": {
+			ImageAliasesEntryPut: api.ImageAliasesEntryPut{
+				Target: "arm-image",
+			},
+		},
+	}
+	cli.On("GetProfileNames").Return([]string{"default", "small"}, nil)
+	cli.On("GetImageAliasArchitectures", "container", "ubuntu").Return(aliases, nil)
+	cli.On("GetImageAliasArchitectures", "container", "missing").Return(map[string]*api.ImageAliasesEntry{}, fmt.Errorf("not found"))
+	cli.On("GetImage", "arm-image").Return(&api.Image{Fingerprint: "123abc"}, "", nil)
+	cli.On("GetInstance", "golden").Return(&api.Instance{Name: "golden", StatusCode: api.Stopped}, "", nil)
+	srv.On("GetImages").Return([]api.Image{
+		{
+			Fingerprint:  "456def",
+			Architecture: "x86_64",
+			Type:         "container",
+			Aliases:      []api.ImageAlias{{Name: "ubuntu/jammy"}, {Name: "ubuntu/22.04"}},
+			ImagePut: api.ImagePut{
+				Properties: map[string]string{"os": "Ubuntu", "release": "jammy", "variant": "default"},
+			},
+		},
+	}, nil)
+	srv.On("GetImageAliasArchitectures", "container", "ubuntu/22.04/cloud").Return(map[string]*api.ImageAliasesEntry{
+		"x86_64": {
+			ImageAliasesEntryPut: api.ImageAliasesEntryPut{
+				Target: "remote-image",
+			},
+		},
+	}, nil)
+	srv.On("GetImageAliasArchitectures", "container", "ubuntu/22.04/clod").Return(map[string]*api.ImageAliasesEntry{}, fmt.Errorf("not found"))
+	srv.On("GetImage", "remote-image").Return(&api.Image{Fingerprint: "789ghi"}, "", nil)
+	cli.On("GetInstance", "missing-golden").Return(nil, "", api.StatusErrorf(http.StatusNotFound, "Instance not found"))
+
+	tests := []struct {
+		name       string
+		image      string
+		flavor     string
+		extraSpecs string
+		errStrings []string
+		failures   int
+	}{
+		{
+			name:       "valid local image for a single architecture",
+			image:      "ubuntu",
+			flavor:     "small",
+			extraSpecs: `{"disable_updates": true}`,
+		},
+		{
+			name:   "valid remote image",
+			image:  "images:ubuntu/22.04/cloud",
+			flavor: "small",
+		},
+		{
+			name:       "missing remote image",
+			image:      "images:ubuntu/22.04/clod",
+			flavor:     "small",
+			errStrings: []string{"image: could not resolve container image images:ubuntu/22.04/clod for any architecture (aarch64: resolving image images:ubuntu/22.04/clod: resolving alias: ubuntu/22.04/clod: not found"},
+			failures:   1,
+		},
+		{
+			// The profile of the flavor is only created when creating an instance.
+			name:   "flavor defined in the provider config",
+			image:  "ubuntu",
+			flavor: "medium",
+		},
+		{
+			name:       "all fields invalid",
+			image:      "missing",
+			flavor:     "large",
+			extraSpecs: `{"disable_updates": "true"}`,
+			errStrings: []string{
+				"extra_specs: failed to validate extra specs",
+				"image: could not resolve container image missing for any architecture",
+				"flavor: looking for profile large",
+			},
+			failures: 3,
+		},
+		{
+			name:       "golden instance replaces the image",
+			image:      "missing",
+			flavor:     "small",
+			extraSpecs: `{"golden_instance": "golden"}`,
+		},
+		{
+			name:       "missing golden instance",
+			image:      "ubuntu",
+			flavor:     "small",
+			extraSpecs: `{"golden_instance": "missing-golden"}`,
+			errStrings: []string{"golden_instance: golden instance missing-golden not found"},
+			failures:   1,
+		},
+		{
+			name:       "pinned fingerprint does not match",
+			image:      "ubuntu",
+			flavor:     "small",
+			extraSpecs: `{"image_fingerprint": "000000000000"}`,
+			errStrings: []string{"image: could not resolve container image ubuntu for any architecture (aarch64: image ubuntu resolved to fingerprint 123abc, which does not match the pinned fingerprint 000000000000"},
+			failures:   1,
+		},
+		{
+			name:   "image selector",
+			image:  "images:ubuntu/22.04?variant=default",
+			flavor: "small",
+		},
+		{
+			name:       "image selector without matches",
+			image:      "images:ubuntu/22.04?variant=cloud",
+			flavor:     "small",
+			errStrings: []string{"x86_64: resolving image images:ubuntu/22.04?variant=cloud: image selector ubuntu/22.04?variant=cloud matches no images for arch x86_64 and image type container, available: ubuntu/jammy?variant=default"},
+			failures:   1,
+		},
+		{
+			name:       "unknown remote",
+			image:      "bogus:ubuntu/22.04/cloud",
+			flavor:     "small",
+			errStrings: []string{"image: could not resolve"},
+			failures:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := l.validatePool(ctx, tt.image, tt.flavor, tt.extraSpecs)
+			if len(tt.errStrings) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			for _, errString := range tt.errStrings {
+				assert.Contains(t, err.Error(), errString)
+			}
+			var validationErr *aggregateError
+			require.True(t, errors.As(err, &validationErr))
+			assert.Len(t, validationErr.Failures, tt.failures)
+			assert.ErrorIs(t, err, runnerErrors.ErrBadRequest)
+		})
+	}
+
+	// Validating a pool never writes to Incus.
+	cli.AssertNotCalled(t, "GetProfile", mock.Anything)
+	cli.AssertNotCalled(t, "CreateProfile", mock.Anything)
+	cli.AssertNotCalled(t, "UpdateProfile", mock.Anything, mock.Anything, mock.Anything)
+}
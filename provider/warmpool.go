@@ -0,0 +1,230 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"time"
+
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-incus/config"
+	"github.com/lxc/incus/shared/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	// warmInstancePrefix is the name prefix of the clones kept in warm pools.
+	warmInstancePrefix = "garm-warm-"
+	// warmInstanceStartTimeout is the time after which a warm clone that is not
+	// running is considered broken, and is removed.
+	warmInstanceStartTimeout = 10 * time.Minute
+)
+
+// claimWarmInstance claims a running clone of the given source from the warm pool of
+// a pool, for a new runner. The clone is marked as a runner of this controller, and
+// gets the name of the runner in its config. Returns an empty name if no clone is
+// available.
+func (l *Incus) claimWarmInstance(ctx context.Context, bootstrapParams commonParams.BootstrapInstance, source string) (string, error) {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "fetching client")
+	}
+
+	clones, err := l.getStandbyInstances(cli, warmPoolIDKey, bootstrapParams.PoolID)
+	if err != nil {
+		return "", errors.Wrap(err, "fetching warm instances")
+	}
+
+	for _, clone := range clones {
+		if clone.Config[goldenSourceKeyName] != source || clone.State == nil || !hasIPv4Address(incusInstanceToAPIInstance(&clone)) {
+			continue
+		}
+		if err := l.claimInstance(cli, clone.Name, bootstrapParams); err != nil {
+			// Another runner may have claimed the clone first.
+			log.Printf("failed to claim warm instance %s: %s", clone.Name, err)
+			continue
+		}
+		return clone.Name, nil
+	}
+	return "", nil
+}
+
+// claimInstance turns a warm clone into a runner. The update is done with the etag of
+// the clone, so only one runner can claim it.
+func (l *Incus) claimInstance(cli InstanceServerInterface, instanceName string, bootstrapParams commonParams.BootstrapInstance) error {
+	instance, etag, err := cli.GetInstance(instanceName)
+	if err != nil {
+		return errors.Wrap(err, "fetching instance")
+	}
+	if instance.Config[warmPoolIDKey] != bootstrapParams.PoolID {
+		return fmt.Errorf("instance is not in the warm pool")
+	}
+
+	instancePut := instance.Writable()
+	instancePut.Config = maps.Clone(instancePut.Config)
+	for _, key := range standbyConfigKeys {
+		delete(instancePut.Config, key)
+	}
+	instancePut.Config[controllerIDKeyName] = l.controllerID
+	instancePut.Config[poolIDKey] = bootstrapParams.PoolID
+	instancePut.Config[runnerNameKeyName] = bootstrapParams.Name
+
+	op, err := cli.UpdateInstance(instanceName, instancePut, etag)
+	if err != nil {
+		return errors.Wrap(err, "updating instance")
+	}
+	if err := op.Wait(); err != nil {
+		return errors.Wrap(err, "waiting for instance update")
+	}
+	return nil
+}
+
+// bootstrapWarmInstance registers the runner in a clone claimed from a warm pool,
+// through the Incus exec API. The clone is removed if the bootstrap fails.
+func (l *Incus) bootstrapWarmInstance(ctx context.Context, instanceName string, instanceType config.IncusImageType, files bootstrapFiles) (commonParams.ProviderInstance, error) {
+	if err := l.execBootstrap(ctx, instanceName, instanceType, files); err != nil {
+		err = l.rollbackInstance(ctx, instanceName, err)
+		return commonParams.ProviderInstance{}, errors.Wrap(err, "bootstrapping instance")
+	}
+
+	instance, err := l.getInstanceFull(ctx, instanceName)
+	if err != nil {
+		return commonParams.ProviderInstance{}, errors.Wrap(err, "fetching instance")
+	}
+	return incusInstanceToAPIInstance(instance), nil
+}
+
+// reconcileWarmPool makes sure the warm pool of a pool holds the given number of clones
+// of the golden instance or template of the pool. New clones are started, but we don't
+// wait for them to boot. Clones of another golden instance or template, left over when
+// the golden template is rebuilt or the golden instance of the pool changes, clones that
+// failed to start and clones beyond the size of the warm pool are removed. If golden is
+// empty, all the clones are removed.
+func (l *Incus) reconcileWarmPool(ctx context.Context, spec poolWorkerSpec, golden string) error {
+	cli, err := l.getCLI(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetching client")
+	}
+
+	clones, err := l.getStandbyInstances(cli, warmPoolIDKey, spec.PoolID)
+	if err != nil {
+		return errors.Wrap(err, "fetching warm instances")
+	}
+
+	// Clones are sorted oldest first, so we keep the ones most likely to have booted.
+	var count uint
+	for _, clone := range clones {
+		stale := golden == "" || clone.Config[goldenSourceKeyName] != golden
+		broken := clone.StatusCode != api.Running && time.Since(clone.CreatedAt) > warmInstanceStartTimeout
+		if stale || broken || count >= spec.WarmPoolSize {
+			if err := l.removeWarmInstance(ctx, cli, clone.Name, spec.PoolID); err != nil {
+				log.Printf("failed to remove warm instance %s: %s", clone.Name, err)
+			}
+			continue
+		}
+		count++
+	}
+
+	if golden == "" || count >= spec.WarmPoolSize {
+		return nil
+	}
+
+	args, err := l.warmInstanceArgs(ctx, spec, golden)
+	if err != nil {
+		return errors.Wrap(err, "getting warm instance args")
+	}
+	for ; count < spec.WarmPoolSize; count++ {
+		args.Name = fmt.Sprintf("%s%d", warmInstancePrefix, time.Now().UnixNano())
+		// We give up on the first failure, instead of hammering a full storage pool.
+		if err := l.launchInstance(ctx, args); err != nil {
+			return errors.Wrapf(err, "adding instance %s to the warm pool", args.Name)
+		}
+	}
+	return nil
+}
+
+// removeWarmInstance removes a clone from the warm pool. The clone is taken out of the
+// warm pool first, with its etag, so we never remove a clone a runner just claimed.
+func (l *Incus) removeWarmInstance(ctx context.Context, cli InstanceServerInterface, instanceName string, poolID string) error {
+	instance, etag, err := cli.GetInstance(instanceName)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil
+		}
+		return errors.Wrap(err, "fetching instance")
+	}
+	if instance.Config[warmPoolIDKey] != poolID {
+		// Claimed since it was listed.
+		return nil
+	}
+
+	instancePut := instance.Writable()
+	instancePut.Config = maps.Clone(instancePut.Config)
+	delete(instancePut.Config, warmPoolIDKey)
+	op, err := cli.UpdateInstance(instanceName, instancePut, etag)
+	if err != nil {
+		return errors.Wrap(err, "taking instance out of the warm pool")
+	}
+	if err := op.Wait(); err != nil {
+		return errors.Wrap(err, "waiting for instance update")
+	}
+	return l.deleteInstance(ctx, instanceName)
+}
+
+// warmInstanceBaseArgs returns the arguments of the warm clones of a pool, from the ones
+// of a runner of the pool. Warm clones are not runners until they are claimed, so they
+// are not marked with the controller and pool IDs, and get no user data. The source is
+// set by the pool worker, which knows which golden template is current.
+func warmInstanceBaseArgs(args api.InstancesPost) api.InstancesPost {
+	warmArgs := args
+	warmArgs.Name = ""
+	warmArgs.Source = api.InstanceSource{}
+	warmArgs.Type = ""
+	warmArgs.Config = maps.Clone(args.Config)
+	delete(warmArgs.Config, controllerIDKeyName)
+	delete(warmArgs.Config, poolIDKey)
+	// Clones inherit the fingerprint recorded on the golden instance.
+	delete(warmArgs.Config, imageFingerprintKeyName)
+	for _, key := range bootstrapConfigKeys {
+		warmArgs.Config[key] = ""
+	}
+	return warmArgs
+}
+
+// warmInstanceArgs returns the arguments used to create a warm clone of the given golden
+// instance or template.
+func (l *Incus) warmInstanceArgs(ctx context.Context, spec poolWorkerSpec, golden string) (api.InstancesPost, error) {
+	source, instanceType, err := l.getGoldenInstanceSource(ctx, golden, spec.Clone.Architecture)
+	if err != nil {
+		return api.InstancesPost{}, errors.Wrap(err, "getting golden instance")
+	}
+
+	args := spec.Clone
+	args.Description = fmt.Sprintf("Warm clone of pool %s, maintained by garm", spec.PoolID)
+	args.Source = source
+	args.Type = api.InstanceType(instanceType)
+	args.Config = maps.Clone(spec.Clone.Config)
+	if args.Config == nil {
+		args.Config = map[string]string{}
+	}
+	setCloneConfig(args.Config, golden)
+	args.Config[standbyControllerIDKeyName] = l.controllerID
+	args.Config[warmPoolIDKey] = spec.PoolID
+	return args, nil
+}
@@ -0,0 +1,376 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudbase/garm-provider-common/cloudconfig"
+	commonParams "github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-incus/config"
+	"github.com/lxc/incus/shared/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var warmPoolFilters = []string{
+	"config.user.runner-standby-controller-id=controller",
+	"config.user.runner-warm-pool-id=pool",
+}
+
+func warmInstance(name string, source string, status api.StatusCode, created time.Time, addresses ...string) api.InstanceFull {
+	network := map[string]api.InstanceStateNetwork{}
+	for _, addr := range addresses {
+		network["eth0"] = api.InstanceStateNetwork{
+			Addresses: []api.InstanceStateNetworkAddress{
+				{Address: addr, Scope: "global"},
+			},
+		}
+	}
+	return api.InstanceFull{
+		Instance: api.Instance{
+			Name: name,
+			InstancePut: api.InstancePut{
+				Config: map[string]string{
+					standbyControllerIDKeyName: "controller",
+					warmPoolIDKey:              "pool",
+					goldenSourceKeyName:        source,
+				},
+			},
+			CreatedAt:  created,
+			Status:     status.String(),
+			StatusCode: status,
+		},
+		State: &api.InstanceState{
+			Status:  status.String(),
+			Network: network,
+		},
+	}
+}
+
+func TestClaimWarmInstance(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg:          &config.Incus{},
+		cli:          cli,
+		controllerID: "controller",
+	}
+	now := time.Now()
+	clones := []api.InstanceFull{
+		warmInstance("garm-warm-other-source", "old-golden", api.Running, now.Add(-4*time.Minute), "10.10.0.2"),
+		warmInstance("garm-warm-booting", "golden", api.Running, now.Add(-3*time.Minute)),
+		warmInstance("garm-warm-taken", "golden", api.Running, now.Add(-2*time.Minute), "10.10.0.3"),
+		warmInstance("garm-warm-free", "golden", api.Running, now.Add(-time.Minute), "10.10.0.4"),
+	}
+	cli.On("HasExtension", "api_filtering").Return(true)
+	cli.On("GetInstancesFullWithFilter", api.InstanceTypeAny, warmPoolFilters).Return(clones, nil)
+	for _, clone := range clones {
+		cli.On("GetInstance", clone.Name).Return(&clone.Instance, clone.Name+"-etag", nil)
+	}
+	// The clone was claimed by another runner since it was listed.
+	cli.On("UpdateInstance", "garm-warm-taken", mock.Anything, "garm-warm-taken-etag").Return((*MockOperation)(nil), api.StatusErrorf(http.StatusPreconditionFailed, "ETag doesn't match"))
+	mockOp := new(MockOperation)
+	mockOp.On("Wait").Return(nil)
+	cli.On("UpdateInstance", "garm-warm-free", mock.Anything, "garm-warm-free-etag").Return(mockOp, nil)
+
+	bootstrapParams := commonParams.BootstrapInstance{
+		Name:   "runner-1",
+		PoolID: "pool",
+	}
+	name, err := l.claimWarmInstance(ctx, bootstrapParams, "golden")
+	require.NoError(t, err)
+	assert.Equal(t, "garm-warm-free", name)
+	cli.AssertCalled(t, "UpdateInstance", "garm-warm-free", api.InstancePut{
+		Config: map[string]string{
+			controllerIDKeyName: "controller",
+			poolIDKey:           "pool",
+			runnerNameKeyName:   "runner-1",
+			goldenSourceKeyName: "golden",
+		},
+	}, "garm-warm-free-etag")
+	cli.AssertNotCalled(t, "UpdateInstance", "garm-warm-other-source", mock.Anything, mock.Anything)
+	cli.AssertNotCalled(t, "UpdateInstance", "garm-warm-booting", mock.Anything, mock.Anything)
+	// The config of the listed clone is not changed in place.
+	assert.Equal(t, "pool", clones[3].Config[warmPoolIDKey])
+}
+
+func TestClaimWarmInstanceEmptyPool(t *testing.T) {
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg:          &config.Incus{},
+		cli:          cli,
+		controllerID: "controller",
+	}
+	cli.On("HasExtension", "api_filtering").Return(true)
+	cli.On("GetInstancesFullWithFilter", api.InstanceTypeAny, warmPoolFilters).Return([]api.InstanceFull{}, nil)
+
+	name, err := l.claimWarmInstance(context.Background(), commonParams.BootstrapInstance{Name: "runner-1", PoolID: "pool"}, "golden")
+	require.NoError(t, err)
+	assert.Empty(t, name)
+}
+
+// mockRemoveWarmInstance mocks taking the given clone out of the warm pool and removing it.
+func mockRemoveWarmInstance(cli *MockIncusServer, mockOp *MockOperation, clone api.InstanceFull) {
+	cli.On("GetInstance", clone.Name).Return(&clone.Instance, "etag-"+clone.Name, nil)
+	cli.On("UpdateInstance", clone.Name, mock.Anything, "etag-"+clone.Name).Return(mockOp, nil)
+}
+
+func TestReconcileWarmPool(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg:          &config.Incus{},
+		cli:          cli,
+		controllerID: "controller",
+	}
+	now := time.Now()
+	clones := []api.InstanceFull{
+		warmInstance("garm-warm-stale", "old-golden", api.Running, now.Add(-time.Hour), "10.10.0.2"),
+		warmInstance("garm-warm-broken", "golden", api.Stopped, now.Add(-time.Hour)),
+		warmInstance("garm-warm-starting", "golden", api.Stopped, now.Add(-time.Second)),
+		warmInstance("garm-warm-ready", "golden", api.Running, now.Add(-time.Minute), "10.10.0.3"),
+	}
+	cli.On("HasExtension", "api_filtering").Return(true)
+	cli.On("GetInstancesFullWithFilter", api.InstanceTypeAny, warmPoolFilters).Return(clones, nil)
+	mockOp := new(MockOperation)
+	mockOp.On("Wait").Return(nil)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+	mockRemoveWarmInstance(cli, mockOp, clones[0])
+	mockRemoveWarmInstance(cli, mockOp, clones[1])
+	cli.On("GetInstance", "golden").Return(&api.Instance{
+		Name:       "golden",
+		Type:       "container",
+		StatusCode: api.Stopped,
+	}, "", nil)
+	cli.On("UpdateInstanceState", mock.Anything, mock.Anything, "").Return(mockOp, nil)
+	cli.On("DeleteInstance", mock.Anything).Return(mockOp, nil)
+	cli.On("CreateInstance", mock.Anything).Return(mockOp, nil)
+
+	spec := poolWorkerSpec{
+		PoolID:       "pool",
+		WarmPoolSize: 4,
+		Clone: warmInstanceBaseArgs(api.InstancesPost{
+			InstancePut: api.InstancePut{
+				Config: map[string]string{
+					controllerIDKeyName:     "controller",
+					poolIDKey:               "pool",
+					userDataKeyName:         "#cloud-config",
+					imageFingerprintKeyName: "123abc",
+					osTypeKeyName:           "linux",
+				},
+			},
+			Source: api.InstanceSource{Type: "image", Alias: "ubuntu"},
+			Name:   "runner-1",
+			Type:   "container",
+		}),
+	}
+	require.NoError(t, l.reconcileWarmPool(ctx, spec, "golden"))
+
+	cli.AssertNumberOfCalls(t, "DeleteInstance", 2)
+	for _, name := range []string{"garm-warm-stale", "garm-warm-broken"} {
+		cli.AssertCalled(t, "UpdateInstance", name, mock.MatchedBy(func(put api.InstancePut) bool {
+			_, ok := put.Config[warmPoolIDKey]
+			return !ok
+		}), "etag-"+name)
+		cli.AssertCalled(t, "DeleteInstance", name)
+	}
+	cli.AssertNumberOfCalls(t, "CreateInstance", 2)
+	cli.AssertCalled(t, "CreateInstance", mock.MatchedBy(func(warmArgs api.InstancesPost) bool {
+		return strings.HasPrefix(warmArgs.Name, warmInstancePrefix) &&
+			assert.ObjectsAreEqual(api.InstanceSource{Type: "copy", Source: "golden", InstanceOnly: true}, warmArgs.Source) &&
+			assert.ObjectsAreEqual(map[string]string{
+				standbyControllerIDKeyName:    "controller",
+				warmPoolIDKey:                 "pool",
+				userDataKeyName:               "",
+				vendorDataKeyName:             "",
+				networkConfigKeyName:          "",
+				cloudInitUserDataKeyName:      "",
+				cloudInitVendorDataKeyName:    "",
+				cloudInitNetworkConfigKeyName: "",
+				goldenSourceKeyName:           "golden",
+				goldenPoolIDKey:               "",
+				goldenVersionKeyName:          "",
+				goldenReadyKeyName:            "",
+				osTypeKeyName:                 "linux",
+			}, warmArgs.Config)
+	}))
+	// The arguments in the spec are left untouched.
+	assert.Empty(t, spec.Clone.Config[warmPoolIDKey])
+}
+
+func TestReconcileWarmPoolShrink(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg:          &config.Incus{},
+		cli:          cli,
+		controllerID: "controller",
+	}
+	now := time.Now()
+	clones := []api.InstanceFull{
+		warmInstance("garm-warm-1", "golden", api.Running, now.Add(-time.Hour), "10.10.0.2"),
+		warmInstance("garm-warm-2", "golden", api.Running, now.Add(-time.Minute), "10.10.0.3"),
+		warmInstance("garm-warm-3", "golden", api.Running, now.Add(-time.Second), "10.10.0.4"),
+	}
+	cli.On("HasExtension", "api_filtering").Return(true)
+	cli.On("GetInstancesFullWithFilter", api.InstanceTypeAny, warmPoolFilters).Return(clones, nil)
+	mockOp := new(MockOperation)
+	mockOp.On("Wait").Return(nil)
+	mockOp.On("WaitContext", mock.Anything).Return(nil)
+	mockRemoveWarmInstance(cli, mockOp, clones[1])
+	// The last clone was claimed by a runner since it was listed.
+	claimed := clones[2]
+	claimed.Config = map[string]string{runnerNameKeyName: "runner-1"}
+	cli.On("GetInstance", "garm-warm-3").Return(&claimed.Instance, "etag", nil)
+	cli.On("UpdateInstanceState", mock.Anything, mock.Anything, "").Return(mockOp, nil)
+	cli.On("DeleteInstance", mock.Anything).Return(mockOp, nil)
+
+	require.NoError(t, l.reconcileWarmPool(ctx, poolWorkerSpec{PoolID: "pool", WarmPoolSize: 1}, "golden"))
+
+	cli.AssertNumberOfCalls(t, "DeleteInstance", 1)
+	cli.AssertCalled(t, "DeleteInstance", "garm-warm-2")
+	cli.AssertNotCalled(t, "UpdateInstance", "garm-warm-3", mock.Anything, mock.Anything)
+	cli.AssertNotCalled(t, "CreateInstance", mock.Anything)
+}
+
+func TestReconcileWarmPoolCreateFails(t *testing.T) {
+	cli := new(MockIncusServer)
+	l := &Incus{
+		cfg:          &config.Incus{},
+		cli:          cli,
+		controllerID: "controller",
+	}
+	cli.On("HasExtension", "api_filtering").Return(true)
+	cli.On("GetInstancesFullWithFilter", api.InstanceTypeAny, warmPoolFilters).Return([]api.InstanceFull{}, nil)
+	cli.On("GetInstance", "golden").Return(&api.Instance{
+		Name:       "golden",
+		Type:       "container",
+		StatusCode: api.Stopped,
+	}, "", nil)
+	cli.On("CreateInstance", mock.Anything).Return((*MockOperation)(nil), fmt.Errorf("no space left"))
+
+	err := l.reconcileWarmPool(context.Background(), poolWorkerSpec{PoolID: "pool", WarmPoolSize: 3}, "golden")
+	require.Error(t, err)
+
+	// We give up on the first failure, instead of hammering a full storage pool.
+	cli.AssertNumberOfCalls(t, "CreateInstance", 1)
+}
+
+func TestCreateInstanceFromWarmPool(t *testing.T) {
+	ctx := context.Background()
+	cli := new(MockIncusServer)
+	bootstrapLog = io.Discard
+	t.Cleanup(func() {
+		bootstrapLog = os.Stderr
+	})
+	l := &Incus{
+		cfg: &config.Incus{
+			UnixSocket:   "/var/run/incus.sock",
+			InstanceType: config.IncusImageContainer,
+		},
+		cli:          cli,
+		imageManager: &image{},
+		controllerID: "controller",
+		stateDir:     t.TempDir(),
+	}
+	var worker poolWorkerSpec
+	spawnPoolWorker = func(_ *Incus, spec poolWorkerSpec) error {
+		worker = spec
+		return nil
+	}
+	DefaultToolFetch = func(_ commonParams.OSType, _ commonParams.OSArch, tools []commonParams.RunnerApplicationDownload) (commonParams.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+	DefaultGetCloudconfig = func(_ commonParams.BootstrapInstance, _ commonParams.RunnerApplicationDownload, _ string) (string, error) {
+		return "#cloud-config", nil
+	}
+	DefaultGetRunnerInstallScript = func(_ commonParams.BootstrapInstance, _ commonParams.RunnerApplicationDownload, _ string) ([]byte, error) {
+		return []byte("#!/bin/bash\necho registering"), nil
+	}
+	t.Cleanup(func() {
+		DefaultGetRunnerInstallScript = cloudconfig.GetRunnerInstallScript
+		spawnPoolWorker = startDetachedPoolWorker
+	})
+
+	bootstrapParams := commonParams.BootstrapInstance{
+		Name: "runner-1",
+		Tools: []commonParams.RunnerApplicationDownload{
+			{
+				OS:           ptr("linux"),
+				Architecture: ptr("x64"),
+				DownloadURL:  ptr("https://example.com"),
+				Filename:     ptr("test-app"),
+			},
+		},
+		Image:      "ignored",
+		Flavor:     "default",
+		PoolID:     "pool",
+		OSArch:     commonParams.Amd64,
+		OSType:     commonParams.Linux,
+		ExtraSpecs: []byte(`{"golden_instance": "golden", "warm_pool_size": 1}`),
+	}
+
+	cli.On("GetProfileNames").Return([]string{"default"}, nil)
+	cli.On("GetInstance", "golden").Return(&api.Instance{
+		Name: "golden",
+		InstancePut: api.InstancePut{
+			Architecture: "x86_64",
+		},
+		Type:       "container",
+		StatusCode: api.Stopped,
+	}, "", nil)
+	clone := warmInstance("garm-warm-1", "golden", api.Running, time.Now().Add(-time.Minute), "10.10.0.2")
+	cli.On("HasExtension", "api_filtering").Return(true)
+	cli.On("GetInstancesFullWithFilter", api.InstanceTypeAny, warmPoolFilters).Return([]api.InstanceFull{clone}, nil)
+	cli.On("GetInstance", "garm-warm-1").Return(&clone.Instance, "etag", nil)
+	mockOp := new(MockOperation)
+	mockOp.On("Wait").Return(nil)
+	cli.On("UpdateInstance", "garm-warm-1", mock.Anything, "etag").Return(mockOp, nil)
+	cli.On("CreateInstanceFile", "garm-warm-1", mock.Anything, mock.Anything).Return(nil)
+	mockBootstrapExec(cli, "garm-warm-1", "runner registered\n", 0)
+	claimed := clone
+	claimed.ExpandedConfig = map[string]string{
+		controllerIDKeyName: "controller",
+		poolIDKey:           "pool",
+		runnerNameKeyName:   "runner-1",
+	}
+	cli.On("GetInstanceFull", "garm-warm-1").Return(&claimed, "", nil)
+
+	instance, err := l.CreateInstance(ctx, bootstrapParams)
+	require.NoError(t, err)
+	assert.Equal(t, "runner-1", instance.Name)
+	assert.Equal(t, "garm-warm-1", instance.ProviderID)
+	cli.AssertCalled(t, "ExecInstance", "garm-warm-1", mock.MatchedBy(func(req api.InstanceExecPost) bool {
+		return req.Command[1] == bootstrapScriptPath
+	}), mock.Anything)
+	// The warm pool is refilled in the background.
+	cli.AssertNotCalled(t, "CreateInstance", mock.Anything)
+	assert.Equal(t, "pool", worker.PoolID)
+	assert.Equal(t, "golden", worker.GoldenInstance)
+	assert.Equal(t, uint(1), worker.WarmPoolSize)
+	assert.Empty(t, worker.Clone.Name)
+	assert.Empty(t, worker.Clone.Config[controllerIDKeyName])
+	assert.Empty(t, worker.Clone.Config[userDataKeyName])
+}